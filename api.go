@@ -0,0 +1,233 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bitly/nsq/nsqd"
+	"github.com/shipwire/ansqd/internal/admin"
+	"github.com/shipwire/ansqd/internal/logging"
+)
+
+// membersHandler lists the members of the serf cluster.
+func membersHandler(a auditor) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		members := []admin.Member{}
+		for _, m := range a.ag.Serf().Members() {
+			members = append(members, admin.Member{
+				Name:   m.Name,
+				Addr:   net.JoinHostPort(m.Addr.String(), strconv.Itoa(int(m.Port))),
+				Status: m.Status.String(),
+				Tags:   m.Tags,
+			})
+		}
+		sort.Sort(membersByName(members))
+		writeJSON(w, members)
+	})
+}
+
+type membersByName []admin.Member
+
+func (m membersByName) Len() int           { return len(m) }
+func (m membersByName) Less(i, j int) bool { return m[i].Name < m[j].Name }
+func (m membersByName) Swap(i, j int)      { m[i], m[j] = m[j], m[i] }
+
+// rolesHandler lists the held polity roles beginning with the prefix form
+// value, and their holders.
+func rolesHandler(a auditor) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		holders, err := a.p.QueryPrefix(r.FormValue("prefix"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		writeJSON(w, holders)
+	})
+}
+
+// hostsHandler serves the audit of each host:
+//
+//	GET  /ansqd/hosts                       summarizes every host
+//	GET  /ansqd/hosts/<host>                summarizes one host
+//	POST /ansqd/hosts/<host>/recover        starts recovering a host
+//	POST /ansqd/hosts/<host>/cancel         cancels the recovery of a host
+//	GET  /ansqd/hosts/<host>/messages/<id>  dumps an audited message
+//
+// Only the summaries are served to remote clients.
+func hostsHandler(a auditor) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/ansqd/hosts"), "/")
+		if path == "" {
+			if r.Method != "GET" {
+				http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			writeJSON(w, a.hostSummaries())
+			return
+		}
+
+		parts := strings.SplitN(path, "/", 2)
+		name := parts[0]
+		a.hostsLock.Lock()
+		h, ok := a.hosts[name]
+		a.hostsLock.Unlock()
+		if !ok {
+			http.Error(w, "no such host", http.StatusNotFound)
+			return
+		}
+
+		action := ""
+		if len(parts) > 1 {
+			action = parts[1]
+		}
+		method := "POST"
+		if action == "" || strings.HasPrefix(action, "messages/") {
+			method = "GET"
+		}
+		if r.Method != method {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if action != "" && !fromLocalHost(r) {
+			http.Error(w, "hosts may only be recovered or inspected from the local host", http.StatusForbidden)
+			return
+		}
+
+		switch {
+		case action == "":
+			writeJSON(w, summarize(name, h, a.recoveries()))
+		case action == "recover":
+			auditLog.Info("recovery requested", logging.HostKey, name, "remote", r.RemoteAddr)
+			go h.InitiateRecovery()
+			w.WriteHeader(http.StatusAccepted)
+		case action == "cancel":
+			if !h.CancelRecovery() {
+				http.Error(w, "host is not being recovered", http.StatusConflict)
+				return
+			}
+			auditLog.Info("recovery cancellation requested", logging.HostKey, name, "remote", r.RemoteAddr)
+			w.WriteHeader(http.StatusAccepted)
+		case strings.HasPrefix(action, "messages/"):
+			id, ok := parseMessageID(strings.TrimPrefix(action, "messages/"))
+			if !ok {
+				http.Error(w, "invalid message ID", http.StatusBadRequest)
+				return
+			}
+			m, expires, ok := h.Message(id)
+			if !ok {
+				http.Error(w, "no such message", http.StatusNotFound)
+				return
+			}
+			am := extractAudit(m)
+			writeJSON(w, admin.Message{
+				ID:        string(m.ID[:]),
+				Host:      name,
+				Topic:     am.Topic,
+				Body:      am.Body,
+				Timestamp: time.Unix(0, am.Timestamp),
+				Attempts:  am.Attempts,
+				Expires:   expires,
+			})
+		default:
+			http.NotFound(w, r)
+		}
+	})
+}
+
+// hostSummaries summarizes the audit of every host, in order. Hosts being
+// recovered by other nodes are reported as such when the cluster can be
+// asked.
+func (a auditor) hostSummaries() []admin.Host {
+	recoveries := a.recoveries()
+
+	a.hostsLock.Lock()
+	hosts := make(map[string]*Host, len(a.hosts))
+	for name, h := range a.hosts {
+		hosts[name] = h
+	}
+	a.hostsLock.Unlock()
+
+	summaries := []admin.Host{}
+	for name, h := range hosts {
+		summaries = append(summaries, summarize(name, h, recoveries))
+	}
+	sort.Sort(hostsByName(summaries))
+	return summaries
+}
+
+// recoveries lists the hosts being recovered anywhere in the cluster, or none
+// if the cluster cannot be asked.
+func (a auditor) recoveries() map[string]string {
+	recoveries, err := a.Recoveries()
+	if err != nil {
+		httpLog.Warn("could not query recoveries", logging.ErrorKey, err)
+	}
+	return recoveries
+}
+
+// summarize summarizes the audit of a host, given the hosts being recovered
+// across the cluster.
+func summarize(name string, h *Host, recoveries map[string]string) admin.Host {
+	messages, buckets := h.Stats()
+	return admin.Host{
+		Host:        name,
+		Messages:    messages,
+		Buckets:     buckets,
+		Topics:      h.Topics(),
+		Recovering:  h.Recovering(),
+		RecoveredBy: recoveries[name],
+	}
+}
+
+type hostsByName []admin.Host
+
+func (h hostsByName) Len() int           { return len(h) }
+func (h hostsByName) Less(i, j int) bool { return h[i].Host < h[j].Host }
+func (h hostsByName) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+
+// parseMessageID parses a message ID as nsqd reports it and ansqd logs it.
+func parseMessageID(s string) (id nsqd.MessageID, ok bool) {
+	if len(s) != len(id) {
+		return id, false
+	}
+	copy(id[:], s)
+	return id, true
+}
+
+// drainHandler starts draining the node when POSTed to from the local host, by
+// calling drain.
+func drainHandler(drain func()) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !fromLocalHost(r) {
+			http.Error(w, "the node may only be drained from the local host", http.StatusForbidden)
+			return
+		}
+		httpLog.Info("drain requested", "remote", r.RemoteAddr)
+		drain()
+		w.WriteHeader(http.StatusAccepted)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
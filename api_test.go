@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/bitly/nsq/nsqd"
+	"github.com/shipwire/ansqd/internal/admin"
+)
+
+func TestDumpMessage(t *testing.T) {
+	a := auditor{hosts: map[string]*Host{}, hostsLock: &sync.Mutex{}, stats: &auditStats{}}
+	var id nsqd.MessageID
+	copy(id[:], "06af3c7e9d2b4a10")
+	record := auditMessage{nsqd.Message{ID: id, Body: []byte("hello"), Attempts: 2}, "orders", "nsqd-1"}
+	a.Audit(&nsqd.Message{Body: record.Bytes()})
+
+	for _, path := range []string{
+		"/ansqd/hosts/nsqd-1/messages/" + string(id[:]),
+	} {
+		w := httptest.NewRecorder()
+		hostsHandler(a).ServeHTTP(w, localRequest("GET", path))
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: expected 200 OK, got %d: %s", path, w.Code, w.Body)
+		}
+
+		var m admin.Message
+		err := json.NewDecoder(w.Body).Decode(&m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m.ID != string(id[:]) || m.Host != "nsqd-1" || m.Topic != "orders" || string(m.Body) != "hello" || m.Attempts != 2 {
+			t.Fatalf("%s: unexpected message %+v", path, m)
+		}
+	}
+
+	for path, code := range map[string]int{
+		"/ansqd/hosts/nsqd-2/messages/" + string(id[:]):             http.StatusNotFound,
+		"/ansqd/hosts/nsqd-1/messages/0123":                         http.StatusBadRequest,
+		"/ansqd/hosts/nsqd-1/messages/" + hex.EncodeToString(id[:]): http.StatusBadRequest,
+		"/ansqd/hosts/nsqd-1/messages/0000000000000000":             http.StatusNotFound,
+	} {
+		w := httptest.NewRecorder()
+		hostsHandler(a).ServeHTTP(w, localRequest("GET", path))
+		if w.Code != code {
+			t.Errorf("%s: expected %d, got %d", path, code, w.Code)
+		}
+	}
+
+	// httptest's requests come from a remote address
+	w := httptest.NewRecorder()
+	hostsHandler(a).ServeHTTP(w, httptest.NewRequest("GET", "/ansqd/hosts/nsqd-1/messages/"+string(id[:]), nil))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("expected a remote dump to be forbidden, got %d", w.Code)
+	}
+}
+
+func TestLocalOnly(t *testing.T) {
+	a := auditor{hosts: map[string]*Host{}, hostsLock: &sync.Mutex{}, stats: &auditStats{}}
+	a.GetHost("nsqd-1")
+	drained := false
+	drain := drainHandler(func() { drained = true })
+
+	for _, test := range []struct {
+		handler      http.Handler
+		method, path string
+	}{
+		{hostsHandler(a), "POST", "/ansqd/hosts/nsqd-1/recover"},
+		{hostsHandler(a), "POST", "/ansqd/hosts/nsqd-1/cancel"},
+		{drain, "POST", "/ansqd/drain"},
+	} {
+		w := httptest.NewRecorder()
+		test.handler.ServeHTTP(w, httptest.NewRequest(test.method, test.path, nil))
+		if w.Code != http.StatusForbidden {
+			t.Errorf("%s %s: expected a remote request to be forbidden, got %d", test.method, test.path, w.Code)
+		}
+	}
+	if drained {
+		t.Error("a remote request drained the node")
+	}
+
+	w := httptest.NewRecorder()
+	drain.ServeHTTP(w, localRequest("POST", "/ansqd/drain"))
+	if w.Code != http.StatusAccepted || !drained {
+		t.Errorf("expected a local request to drain the node, got %d", w.Code)
+	}
+}
+
+// localRequest makes a request as though from the loopback interface.
+func localRequest(method, path string) *http.Request {
+	r := httptest.NewRequest(method, path, nil)
+	r.RemoteAddr = "127.0.0.1:50000"
+	return r
+}
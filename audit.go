@@ -1,18 +1,45 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
-	"log"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/bitly/nsq/nsqd"
 	"github.com/hashicorp/serf/command/agent"
+	"github.com/shipwire/ansqd/internal/logging"
 	"github.com/shipwire/ansqd/internal/polity"
 )
 
-var ExpirationTime = 2 * time.Minute
+// expirationTime is how long, in nanoseconds, a message may go unfinished before
+// it is recovered. It is read through ExpirationTime, since it may be changed
+// by reloading the config.
+var expirationTime = int64(2 * time.Minute)
+
+// ExpirationTime is how long a message may go unfinished before it is recovered.
+func ExpirationTime() time.Duration {
+	return time.Duration(atomic.LoadInt64(&expirationTime))
+}
+
+// setExpirationTime changes how long messages may go unfinished from now on.
+func setExpirationTime(d time.Duration) {
+	atomic.StoreInt64(&expirationTime, int64(d))
+}
+
+// recoveryCheckpointInterval is how many messages are republished between
+// recovery checkpoints.
+const recoveryCheckpointInterval = 100
+
+// Namespaces of the polity roles claimed while recovering a host.
+const (
+	recoverNamespace   = "recover"
+	partitionNamespace = "partition"
+)
 
 type audit struct {
 	m *nsqd.Message
@@ -20,13 +47,17 @@ type audit struct {
 
 type delegate struct{}
 
-// OnFinish is called when FIN is received for the message
+// OnFinish is called when FIN is received for the message. Peers finishing the
+// audit records they consume are not audited in turn.
 func (d *delegate) OnFinish(m *nsqd.Message) {
-	n.GetTopic("audit.finish").PutMessage(&nsqd.Message{
-		ID:   n.NewID(),
-		Body: m.ID[:],
-	})
-	log.Printf("AUDIT: OnFinish %x", m.ID)
+	if isAuditRecord(m) {
+		return
+	}
+	a.stats.finished.Inc()
+	a.drainer.finished(m.ID)
+	n.GetTopic("audit.finish").PutMessage(nsqd.NewMessage(n.NewID(),
+		auditMessage{Message: nsqd.Message{ID: m.ID}, Hostname: a.hostname()}.Bytes()))
+	auditLog.Debug("finished", logging.MessageIDKey, string(m.ID[:]))
 }
 
 // OnQueue is called before a message is sent to the queue
@@ -34,20 +65,28 @@ func (d *delegate) OnQueue(m *nsqd.Message, topic string) {
 	if strings.HasPrefix(topic, "audit.") {
 		return
 	}
-	n.GetTopic("audit.send").PutMessage(&nsqd.Message{
-		ID:   n.NewID(),
-		Body: auditMessage{*m, topic}.Bytes(),
-	})
-	log.Printf("AUDIT: OnQueue %x", m.ID)
+	a.stats.queued.Inc()
+	if a.drainer.queued(m, topic) {
+		pauseTopic(topic)
+	}
+	n.GetTopic("audit.send").PutMessage(nsqd.NewMessage(n.NewID(),
+		auditMessage{*m, topic, a.hostname()}.Bytes()))
+	auditLog.Debug("queued", logging.MessageIDKey, string(m.ID[:]), "topic", topic)
 }
 
 // OnRequeue is called when REQ is received for the message
 func (d *delegate) OnRequeue(m *nsqd.Message, delay time.Duration) {
+	if isAuditRecord(m) {
+		return
+	}
 	a.Req(m)
 }
 
 // OnTouch is called when TOUCH is received for the message
 func (d *delegate) OnTouch(m *nsqd.Message) {
+	if isAuditRecord(m) {
+		return
+	}
 	a.Touch(m)
 }
 
@@ -56,44 +95,231 @@ type auditor struct {
 	ag        *agent.Agent
 	hosts     map[string]*Host
 	hostsLock *sync.Mutex
+	stats     *auditStats
+	drainer   *drainer
 }
 
+// Audit records a message queued on another node, from the audit record m
+// published to that node's audit.send. The record is kept under the queued
+// message's ID.
 func (a auditor) Audit(m *nsqd.Message) {
-	a.ExtractHost(m).AddMessage(*m, time.Now().Add(ExpirationTime))
+	am := extractAudit(*m)
+	if am.Hostname == "" {
+		auditLog.Warn("ignoring malformed audit record", logging.MessageIDKey, string(m.ID[:]))
+		return
+	}
+	a.received(m)
+
+	record := *m
+	record.ID = am.ID
+	a.GetHost(am.Hostname).Audit(record, time.Now().Add(ExpirationTime()))
 }
 
+// Fin stops auditing a message finished on another node, given the audit
+// record m published to that node's audit.finish.
 func (a auditor) Fin(m *nsqd.Message) {
-	a.ExtractHost(m).RemoveMessage(*m)
+	am := extractAudit(*m)
+	if am.Hostname == "" {
+		auditLog.Warn("ignoring malformed audit record", logging.MessageIDKey, string(m.ID[:]))
+		return
+	}
+	a.received(m)
+
+	a.GetHost(am.Hostname).Finish(am.ID, time.Now().Add(ExpirationTime()))
+}
+
+// received counts an audit record from a peer, and tracks the time since the
+// peer published it as the audit lag. The lag is measured across the two
+// nodes' clocks, so it is only as accurate as their synchronization.
+func (a auditor) received(m *nsqd.Message) {
+	a.stats.received.Inc()
+	if m.Timestamp > 0 {
+		a.stats.lag.observe(time.Since(time.Unix(0, m.Timestamp)))
+	}
 }
 
 func (a auditor) Req(m *nsqd.Message) {
-	a.ExtractHost(m).AddMessage(*m, time.Now().Add(ExpirationTime))
+	a.stats.requeued.Inc()
+	a.ExtractHost(m).AddMessage(*m, time.Now().Add(ExpirationTime()))
 }
 
 func (a auditor) Touch(m *nsqd.Message) {
-	a.ExtractHost(m).AddMessage(*m, time.Now().Add(ExpirationTime))
+	a.stats.touched.Inc()
+	a.ExtractHost(m).AddMessage(*m, time.Now().Add(ExpirationTime()))
 }
 
 func (h *Host) InitiateRecovery() {
+	ctx, cancelRecovery := context.WithCancel(context.Background())
+	defer cancelRecovery()
+
 	h.recoveryLock.Lock()
 	if h.inRecovery {
+		h.recoveryLock.Unlock()
 		return
 	}
 	h.inRecovery = true
+	h.cancelRecovery = cancelRecovery
 	h.recoveryLock.Unlock()
 
-	role := "recover:" + h.host
-	err := <-a.p.RunElection(role)
-	defer a.p.RunRecallElection(role)
+	defer func() {
+		h.recoveryLock.Lock()
+		h.inRecovery = false
+		h.cancelRecovery = nil
+		h.recoveryLock.Unlock()
+	}()
+
+	// observers cannot claim the roles recovery requires
+	if a.p.Observer() {
+		return
+	}
+
+	// another node may already be recovering this host. wait for it to finish,
+	// then recover whatever messages are still outstanding.
+	lockCtx, cancel := context.WithTimeout(ctx, ExpirationTime())
+	defer cancel()
+
+	role := polity.RoleName(recoverNamespace, h.host)
+	l := auditLog.With(logging.HostKey, h.host, logging.RoleKey, role)
+	a.stats.recoveriesStarted.Inc()
+
+	lock := a.p.NewMutex(role)
+	err := lock.Lock(lockCtx)
 	if err != nil {
+		l.Warn("could not lock recovery", logging.ErrorKey, err)
+		a.stats.recoveriesFailed.Inc()
 		return
 	}
+	defer lock.Unlock()
+
+	// the host's topic partitions are claimed too, so that no other node
+	// publishes to them while it is being recovered. a host may have too many
+	// to claim in one election, so they are claimed in batches; holding the
+	// recovery role keeps other nodes from claiming them meanwhile.
+	partitions := []string{}
+	for _, topic := range h.Topics() {
+		partitions = append(partitions, polity.RoleName(partitionNamespace, h.host, topic))
+	}
+	for _, batch := range polity.SplitRoles(partitions) {
+		partitionLock := a.p.NewMutex(batch...)
+		err = partitionLock.Lock(lockCtx)
+		if err != nil {
+			l.Warn("could not lock partitions", "partitions", strings.Join(batch, " "), logging.ErrorKey, err)
+			a.stats.recoveriesFailed.Inc()
+			return
+		}
+		defer partitionLock.Unlock()
+	}
+
+	// messages are republished in ID order, and the last one republished is
+	// checkpointed on the recovery role, so that a recovery interrupted here or
+	// on another node does not republish them again.
+	var checkpoint []byte
+	info, err := a.p.QueryRoleInfo(role)
+	if err != nil {
+		l.Warn("could not read recovery checkpoint", logging.ErrorKey, err)
+	} else {
+		checkpoint = info.Value
+	}
+
+	h.messagesLock.Lock()
+	ids := make(messageIDs, 0, len(h.messages))
+	for mid := range h.messages {
+		if bytes.Compare(mid[:], checkpoint) > 0 {
+			ids = append(ids, mid)
+		}
+	}
+	h.messagesLock.Unlock()
+	sort.Sort(ids)
+	l.Info("recovering", "messages", len(ids), "checkpoint", string(checkpoint))
+
+	for i, mid := range ids {
+		if ctx.Err() != nil {
+			// checkpoint what has been republished, so that the next recovery
+			// carries on from here
+			if i%recoveryCheckpointInterval != 0 {
+				err = a.p.SetValue(role, ids[i-1][:])
+				if err != nil {
+					l.Warn("could not checkpoint recovery", logging.MessageIDKey, string(ids[i-1][:]), logging.ErrorKey, err)
+				}
+			}
+			l.Info("recovery cancelled", "republished", i, "messages", len(ids))
+			a.stats.recoveriesCancelled.Inc()
+			return
+		}
+
+		h.messagesLock.Lock()
+		bucket, ok := h.messages[mid]
+		h.messagesLock.Unlock()
+		if !ok {
+			continue
+		}
 
-	for mid, bucket := range h.messages {
 		m := bucket.GetMessage(mid)
 		am := extractAudit(m)
-		n.GetTopic(am.Topic).PutMessage(&am.Message)
+		err = n.GetTopic(am.Topic).PutMessage(&am.Message)
+		if err != nil {
+			// stop here, so that the checkpoint does not pass this message
+			l.Error("could not republish message", logging.MessageIDKey, string(mid[:]), logging.ErrorKey, err)
+			a.stats.recoveriesFailed.Inc()
+			return
+		}
+		a.stats.republished.Inc()
+		h.RemoveMessage(m)
+
+		if (i+1)%recoveryCheckpointInterval == 0 {
+			err = a.p.SetValue(role, mid[:])
+			if err != nil {
+				l.Warn("could not checkpoint recovery", logging.MessageIDKey, string(mid[:]), logging.ErrorKey, err)
+			}
+		}
+	}
+
+	// the recovery is complete, so the next one, of messages the host audits
+	// from now on, starts from the beginning. peers that audited the same
+	// messages may republish them again, which nsq's at-least-once delivery
+	// allows for.
+	err = a.p.SetValue(role, nil)
+	if err != nil {
+		l.Warn("could not clear recovery checkpoint", logging.ErrorKey, err)
+	}
+
+	l.Info("recovered", "messages", len(ids))
+	a.stats.recoveriesSucceeded.Inc()
+}
+
+// CancelRecovery stops the recovery of the host's messages, if this node is
+// recovering it. It reports whether a recovery was running.
+func (h *Host) CancelRecovery() bool {
+	h.recoveryLock.Lock()
+	defer h.recoveryLock.Unlock()
+
+	if h.cancelRecovery != nil {
+		h.cancelRecovery()
 	}
+	return h.inRecovery
+}
+
+// messageIDs sorts message IDs, which increase over time on any one host.
+type messageIDs []nsqd.MessageID
+
+func (m messageIDs) Len() int           { return len(m) }
+func (m messageIDs) Less(i, j int) bool { return bytes.Compare(m[i][:], m[j][:]) < 0 }
+func (m messageIDs) Swap(i, j int)      { m[i], m[j] = m[j], m[i] }
+
+// Recoveries lists the hosts being recovered anywhere in the cluster, along with
+// the node recovering each.
+func (a auditor) Recoveries() (map[string]string, error) {
+	prefix := polity.Namespace(recoverNamespace)
+	holders, err := a.p.QueryPrefix(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	recoveries := make(map[string]string, len(holders))
+	for role, node := range holders {
+		recoveries[strings.TrimPrefix(role, prefix)] = node
+	}
+	return recoveries, nil
 }
 
 func (a auditor) ExtractHost(m *nsqd.Message) *Host {
@@ -129,15 +355,72 @@ func (a auditor) GetHost(hostname string) *Host {
 	return host
 }
 
+// hostname is the name under which peers audit the local node's messages: its
+// serf node name.
+func (a auditor) hostname() string {
+	return a.ag.Serf().LocalMember().Name
+}
+
+// auditMessage is a message queued on Hostname, as carried by an audit record.
+// The records published to audit.finish carry only the message's ID.
 type auditMessage struct {
 	nsqd.Message
-	Topic string
+	Topic    string
+	Hostname string
 }
 
+// auditRecord is the JSON encoding of an auditMessage. The hostname field is
+// what ExtractHost looks for.
+type auditRecord struct {
+	Hostname  string `json:"hostname"`
+	Topic     string `json:"topic,omitempty"`
+	ID        string `json:"id"`
+	Body      []byte `json:"body,omitempty"`
+	Timestamp int64  `json:"timestamp,omitempty"`
+	Attempts  uint16 `json:"attempts,omitempty"`
+}
+
+// Bytes encodes the message as the body of an audit record.
 func (a auditMessage) Bytes() []byte {
-	return nil
+	b, _ := json.Marshal(auditRecord{
+		Hostname:  a.Hostname,
+		Topic:     a.Topic,
+		ID:        string(a.ID[:]),
+		Body:      a.Body,
+		Timestamp: a.Timestamp,
+		Attempts:  a.Attempts,
+	})
+	return b
 }
 
+// auditRecordPrefix begins the encoding of every audit record.
+var auditRecordPrefix = []byte(`{"hostname":`)
+
+// isAuditRecord tests whether m is an audit record rather than a message
+// published by a client. A client message that happens to begin like one is
+// not audited when it is finished, requeued or touched.
+func isAuditRecord(m *nsqd.Message) bool {
+	return bytes.HasPrefix(m.Body, auditRecordPrefix)
+}
+
+// extractAudit decodes the message carried by the audit record m. It returns
+// the zero auditMessage if m is not an audit record.
 func extractAudit(m nsqd.Message) auditMessage {
-	return auditMessage{}
+	var r auditRecord
+	err := json.Unmarshal(m.Body, &r)
+	if err != nil || len(r.ID) != len(nsqd.MessageID{}) {
+		return auditMessage{}
+	}
+
+	am := auditMessage{
+		Message: nsqd.Message{
+			Body:      r.Body,
+			Timestamp: r.Timestamp,
+			Attempts:  r.Attempts,
+		},
+		Topic:    r.Topic,
+		Hostname: r.Hostname,
+	}
+	copy(am.ID[:], r.ID)
+	return am
 }
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bitly/nsq/nsqd"
+)
+
+func TestAuditRecord(t *testing.T) {
+	var id nsqd.MessageID
+	copy(id[:], "06af3c7e9d2b4a10")
+	sent := auditMessage{nsqd.Message{ID: id, Body: []byte(`{"order":1}`), Timestamp: 1e18, Attempts: 1}, "orders", "nsqd-1"}
+
+	got := extractAudit(nsqd.Message{Body: sent.Bytes()})
+	if !reflect.DeepEqual(got, sent) {
+		t.Fatalf("expected %+v, got %+v", sent, got)
+	}
+
+	if got := extractAudit(nsqd.Message{Body: []byte(`{"order":1}`)}); got.Hostname != "" {
+		t.Fatalf("expected nothing from a message that is not an audit record, got %+v", got)
+	}
+
+	a := auditor{hosts: map[string]*Host{}, hostsLock: &sync.Mutex{}, stats: &auditStats{}}
+	a.Audit(&nsqd.Message{ID: nsqd.MessageID{1}, Body: sent.Bytes()})
+
+	h := a.hosts["nsqd-1"]
+	if h == nil {
+		t.Fatal("expected the audited host to be tracked")
+	}
+	m, _, ok := h.Message(id)
+	if !ok || extractAudit(m).Topic != "orders" {
+		t.Fatalf("expected the message to be audited under its own ID, got %+v", m)
+	}
+	if topics := h.Topics(); !reflect.DeepEqual(topics, []string{"orders"}) {
+		t.Fatalf("expected topics [orders], got %v", topics)
+	}
+
+	finished := auditMessage{Message: nsqd.Message{ID: id}, Hostname: "nsqd-1"}
+	a.Fin(&nsqd.Message{ID: nsqd.MessageID{2}, Body: finished.Bytes()})
+	if _, _, ok := h.Message(id); ok {
+		t.Fatal("expected the finished message to no longer be audited")
+	}
+}
+
+func TestAuditFinishedFirst(t *testing.T) {
+	var id nsqd.MessageID
+	copy(id[:], "06af3c7e9d2b4a10")
+	sent := auditMessage{nsqd.Message{ID: id, Body: []byte(`{"order":1}`)}, "orders", "nsqd-1"}
+	finished := auditMessage{Message: nsqd.Message{ID: id}, Hostname: "nsqd-1"}
+
+	a := auditor{hosts: map[string]*Host{}, hostsLock: &sync.Mutex{}, stats: &auditStats{}}
+	a.Fin(&nsqd.Message{ID: nsqd.MessageID{2}, Body: finished.Bytes(), Timestamp: time.Now().UnixNano()})
+	a.Audit(&nsqd.Message{ID: nsqd.MessageID{1}, Body: sent.Bytes(), Timestamp: time.Now().UnixNano()})
+
+	if _, _, ok := a.hosts["nsqd-1"].Message(id); ok {
+		t.Fatal("expected a message finished before its audit record arrived not to be audited")
+	}
+	if got := a.stats.received.Load(); got != 2 {
+		t.Fatal("expected 2 records to be received, got", got)
+	}
+	if _, at := a.stats.lag.Last(); at.IsZero() {
+		t.Fatal("expected the records' lag to be tracked")
+	}
+
+	if !isAuditRecord(&nsqd.Message{Body: sent.Bytes()}) || !isAuditRecord(&nsqd.Message{Body: finished.Bytes()}) {
+		t.Fatal("expected audit records to be recognized")
+	}
+	if isAuditRecord(&nsqd.Message{Body: []byte(`{"order":1}`)}) {
+		t.Fatal("expected a client message not to be taken for an audit record")
+	}
+}
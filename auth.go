@@ -0,0 +1,113 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/hashicorp/serf/command/agent"
+	"github.com/shipwire/ansqd/internal/polity"
+)
+
+// polityTransport creates the transport polity runs over, signing its messages
+// if a key has been configured.
+func polityTransport(ag *agent.Agent) (polity.Transport, error) {
+	t := polity.AgentTransport(ag)
+
+	switch {
+	case *polityAuthKeyFile != "" && *politySigningKeyFile != "":
+		return nil, errors.New("--polity-auth-key-file and --polity-signing-key-file are mutually exclusive")
+	case *polityAuthKeyFile != "":
+		key, err := ioutil.ReadFile(*polityAuthKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		key = []byte(strings.TrimSpace(string(key)))
+		if len(key) == 0 {
+			return nil, fmt.Errorf("%s is empty", *polityAuthKeyFile)
+		}
+		return polity.Authenticate(t, polity.NewHMACAuthenticator(key)), nil
+	case *politySigningKeyFile != "":
+		key, err := readSigningKey(*politySigningKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		if *polityTrustedKeys == "" {
+			return nil, errors.New("--polity-signing-key-file requires --polity-trusted-keys-file")
+		}
+		trusted, err := readTrustedKeys(*polityTrustedKeys)
+		if err != nil {
+			return nil, err
+		}
+
+		// advertise the public key so that peers can verify our messages
+		err = setAgentTag(ag, polity.PublicKeyTag, polity.EncodePublicKey(key.Public().(ed25519.PublicKey)))
+		if err != nil {
+			return nil, err
+		}
+		return polity.Authenticate(t, polity.NewEd25519Authenticator(key, t, trusted)), nil
+	}
+	return t, nil
+}
+
+// setAgentTag adds a tag to those the local serf member advertises.
+func setAgentTag(ag *agent.Agent, key, value string) error {
+	tags := map[string]string{}
+	for k, v := range ag.Serf().LocalMember().Tags {
+		tags[k] = v
+	}
+	tags[key] = value
+	return ag.SetTags(tags)
+}
+
+// readSigningKey reads a base64 encoded ed25519 seed or private key.
+func readSigningKey(path string) (ed25519.PrivateKey, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(b)))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+
+	switch len(raw) {
+	case ed25519.SeedSize:
+		return ed25519.NewKeyFromSeed(raw), nil
+	case ed25519.PrivateKeySize:
+		return ed25519.PrivateKey(raw), nil
+	}
+	return nil, fmt.Errorf("%s: expected a %d byte seed or %d byte private key, got %d bytes", path, ed25519.SeedSize, ed25519.PrivateKeySize, len(raw))
+}
+
+// readTrustedKeys reads base64 encoded ed25519 public keys, one per line. Blank
+// lines and lines beginning with # are skipped.
+func readTrustedKeys(path string) ([]ed25519.PublicKey, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := []ed25519.PublicKey{}
+	for i, line := range strings.Split(string(b), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		raw, err := base64.StdEncoding.DecodeString(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", path, i+1, err)
+		}
+		if len(raw) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("%s:%d: expected a %d byte public key, got %d bytes", path, i+1, ed25519.PublicKeySize, len(raw))
+		}
+		keys = append(keys, ed25519.PublicKey(raw))
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%s has no keys", path)
+	}
+	return keys, nil
+}
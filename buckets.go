@@ -1,6 +1,7 @@
 package main
 
 import (
+	"sort"
 	"sync"
 	"time"
 
@@ -17,6 +18,13 @@ type Host struct {
 	recoveryLock, bucketsLock, messagesLock *sync.Mutex
 	messages                                map[nsqd.MessageID]*Bucket
 	inRecovery                              bool
+	cancelRecovery                          func()
+
+	// finished holds, until they expire, the messages finished before their
+	// audit records arrived. Records of queued and finished messages are
+	// published to different topics, so they may arrive in either order.
+	finished  map[nsqd.MessageID]time.Time
+	nextSweep time.Time
 }
 
 func NewHost(hostname string) *Host {
@@ -27,6 +35,7 @@ func NewHost(hostname string) *Host {
 		messagesLock: &sync.Mutex{},
 		recoveryLock: &sync.Mutex{},
 		messages:     map[nsqd.MessageID]*Bucket{},
+		finished:     map[nsqd.MessageID]time.Time{},
 	}
 	h.nextBucket = h.GetBucketAtExpireTime(time.Now())
 	return h
@@ -54,18 +63,19 @@ func (h *Host) GetBucketAtExpireTime(e time.Time) *Bucket {
 		b = &Bucket{
 			messages:   make(map[nsqd.MessageID]nsqd.Message),
 			expiration: e,
+			host:       h,
 		}
 
 		// is this bucket the earliest?
-		if e.Before(h.nextBucket.expiration) {
+		if h.nextBucket == nil || e.Before(h.nextBucket.expiration) {
 			b.next = h.nextBucket
 			h.nextBucket = b
+		} else {
+			// what is the previous?
+			prev := h.GetBucketAtExpireTime(rounded.Add(-round))
+			prev.next = b
 		}
 
-		// what is the previous?
-		prev := h.GetBucketAtExpireTime(rounded.Add(-round))
-		prev.next = b
-
 		h.bucketsLock.Lock()
 		h.buckets[rounded] = b
 		h.bucketsLock.Unlock()
@@ -78,7 +88,12 @@ func (h *Host) AddMessage(m nsqd.Message, e time.Time) {
 		return
 	}
 	h.RemoveMessage(m)
-	h.GetBucketAtExpireTime(e).messages[m.ID] = m
+	b := h.GetBucketAtExpireTime(e)
+
+	h.messagesLock.Lock()
+	defer h.messagesLock.Unlock()
+	b.messages[m.ID] = m
+	h.messages[m.ID] = b
 }
 
 func (h *Host) RemoveMessage(m nsqd.Message) {
@@ -93,6 +108,68 @@ func (h *Host) RemoveMessage(m nsqd.Message) {
 	}
 }
 
+// Audit starts auditing a message queued on the host, to expire at e, unless
+// it has already been finished. It reports whether the message is audited.
+func (h *Host) Audit(m nsqd.Message, e time.Time) bool {
+	b := h.GetBucketAtExpireTime(e)
+
+	h.messagesLock.Lock()
+	defer h.messagesLock.Unlock()
+	if _, ok := h.finished[m.ID]; ok {
+		delete(h.finished, m.ID)
+		return false
+	}
+	if have, ok := h.messages[m.ID]; ok {
+		delete(have.messages, m.ID)
+	}
+	b.messages[m.ID] = m
+	h.messages[m.ID] = b
+	return true
+}
+
+// Finish stops auditing a message finished on the host. If the message is not
+// being audited, its audit record may not have arrived yet, so the finish is
+// remembered until e and the record ignored if it arrives before then.
+func (h *Host) Finish(id nsqd.MessageID, e time.Time) {
+	h.messagesLock.Lock()
+	defer h.messagesLock.Unlock()
+
+	if have, ok := h.messages[id]; ok {
+		delete(have.messages, id)
+		delete(h.messages, id)
+		return
+	}
+
+	now := time.Now()
+	if now.After(h.nextSweep) {
+		for fid, expires := range h.finished {
+			if now.After(expires) {
+				delete(h.finished, fid)
+			}
+		}
+		h.nextSweep = now.Add(round)
+	}
+	h.finished[id] = e
+}
+
+// Topics lists the topics of the host's outstanding messages.
+func (h *Host) Topics() []string {
+	h.messagesLock.Lock()
+	defer h.messagesLock.Unlock()
+
+	seen := map[string]bool{}
+	topics := []string{}
+	for mid, bucket := range h.messages {
+		topic := extractAudit(bucket.GetMessage(mid)).Topic
+		if topic != "" && !seen[topic] {
+			seen[topic] = true
+			topics = append(topics, topic)
+		}
+	}
+	sort.Strings(topics)
+	return topics
+}
+
 func (h *Host) Recovery(stop chan bool) {
 	if h == nil {
 		return
@@ -112,6 +189,40 @@ func (h *Host) Recovery(stop chan bool) {
 
 func (b *Bucket) Expire() {
 	if len(b.messages) > 0 {
+		a.stats.expirations.Inc()
 		go b.host.InitiateRecovery()
 	}
 }
+
+// Message returns an outstanding message and when it expires.
+func (h *Host) Message(id nsqd.MessageID) (m nsqd.Message, expires time.Time, ok bool) {
+	h.messagesLock.Lock()
+	defer h.messagesLock.Unlock()
+
+	b, ok := h.messages[id]
+	if !ok {
+		return nsqd.Message{}, time.Time{}, false
+	}
+	return b.GetMessage(id), b.expiration, true
+}
+
+// Recovering tests whether the host's messages are being recovered by this
+// node.
+func (h *Host) Recovering() bool {
+	h.recoveryLock.Lock()
+	defer h.recoveryLock.Unlock()
+	return h.inRecovery
+}
+
+// Stats reports how many messages the host has outstanding, and across how many
+// buckets.
+func (h *Host) Stats() (messages, buckets int) {
+	h.messagesLock.Lock()
+	messages = len(h.messages)
+	h.messagesLock.Unlock()
+
+	h.bucketsLock.Lock()
+	buckets = len(h.buckets)
+	h.bucketsLock.Unlock()
+	return messages, buckets
+}
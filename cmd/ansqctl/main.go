@@ -0,0 +1,209 @@
+// Command ansqctl administers an ansqd node through its admin HTTP API.
+//
+//	ansqctl [--ansqd-http-address=<addr>:<port>] <command> [args]
+//
+// The commands are:
+//
+//	members                  list the members of the serf cluster
+//	roles [prefix]           list the held polity roles and their holders
+//	hosts [host]             summarize the audit of every host, or of one
+//	recover <host>           recover a host's messages without waiting for them to expire
+//	cancel <host>            cancel the node's recovery of a host
+//	message <host> <id>      dump a message the node is auditing
+//	drain                    drain the node ahead of its shutdown
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/shipwire/ansqd/internal/admin"
+)
+
+var (
+	flagSet = flag.NewFlagSet("ansqctl", flag.ExitOnError)
+
+	ansqdHTTPAddress = flagSet.String("ansqd-http-address", "127.0.0.1:4155", "<addr>:<port> of the ansqd admin HTTP API")
+)
+
+// commands maps each command to the number of arguments it takes, at least and
+// at most, and the function running it.
+var commands = map[string]struct {
+	min, max int
+	run      func(c *admin.Client, args []string) error
+}{
+	"members": {0, 0, listMembers},
+	"roles":   {0, 1, listRoles},
+	"hosts":   {0, 1, listHosts},
+	"recover": {1, 1, recoverHost},
+	"cancel":  {1, 1, cancelRecovery},
+	"message": {2, 2, dumpMessage},
+	"drain":   {0, 0, drainNode},
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, `usage: ansqctl [--ansqd-http-address=<addr>:<port>] <command> [args]
+
+commands:
+  members                  list the members of the serf cluster
+  roles [prefix]           list the held polity roles and their holders
+  hosts [host]             summarize the audit of every host, or of one
+  recover <host>           recover a host's messages without waiting for them to expire
+  cancel <host>            cancel the node's recovery of a host
+  message <host> <id>      dump a message the node is auditing
+  drain                    drain the node ahead of its shutdown
+
+flags:`)
+	flagSet.PrintDefaults()
+}
+
+func main() {
+	flagSet.Usage = usage
+	flagSet.Parse(os.Args[1:])
+
+	cmd, ok := commands[flagSet.Arg(0)]
+	args := flagSet.Args()
+	if len(args) > 0 {
+		args = args[1:]
+	}
+	if !ok || len(args) < cmd.min || len(args) > cmd.max {
+		usage()
+		os.Exit(2)
+	}
+
+	err := cmd.run(admin.NewClient(*ansqdHTTPAddress), args)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "ERROR:", err)
+		os.Exit(1)
+	}
+}
+
+func listMembers(c *admin.Client, args []string) error {
+	members, err := c.Members()
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tADDRESS\tSTATUS\tTAGS")
+	for _, m := range members {
+		tags := []string{}
+		for k, v := range m.Tags {
+			tags = append(tags, k+"="+v)
+		}
+		sort.Strings(tags)
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", m.Name, m.Addr, m.Status, strings.Join(tags, ","))
+	}
+	return w.Flush()
+}
+
+func listRoles(c *admin.Client, args []string) error {
+	prefix := ""
+	if len(args) > 0 {
+		prefix = args[0]
+	}
+	holders, err := c.Roles(prefix)
+	if err != nil {
+		return err
+	}
+
+	roles := make([]string, 0, len(holders))
+	for role := range holders {
+		roles = append(roles, role)
+	}
+	sort.Strings(roles)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "ROLE\tHOLDER")
+	for _, role := range roles {
+		fmt.Fprintf(w, "%s\t%s\n", role, holders[role])
+	}
+	return w.Flush()
+}
+
+func listHosts(c *admin.Client, args []string) error {
+	var hosts []admin.Host
+	if len(args) > 0 {
+		h, err := c.Host(args[0])
+		if err != nil {
+			return err
+		}
+		hosts = []admin.Host{*h}
+	} else {
+		var err error
+		hosts, err = c.Hosts()
+		if err != nil {
+			return err
+		}
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "HOST\tMESSAGES\tBUCKETS\tRECOVERING\tRECOVERED BY\tTOPICS")
+	for _, h := range hosts {
+		recovering := "no"
+		if h.Recovering {
+			recovering = "yes"
+		}
+		recoveredBy := h.RecoveredBy
+		if recoveredBy == "" {
+			recoveredBy = "-"
+		}
+		fmt.Fprintf(w, "%s\t%d\t%d\t%s\t%s\t%s\n", h.Host, h.Messages, h.Buckets, recovering, recoveredBy, strings.Join(h.Topics, ","))
+	}
+	return w.Flush()
+}
+
+func recoverHost(c *admin.Client, args []string) error {
+	err := c.Recover(args[0])
+	if err != nil {
+		return err
+	}
+	fmt.Printf("recovering %s\n", args[0])
+	return nil
+}
+
+func cancelRecovery(c *admin.Client, args []string) error {
+	err := c.CancelRecovery(args[0])
+	if err != nil {
+		return err
+	}
+	fmt.Printf("cancelled recovery of %s\n", args[0])
+	return nil
+}
+
+func dumpMessage(c *admin.Client, args []string) error {
+	m, err := c.Message(args[0], args[1])
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "ID:\t%s\n", m.ID)
+	fmt.Fprintf(w, "Host:\t%s\n", m.Host)
+	fmt.Fprintf(w, "Topic:\t%s\n", m.Topic)
+	fmt.Fprintf(w, "Timestamp:\t%s\n", m.Timestamp.Format(time.RFC3339Nano))
+	fmt.Fprintf(w, "Attempts:\t%d\n", m.Attempts)
+	fmt.Fprintf(w, "Expires:\t%s\n", m.Expires.Format(time.RFC3339Nano))
+	err = w.Flush()
+	if err != nil {
+		return err
+	}
+
+	fmt.Println()
+	_, err = os.Stdout.Write(m.Body)
+	return err
+}
+
+func drainNode(c *admin.Client, args []string) error {
+	err := c.Drain()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("draining %s\n", c.Addr)
+	return nil
+}
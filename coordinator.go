@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/hashicorp/serf/serf"
+	"github.com/shipwire/ansqd/internal/logging"
+)
+
+// coordinatorRole is held by the one node in the cluster that performs
+// cluster-wide housekeeping.
+const coordinatorRole = "coordinator"
+
+// coordinate performs housekeeping until ctx is cancelled. It is run by
+// polity.Campaign while this node is the cluster coordinator.
+func (a auditor) coordinate(ctx context.Context) {
+	auditLog.Info("elected cluster coordinator", logging.RoleKey, coordinatorRole)
+
+	// the interval is read on every pass, so that it follows config reloads
+	for {
+		select {
+		case <-time.After(ExpirationTime()):
+			a.housekeeping()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (a auditor) demoted() {
+	auditLog.Info("no longer cluster coordinator", logging.RoleKey, coordinatorRole)
+}
+
+// housekeeping looks after hosts whose nodes have left or failed. Hosts with no
+// outstanding messages are forgotten, while the rest are recovered without
+// waiting for their messages to expire.
+func (a auditor) housekeeping() {
+	departed := map[string]bool{}
+	for _, m := range a.ag.Serf().Members() {
+		if m.Status == serf.StatusLeft || m.Status == serf.StatusFailed {
+			departed[m.Name] = true
+		}
+	}
+
+	a.hostsLock.Lock()
+	defer a.hostsLock.Unlock()
+
+	for name, h := range a.hosts {
+		if !departed[name] {
+			continue
+		}
+
+		h.messagesLock.Lock()
+		outstanding := len(h.messages)
+		h.messagesLock.Unlock()
+
+		if outstanding == 0 {
+			auditLog.Info("forgetting departed host", logging.HostKey, name)
+			delete(a.hosts, name)
+		} else {
+			auditLog.Info("recovering departed host", logging.HostKey, name, "messages", outstanding)
+			go h.InitiateRecovery()
+		}
+	}
+}
@@ -0,0 +1,454 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bitly/nsq/nsqd"
+	"github.com/hashicorp/serf/serf"
+	"github.com/shipwire/ansqd/internal/logging"
+	"github.com/shipwire/ansqd/internal/polity"
+)
+
+const (
+	// drainingTag is advertised as "true" by a node that is draining. Peers do
+	// not hand messages to a draining node.
+	drainingTag = "ansqd-draining"
+
+	// nsqdHTTPTag advertises the address of a node's nsqd HTTP API, to which
+	// draining peers hand their unfinished messages.
+	nsqdHTTPTag = "ansqd-nsqd-http-address"
+
+	// drainedEvent is broadcast over the polity's transport by a node that has
+	// drained, with its host name as the payload, so that peers stop auditing
+	// it. The host name is the one its audit records carry.
+	drainedEvent = "ansqd.drained"
+
+	// checkpointTopic receives a drained node's final audit checkpoint.
+	checkpointTopic = "audit.checkpoint"
+)
+
+// handOffTimeout bounds each attempt to hand a message to a peer.
+var handOffTimeout = 10 * time.Second
+
+// drainer tracks the messages queued on this node until they are finished, so
+// that those still unfinished when the node drains can be handed to a peer.
+// Their bodies are kept, up to maxBytes; messages queued beyond that are only
+// counted, and left to recovery if the node drains before they are finished.
+type drainer struct {
+	mu        sync.Mutex
+	messages  map[nsqd.MessageID]auditMessage
+	size      int64
+	maxBytes  int64
+	untracked int64
+	draining  bool
+
+	// paused holds the topics whose delivery is paused while draining.
+	paused map[string]bool
+}
+
+func newDrainer(maxBytes int64) *drainer {
+	return &drainer{
+		messages: make(map[nsqd.MessageID]auditMessage),
+		maxBytes: maxBytes,
+		paused:   make(map[string]bool),
+	}
+}
+
+// queued tracks m, queued on topic. It reports whether the node is draining and
+// topic has yet to be paused.
+func (d *drainer) queued(m *nsqd.Message, topic string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.size+int64(len(m.Body)) > d.maxBytes {
+		d.untracked++
+	} else {
+		d.messages[m.ID] = auditMessage{Message: *m, Topic: topic}
+		d.size += int64(len(m.Body))
+	}
+	return d.draining && d.pauseLocked(topic)
+}
+
+func (d *drainer) finished(id nsqd.MessageID) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if m, ok := d.messages[id]; ok {
+		d.size -= int64(len(m.Body))
+		delete(d.messages, id)
+	}
+}
+
+// Untracked is how many messages were queued while maxBytes of bodies were
+// already tracked.
+func (d *drainer) Untracked() int64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.untracked
+}
+
+// pause records that topic is paused while draining. It reports whether it was
+// not already.
+func (d *drainer) pause(topic string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.pauseLocked(topic)
+}
+
+func (d *drainer) pauseLocked(topic string) bool {
+	if d.paused[topic] {
+		return false
+	}
+	d.paused[topic] = true
+	return true
+}
+
+// pausedTopics lists the topics paused while draining.
+func (d *drainer) pausedTopics() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	topics := make([]string, 0, len(d.paused))
+	for topic := range d.paused {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+	return topics
+}
+
+// outstanding lists the unfinished messages in ID order.
+func (d *drainer) outstanding() []auditMessage {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	ids := make(messageIDs, 0, len(d.messages))
+	for id := range d.messages {
+		ids = append(ids, id)
+	}
+	sort.Sort(ids)
+
+	messages := make([]auditMessage, len(ids))
+	for i, id := range ids {
+		messages[i] = d.messages[id]
+	}
+	return messages
+}
+
+// Draining tests whether the node has started draining.
+func (d *drainer) Draining() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.draining
+}
+
+// start marks the node as draining. It reports false if it already was.
+func (d *drainer) start() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.draining {
+		return false
+	}
+	d.draining = true
+	return true
+}
+
+// wait waits up to timeout for the outstanding messages to be finished, or for
+// inFlight to report that none are left in flight, and returns those that are
+// not finished.
+func (d *drainer) wait(timeout time.Duration, inFlight func() int) []auditMessage {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+
+	deadline := time.After(timeout)
+	for {
+		if messages := d.outstanding(); len(messages) == 0 || inFlight() == 0 {
+			return messages
+		}
+		select {
+		case <-ticker.C:
+		case <-deadline:
+			return d.outstanding()
+		}
+	}
+}
+
+// drainCheckpoint is the final audit record of a drained node.
+type drainCheckpoint struct {
+	Hostname   string   `json:"hostname"`
+	Unfinished []string `json:"unfinished"`
+	HandedOff  []string `json:"handed_off"`
+}
+
+// drain prepares the node for shutdown. nsqd's delegate cannot refuse a
+// publish, so the node stops taking on new messages instead: it advertises
+// drainingTag, which keeps peers from handing it messages, fails its readiness
+// check and pauses its topics, so that messages still queued, or published
+// from then on, are no longer delivered here. Messages in flight are given up
+// to timeout to be finished. The rest are handed to peers rather than left to
+// recovery, and emptied from the local topics, so that nsqd does not deliver
+// them again once it restarts from its disk queue. A final audit checkpoint is
+// then published and the topics resumed, and once every message is accounted
+// for, peers are told through polity, which signs the event when
+// authentication is configured, that they can stop auditing the node. If any
+// message is still unfinished, or was queued beyond what the drainer tracks,
+// peers are not told, and keep auditing the node's messages so that they are
+// still recovered.
+func (a auditor) drain(timeout time.Duration) {
+	if !a.drainer.start() {
+		return
+	}
+
+	host := a.hostname()
+	l := auditLog.With(logging.HostKey, host)
+	l.Info("draining", "messages", len(a.drainer.outstanding()), "timeout", timeout)
+
+	err := setAgentTag(a.ag, drainingTag, "true")
+	if err != nil {
+		l.Warn("could not advertise draining tag", logging.ErrorKey, err)
+	}
+	for _, t := range n.GetStats() {
+		if !strings.HasPrefix(t.TopicName, "audit.") && a.drainer.pause(t.TopicName) {
+			pauseTopic(t.TopicName)
+		}
+	}
+
+	unfinished := a.drainer.wait(timeout, clientsInFlight)
+	handedOff := []auditMessage{}
+	if len(unfinished) > 0 {
+		l.Info("handing unfinished messages to peers", "messages", len(unfinished))
+		handedOff = a.handOffUnfinished(l, unfinished)
+
+		// messages queued on an emptied topic since the wait were emptied
+		// along with the rest, so they are handed off too
+		emptied := a.emptyHandedOff(l, handedOff)
+		queuedSince := []auditMessage{}
+		for _, m := range a.drainer.outstanding() {
+			if emptied[m.Topic] {
+				queuedSince = append(queuedSince, m)
+			}
+		}
+		handedOff = append(handedOff, a.handOffUnfinished(l, queuedSince)...)
+	}
+
+	checkpoint := drainCheckpoint{Hostname: host, Unfinished: []string{}, HandedOff: []string{}}
+	for _, m := range unfinished {
+		checkpoint.Unfinished = append(checkpoint.Unfinished, string(m.ID[:]))
+	}
+	for _, m := range handedOff {
+		checkpoint.HandedOff = append(checkpoint.HandedOff, string(m.ID[:]))
+	}
+	body, _ := json.Marshal(checkpoint)
+	err = n.GetTopic(checkpointTopic).PutMessage(nsqd.NewMessage(n.NewID(), body))
+	if err != nil {
+		l.Warn("could not publish final audit checkpoint", logging.ErrorKey, err)
+	}
+
+	// nsqd persists whether topics are paused, so they are resumed for the
+	// node to deliver what is left once it restarts
+	for _, topic := range a.drainer.pausedTopics() {
+		err = n.GetTopic(topic).UnPause()
+		if err != nil {
+			l.Warn("could not resume topic", "topic", topic, logging.ErrorKey, err)
+		}
+	}
+
+	if left, untracked := a.drainer.outstanding(), a.drainer.Untracked(); len(left) > 0 || untracked > 0 {
+		l.Warn("drained with messages left to recovery", "messages", len(left), "untracked", untracked)
+		return
+	}
+	err = a.p.Transport().Broadcast(drainedEvent, []byte(host))
+	if err != nil {
+		l.Warn("could not tell peers the host has drained", logging.ErrorKey, err)
+		return
+	}
+	l.Info("drained", "handed_off", len(handedOff))
+}
+
+// pauseTopic pauses delivery of topic's messages while the node drains.
+func pauseTopic(topic string) {
+	err := n.GetTopic(topic).Pause()
+	if err != nil {
+		auditLog.Warn("could not pause topic", "topic", topic, logging.ErrorKey, err)
+	}
+}
+
+// clientsInFlight counts the messages of client topics in flight to consumers.
+func clientsInFlight() int {
+	inFlight := 0
+	for _, t := range n.GetStats() {
+		if strings.HasPrefix(t.TopicName, "audit.") {
+			continue
+		}
+		for _, c := range t.Channels {
+			inFlight += c.InFlightCount
+		}
+	}
+	return inFlight
+}
+
+// handOffUnfinished hands messages to peers, and stops tracking those handed
+// off.
+func (a auditor) handOffUnfinished(l *logging.Logger, messages []auditMessage) []auditMessage {
+	if len(messages) == 0 {
+		return nil
+	}
+
+	handedOff, err := handOff(messages, a.handOffPeers())
+	if err != nil {
+		l.Error("could not hand off every unfinished message", "handed_off", len(handedOff), "messages", len(messages), logging.ErrorKey, err)
+	}
+	for _, m := range handedOff {
+		a.drainer.finished(m.ID)
+	}
+	return handedOff
+}
+
+// emptyHandedOff empties the topics, and their channels, whose messages have
+// all been handed off, and returns them. A topic is left alone if it may hold
+// a message that has not been: one still unfinished, or more messages than
+// were handed off from it, as when the drainer did not track some of them.
+func (a auditor) emptyHandedOff(l *logging.Logger, handedOff []auditMessage) map[string]bool {
+	counts := map[string]int64{}
+	for _, m := range handedOff {
+		counts[m.Topic]++
+	}
+	for _, m := range a.drainer.outstanding() {
+		delete(counts, m.Topic)
+	}
+
+	emptied := map[string]bool{}
+	for _, t := range n.GetStats() {
+		count, ok := counts[t.TopicName]
+		if !ok {
+			continue
+		}
+		if held := heldMessages(t); held > count {
+			l.Warn("not emptying topic holding messages that were not handed off", "topic", t.TopicName, "held", held, "handed_off", count)
+			continue
+		}
+
+		topic := n.GetTopic(t.TopicName)
+		err := topic.Empty()
+		for _, c := range t.Channels {
+			if err == nil {
+				err = topic.GetChannel(c.ChannelName).Empty()
+			}
+		}
+		if err != nil {
+			l.Error("could not empty handed off messages from topic", "topic", t.TopicName, logging.ErrorKey, err)
+			continue
+		}
+		emptied[t.TopicName] = true
+	}
+	return emptied
+}
+
+// heldMessages is the most messages a topic holds for any one of its channels:
+// those not yet put on its channels, along with those queued, in flight or
+// deferred on the channel.
+func heldMessages(t nsqd.TopicStats) int64 {
+	var most int64
+	for _, c := range t.Channels {
+		held := c.Depth + int64(c.InFlightCount) + int64(c.DeferredCount)
+		if held > most {
+			most = held
+		}
+	}
+	return t.Depth + most
+}
+
+// handOffPeers lists the nsqd HTTP addresses of the peers that can take
+// messages: those alive, not draining and advertising nsqdHTTPTag.
+func (a auditor) handOffPeers() []string {
+	local := a.ag.Serf().LocalMember().Name
+
+	peers := []string{}
+	for _, m := range a.ag.Serf().Members() {
+		addr := m.Tags[nsqdHTTPTag]
+		if m.Name == local || m.Status != serf.StatusAlive || m.Tags[drainingTag] == "true" || addr == "" {
+			continue
+		}
+		peers = append(peers, addr)
+	}
+	sort.Strings(peers)
+	return peers
+}
+
+// handOff publishes messages to their topics on the nsqd HTTP APIs at peers,
+// spreading them across the peers and trying each in turn if one fails. It
+// stops at the first message no peer takes, returning the messages handed off
+// before it along with the error.
+func handOff(messages []auditMessage, peers []string) ([]auditMessage, error) {
+	if len(peers) == 0 {
+		return nil, fmt.Errorf("no peers to hand messages to")
+	}
+
+	client := &http.Client{Timeout: handOffTimeout}
+	handedOff := []auditMessage{}
+	var lastErr error
+	for i, m := range messages {
+		for j := range peers {
+			peer := peers[(i+j)%len(peers)]
+			err := publish(client, peer, m)
+			if err == nil {
+				handedOff = append(handedOff, m)
+				lastErr = nil
+				break
+			}
+			auditLog.Warn("could not hand message to peer", "peer", peer, logging.MessageIDKey, string(m.ID[:]), logging.ErrorKey, err)
+			lastErr = err
+		}
+		if lastErr != nil {
+			return handedOff, lastErr
+		}
+	}
+	return handedOff, nil
+}
+
+// publish publishes m to its topic through the nsqd HTTP API at addr.
+func publish(client *http.Client, addr string, m auditMessage) error {
+	u := url.URL{Scheme: "http", Host: addr, Path: "/pub", RawQuery: url.Values{"topic": {m.Topic}}.Encode()}
+	rsp, err := client.Post(u.String(), "application/octet-stream", bytes.NewReader(m.Body))
+	if err != nil {
+		return err
+	}
+	defer rsp.Body.Close()
+
+	if rsp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(rsp.Body)
+		return fmt.Errorf("%s: %s", rsp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+// forgetDrained stops auditing hosts whose nodes have drained. When polity
+// authenticates its members, a node may only report that it has drained itself.
+func (a auditor) forgetDrained(e polity.UserEvent) {
+	if e.Name != drainedEvent {
+		return
+	}
+	host := string(e.Payload)
+	if host == a.hostname() {
+		return
+	}
+	if e.From != "" && e.From != host {
+		auditLog.Warn("ignoring drained event for another host", logging.HostKey, host, "from", e.From)
+		return
+	}
+
+	a.hostsLock.Lock()
+	_, ok := a.hosts[host]
+	delete(a.hosts, host)
+	a.hostsLock.Unlock()
+	if ok {
+		auditLog.Info("forgetting drained host", logging.HostKey, host)
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bitly/nsq/nsqd"
+)
+
+func TestDrainerWait(t *testing.T) {
+	d := newDrainer(1 << 20)
+	d.queued(&nsqd.Message{ID: nsqd.MessageID{2}}, "orders")
+	d.queued(&nsqd.Message{ID: nsqd.MessageID{1}}, "orders")
+	inFlight := func() int { return 1 }
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		d.finished(nsqd.MessageID{1})
+	}()
+	unfinished := d.wait(300*time.Millisecond, inFlight)
+	if len(unfinished) != 1 || unfinished[0].ID != (nsqd.MessageID{2}) || unfinished[0].Topic != "orders" {
+		t.Fatal("Expected message 2 to be unfinished, got", unfinished)
+	}
+
+	start := time.Now()
+	unfinished = d.wait(time.Second, func() int { return 0 })
+	if len(unfinished) != 1 || time.Since(start) > 500*time.Millisecond {
+		t.Fatal("Expected the wait to end once no messages are in flight, got", unfinished, time.Since(start))
+	}
+
+	d.finished(nsqd.MessageID{2})
+	if unfinished := d.wait(time.Second, inFlight); len(unfinished) != 0 {
+		t.Fatal("Expected every message to be finished, got", unfinished)
+	}
+}
+
+func TestDrainerBounds(t *testing.T) {
+	d := newDrainer(10)
+	if d.queued(&nsqd.Message{ID: nsqd.MessageID{1}, Body: []byte("123456")}, "orders") {
+		t.Fatal("Expected no topic to be paused before draining")
+	}
+	d.queued(&nsqd.Message{ID: nsqd.MessageID{2}, Body: []byte("123456")}, "orders")
+	if len(d.outstanding()) != 1 || d.Untracked() != 1 {
+		t.Fatal("Expected one message tracked and one untracked, got", d.outstanding(), d.Untracked())
+	}
+
+	d.finished(nsqd.MessageID{1})
+	d.queued(&nsqd.Message{ID: nsqd.MessageID{3}, Body: []byte("123456")}, "orders")
+	if len(d.outstanding()) != 1 {
+		t.Fatal("Expected a finished message to free its share of the bound, got", d.outstanding())
+	}
+
+	d.start()
+	if !d.queued(&nsqd.Message{ID: nsqd.MessageID{4}}, "orders") {
+		t.Fatal("Expected a topic queued on while draining to need pausing")
+	}
+	if d.queued(&nsqd.Message{ID: nsqd.MessageID{5}}, "orders") {
+		t.Fatal("Expected a topic to be paused only once")
+	}
+	if topics := d.pausedTopics(); len(topics) != 1 || topics[0] != "orders" {
+		t.Fatal("Expected orders to be paused, got", topics)
+	}
+}
+
+func TestHeldMessages(t *testing.T) {
+	stats := nsqd.TopicStats{
+		TopicName: "orders",
+		Depth:     1,
+		Channels: []nsqd.ChannelStats{
+			{ChannelName: "billing", Depth: 2, InFlightCount: 1},
+			{ChannelName: "shipping", Depth: 1, DeferredCount: 1},
+		},
+	}
+	if held := heldMessages(stats); held != 4 {
+		t.Fatal("Expected the topic to hold 4 messages for its fullest channel, got", held)
+	}
+}
+
+func TestHandOff(t *testing.T) {
+	var mu sync.Mutex
+	published := map[string]string{}
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		mu.Lock()
+		published[string(body)] = r.URL.Path + "?" + r.URL.RawQuery
+		mu.Unlock()
+		w.Write([]byte("OK"))
+	}))
+	defer peer.Close()
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "EXITING", http.StatusInternalServerError)
+	}))
+	defer down.Close()
+
+	messages := []auditMessage{
+		{Message: nsqd.Message{ID: nsqd.MessageID{1}, Body: []byte("a")}, Topic: "orders"},
+		{Message: nsqd.Message{ID: nsqd.MessageID{2}, Body: []byte("b")}, Topic: "shipments"},
+	}
+	peers := []string{strings.TrimPrefix(down.URL, "http://"), strings.TrimPrefix(peer.URL, "http://")}
+
+	handedOff, err := handOff(messages, peers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(handedOff) != 2 {
+		t.Fatal("Expected both messages to be handed off, got", handedOff)
+	}
+	if published["a"] != "/pub?topic=orders" || published["b"] != "/pub?topic=shipments" {
+		t.Fatal("Messages were not published to their topics on the working peer:", published)
+	}
+
+	handedOff, err = handOff(messages, peers[:1])
+	if err == nil || len(handedOff) != 0 {
+		t.Fatal("Expected handing off to a failing peer to fail, got", handedOff, err)
+	}
+}
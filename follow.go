@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/bitly/nsq/nsqd"
+	"github.com/hashicorp/serf/serf"
+	"github.com/shipwire/ansqd/internal/logging"
+	"github.com/shipwire/ansqd/internal/subscriber"
+)
+
+// nsqdTCPTag advertises the address of a node's nsqd TCP listener, from which
+// peers consume its audit records.
+const nsqdTCPTag = "ansqd-nsqd-tcp-address"
+
+var (
+	// followInterval is how often the peers whose audit records are consumed
+	// are brought in line with serf's membership.
+	followInterval = 5 * time.Second
+
+	// followRetry is how long to wait before subscribing again to a peer's
+	// audit topic after losing the subscription.
+	followRetry = 5 * time.Second
+
+	// followMaxInFlight is how many audit records a peer may send ahead of
+	// those being handled.
+	followMaxInFlight = 100
+)
+
+// follow consumes the audit records of every alive peer advertising nsqdTCPTag,
+// until the serf agent shuts down. Each node consumes a peer's audit.send and
+// audit.finish on a channel of its own, named by auditChannel, so that every
+// node audits every peer. The channels are not ephemeral, so records published
+// while a node is away are waiting when it returns; the channels of a node that
+// leaves for good must be deleted from its peers' nsqds by hand.
+func (a auditor) follow() {
+	ticker := time.NewTicker(followInterval)
+	defer ticker.Stop()
+
+	following := map[string]context.CancelFunc{}
+	defer func() {
+		for _, cancel := range following {
+			cancel()
+		}
+	}()
+
+	for {
+		peers := a.auditPeers()
+		for addr, cancel := range following {
+			if !peers[addr] {
+				cancel()
+				delete(following, addr)
+			}
+		}
+		for addr := range peers {
+			if _, ok := following[addr]; ok {
+				continue
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			following[addr] = cancel
+			go a.followTopic(ctx, addr, "audit.send", a.Audit)
+			go a.followTopic(ctx, addr, "audit.finish", a.Fin)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-a.ag.ShutdownCh():
+			return
+		}
+	}
+}
+
+// auditPeers lists the nsqd TCP addresses of the alive peers advertising
+// nsqdTCPTag.
+func (a auditor) auditPeers() map[string]bool {
+	local := a.ag.Serf().LocalMember().Name
+
+	peers := map[string]bool{}
+	for _, m := range a.ag.Serf().Members() {
+		addr := m.Tags[nsqdTCPTag]
+		if m.Name == local || m.Status != serf.StatusAlive || addr == "" {
+			continue
+		}
+		peers[addr] = true
+	}
+	return peers
+}
+
+// followTopic passes the audit records published to topic on the nsqd at addr
+// to handle, subscribing again whenever the subscription is lost, until ctx is
+// done.
+func (a auditor) followTopic(ctx context.Context, addr, topic string, handle func(*nsqd.Message)) {
+	l := auditLog.With("peer", addr, "topic", topic)
+	channel := auditChannel(a.hostname())
+
+	for {
+		err := subscriber.Subscribe(ctx, addr, topic, channel, followMaxInFlight, func(m *subscriber.Message) error {
+			handle(&nsqd.Message{
+				ID:        nsqd.MessageID(m.ID),
+				Body:      m.Body,
+				Timestamp: m.Timestamp,
+				Attempts:  m.Attempts,
+			})
+			return nil
+		})
+		if ctx.Err() != nil {
+			return
+		}
+		l.Warn("lost audit subscription", logging.ErrorKey, err)
+
+		select {
+		case <-time.After(followRetry):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// auditChannel is the channel on which the node named host consumes its peers'
+// audit records: its name, with the characters nsqd does not allow in channel
+// names replaced, cut to nsqd's limit of 64 characters.
+func auditChannel(host string) string {
+	channel := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '.', r == '_', r == '-':
+			return r
+		}
+		return '_'
+	}, host)
+	if len(channel) > 64 {
+		channel = channel[:64]
+	}
+	return channel
+}
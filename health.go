@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/hashicorp/serf/serf"
+)
+
+// healthReport is the local node's view of the cluster, as served on
+// /ansqd/health and /ansqd/ready.
+//
+// A node is healthy while its serf agent is running; restarting an unhealthy
+// node may help. Deciding that takes only local state, so a liveness probe is
+// answered promptly however the cluster is faring. A node is ready while a
+// quorum of the cluster also answers its queries, it is keeping up with its
+// peers' audit records and it is not draining; traffic should be kept away
+// from a node that is not ready, but restarting it will not help. Only
+// /ansqd/ready queries the cluster, so only it reports Ready and Quorum.
+type healthReport struct {
+	Healthy  bool     `json:"healthy"`
+	Ready    *bool    `json:"ready,omitempty"`
+	Draining bool     `json:"draining"`
+	Problems []string `json:"problems,omitempty"`
+
+	Serf   serfHealth   `json:"serf"`
+	Polity polityHealth `json:"polity"`
+	Audit  auditHealth  `json:"audit"`
+}
+
+type serfHealth struct {
+	Status       string `json:"status"`
+	Members      int    `json:"members"`
+	AliveMembers int    `json:"alive_members"`
+}
+
+type polityHealth struct {
+	Voters        int `json:"voters"`
+	VotesRequired int `json:"votes_required"`
+
+	// Quorum is whether a quorum answered a query within quorumQueryTimeout;
+	// if not, QueryError says why.
+	Quorum     *bool  `json:"quorum,omitempty"`
+	QueryError string `json:"query_error,omitempty"`
+}
+
+type auditHealth struct {
+	// LagSeconds is the lag of the latest audit record, received at
+	// LastReceived.
+	LagSeconds   float64    `json:"lag_seconds"`
+	LastReceived *time.Time `json:"last_received,omitempty"`
+	CaughtUp     bool       `json:"caught_up"`
+
+	// Recovering lists the hosts this node is recovering.
+	Recovering []string `json:"recovering"`
+}
+
+// maxAuditLag is how far behind its peers' audit records a node may fall and
+// still be ready. A record arriving after its message expired would find the
+// message already recovered, so half the expiration leaves a margin.
+func maxAuditLag() time.Duration {
+	return ExpirationTime() / 2
+}
+
+// quorumQueryTimeout bounds the query by which a health check tests for a
+// quorum, so that probes are answered promptly.
+var quorumQueryTimeout = 2 * time.Second
+
+// health reports the local node's view of the cluster. If ready is set, it
+// queries the cluster for a quorum and decides whether the node is ready.
+func (a auditor) health(ready bool) *healthReport {
+	r := &healthReport{Draining: a.drainer.Draining()}
+
+	s := a.ag.Serf()
+	r.Serf.Status = s.State().String()
+	for _, m := range s.Members() {
+		r.Serf.Members++
+		if m.Status == serf.StatusAlive {
+			r.Serf.AliveMembers++
+		}
+	}
+
+	r.Polity.Voters, r.Polity.VotesRequired = a.p.Quorum()
+	if ready {
+		_, err := a.p.QueryRoleInfoWithin(coordinatorRole, quorumQueryTimeout)
+		quorum := err == nil
+		r.Polity.Quorum = &quorum
+		if err != nil {
+			r.Polity.QueryError = err.Error()
+		}
+	}
+
+	lag, at := a.stats.lag.Last()
+	if !at.IsZero() {
+		r.Audit.LagSeconds = lag.Seconds()
+		r.Audit.LastReceived = &at
+	}
+
+	a.hostsLock.Lock()
+	hosts := make(map[string]*Host, len(a.hosts))
+	for name, h := range a.hosts {
+		hosts[name] = h
+	}
+	a.hostsLock.Unlock()
+
+	r.Audit.Recovering = []string{}
+	for name, h := range hosts {
+		if h.Recovering() {
+			r.Audit.Recovering = append(r.Audit.Recovering, name)
+		}
+	}
+	sort.Strings(r.Audit.Recovering)
+
+	r.check(ready, time.Now(), lag, maxAuditLag())
+	return r
+}
+
+// check decides whether the node is healthy and, if ready is set, whether it is
+// ready, given the lag of the latest audit record. The lag only counts against
+// the node while records are still arriving; once they stop, there is nothing
+// left to catch up on.
+func (r *healthReport) check(ready bool, now time.Time, lag, maxLag time.Duration) {
+	r.Problems = nil
+
+	r.Healthy = r.Serf.Status == serf.SerfAlive.String()
+	if !r.Healthy {
+		r.Problems = append(r.Problems, "serf agent is "+r.Serf.Status)
+	}
+
+	if r.Serf.AliveMembers < 2 {
+		r.Problems = append(r.Problems, "isolated from the serf cluster")
+	}
+
+	if r.Polity.Voters < r.Polity.VotesRequired {
+		r.Problems = append(r.Problems, "too few voters for a quorum")
+	}
+	if r.Polity.Quorum != nil && !*r.Polity.Quorum {
+		r.Problems = append(r.Problems, "no quorum answered a query")
+	}
+
+	r.Audit.CaughtUp = r.Audit.LastReceived == nil || lag < maxLag || now.Sub(*r.Audit.LastReceived) >= maxLag
+	if !r.Audit.CaughtUp {
+		r.Problems = append(r.Problems, "behind on peers' audit records")
+	}
+
+	if r.Draining {
+		r.Problems = append(r.Problems, "draining")
+	}
+
+	if ready {
+		isReady := len(r.Problems) == 0
+		r.Ready = &isReady
+	}
+}
+
+// healthHandler serves the local node's health report. The response is 200 OK
+// if the node is healthy, or ready if ready is set, and 503 Service
+// Unavailable otherwise, so that it can back liveness and readiness probes.
+//
+// The admin API listens on the loopback interface by default, which kubelet's
+// HTTP probes cannot reach, since they connect to the pod's IP. Either give
+// --ansqd-http-address the pod's IP or 0.0.0.0, which exposes to the network
+// only the endpoints served to any client, or keep the default and use exec
+// probes that fetch the endpoints from inside the container, such as
+// "wget -q -O /dev/null http://127.0.0.1:4155/ansqd/ready".
+func healthHandler(a auditor, ready bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		r := a.health(ready)
+
+		status := http.StatusOK
+		if !r.Healthy || ready && !*r.Ready {
+			status = http.StatusServiceUnavailable
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(r)
+	})
+}
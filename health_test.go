@@ -0,0 +1,71 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHealthCheck(t *testing.T) {
+	now := time.Now()
+	recent, old := now.Add(-time.Second), now.Add(-time.Minute)
+	yes, no := true, false
+
+	for _, test := range []struct {
+		name           string
+		report         healthReport
+		lag            time.Duration
+		healthy, ready bool
+	}{
+		{
+			name:    "ready",
+			report:  healthReport{Serf: serfHealth{"alive", 3, 3}, Polity: polityHealth{Voters: 3, VotesRequired: 2, Quorum: &yes}},
+			healthy: true, ready: true,
+		},
+		{
+			name:    "isolated",
+			report:  healthReport{Serf: serfHealth{"alive", 3, 1}, Polity: polityHealth{Voters: 1, VotesRequired: 2, Quorum: &no}},
+			healthy: true,
+		},
+		{
+			name:   "shut down",
+			report: healthReport{Serf: serfHealth{"shutdown", 3, 3}, Polity: polityHealth{Voters: 3, VotesRequired: 2, Quorum: &yes}},
+		},
+		{
+			name:    "no quorum answering",
+			report:  healthReport{Serf: serfHealth{"alive", 3, 3}, Polity: polityHealth{Voters: 3, VotesRequired: 2, Quorum: &no, QueryError: "lost election"}},
+			healthy: true,
+		},
+		{
+			name:    "behind",
+			report:  healthReport{Serf: serfHealth{"alive", 3, 3}, Polity: polityHealth{Voters: 3, VotesRequired: 2, Quorum: &yes}, Audit: auditHealth{LastReceived: &recent}},
+			lag:     20 * time.Second,
+			healthy: true,
+		},
+		{
+			name:    "caught up after records stop",
+			report:  healthReport{Serf: serfHealth{"alive", 3, 3}, Polity: polityHealth{Voters: 3, VotesRequired: 2, Quorum: &yes}, Audit: auditHealth{LastReceived: &old}},
+			lag:     20 * time.Second,
+			healthy: true, ready: true,
+		},
+		{
+			name:    "draining",
+			report:  healthReport{Draining: true, Serf: serfHealth{"alive", 3, 3}, Polity: polityHealth{Voters: 3, VotesRequired: 2, Quorum: &yes}},
+			healthy: true,
+		},
+	} {
+		r := test.report
+		r.check(true, now, test.lag, 10*time.Second)
+		if r.Healthy != test.healthy || r.Ready == nil || *r.Ready != test.ready {
+			t.Errorf("%s: expected healthy=%v ready=%v, got healthy=%v ready=%v %v", test.name, test.healthy, test.ready, r.Healthy, r.Ready, r.Problems)
+		}
+	}
+}
+
+func TestLivenessCheck(t *testing.T) {
+	// a liveness check leaves out the quorum query, and readiness with it
+	r := healthReport{Serf: serfHealth{"alive", 3, 3}, Polity: polityHealth{Voters: 3, VotesRequired: 2}}
+	r.check(false, time.Now(), 0, 10*time.Second)
+	if !r.Healthy || r.Ready != nil || len(r.Problems) != 0 {
+		t.Errorf("expected a healthy report with no readiness, got healthy=%v ready=%v %v", r.Healthy, r.Ready, r.Problems)
+	}
+}
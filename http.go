@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/bitly/nsq/nsqd"
+	"github.com/shipwire/ansqd/internal/logging"
+	"github.com/shipwire/ansqd/internal/metrics"
+)
+
+// adminServer serves ansqd's own HTTP API on a listener separate from nsqd's.
+type adminServer struct {
+	mux      *http.ServeMux
+	listener net.Listener
+}
+
+// newAdminServer listens on addr and registers ansqd's endpoints. drain is
+// called when the node is asked to drain.
+func newAdminServer(addr string, a auditor, n *nsqd.NSQD, drain func()) (*adminServer, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &adminServer{
+		mux:      http.NewServeMux(),
+		listener: ln,
+	}
+	s.mux.Handle("/ansqd/members", membersHandler(a))
+	s.mux.Handle("/ansqd/roles", rolesHandler(a))
+	s.mux.Handle("/ansqd/hosts", hostsHandler(a))
+	s.mux.Handle("/ansqd/hosts/", hostsHandler(a))
+	s.mux.Handle("/ansqd/drain", drainHandler(drain))
+	s.mux.Handle("/ansqd/health", healthHandler(a, false))
+	s.mux.Handle("/ansqd/ready", healthHandler(a, true))
+	s.mux.Handle("/metrics", metricsHandler(a, n))
+	s.mux.Handle("/polity/metrics", metrics.Handler(a.p.Metrics()))
+	s.mux.Handle("/serf/keys", keysHandler(a.ag))
+	s.mux.Handle("/serf/keys/", keysHandler(a.ag))
+	return s, nil
+}
+
+// fromLocalHost tests whether r was made from the loopback interface. Endpoints
+// that change the node's state or expose message bodies only serve such
+// requests, since the admin API may listen on a public address for probes
+// and scrapes.
+func fromLocalHost(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	ip := net.ParseIP(host)
+	return err == nil && ip != nil && ip.IsLoopback()
+}
+
+// Serve handles requests until the server is closed.
+func (s *adminServer) Serve() {
+	httpLog.Info("listening", "address", s.listener.Addr())
+	err := http.Serve(s.listener, s.mux)
+	if err != nil && !strings.Contains(err.Error(), "use of closed network connection") {
+		httpLog.Error("http.Serve() failed", logging.ErrorKey, err)
+	}
+	httpLog.Info("closing", "address", s.listener.Addr())
+}
+
+// Close stops accepting requests.
+func (s *adminServer) Close() error {
+	return s.listener.Close()
+}
@@ -0,0 +1,161 @@
+// Package admin describes the resources served by ansqd's admin HTTP API, and
+// provides a client for it.
+//
+// Resources are exchanged as JSON. Failed requests are answered with an error
+// status and a plain text explanation, which the client returns as an error.
+//
+// The API has no authentication of its own. Requests that change the node's
+// state or expose message bodies, which are recovering a host, cancelling a
+// recovery, dumping a message, draining the node and managing serf's keys, are
+// only served to clients on the node's loopback interface, and answered 403
+// Forbidden otherwise. Listing members, roles and hosts, health checks and
+// metrics are served to anyone who can reach the API's address, which is the
+// loopback interface unless configured otherwise.
+package admin
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Member is a member of the serf cluster.
+type Member struct {
+	Name   string            `json:"name"`
+	Addr   string            `json:"addr"`
+	Status string            `json:"status"`
+	Tags   map[string]string `json:"tags"`
+}
+
+// Host summarizes the audit of an nsqd host's messages.
+type Host struct {
+	Host     string   `json:"host"`
+	Messages int      `json:"messages"`
+	Buckets  int      `json:"buckets"`
+	Topics   []string `json:"topics"`
+
+	// Recovering is set while the node serving the request is recovering the
+	// host. RecoveredBy names the node holding the host's recovery role, which
+	// may be another.
+	Recovering  bool   `json:"recovering"`
+	RecoveredBy string `json:"recovered_by,omitempty"`
+}
+
+// Message is an audited message, as it will be republished if its host is
+// recovered.
+type Message struct {
+	ID        string    `json:"id"`
+	Host      string    `json:"host"`
+	Topic     string    `json:"topic"`
+	Body      []byte    `json:"body"`
+	Timestamp time.Time `json:"timestamp"`
+	Attempts  uint16    `json:"attempts"`
+	Expires   time.Time `json:"expires"`
+}
+
+// Client makes requests of the admin API of the ansqd at Addr.
+type Client struct {
+	Addr       string
+	HTTPClient *http.Client
+}
+
+// NewClient creates a client for the ansqd whose admin API listens on addr.
+func NewClient(addr string) *Client {
+	return &Client{
+		Addr:       addr,
+		HTTPClient: &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// Members lists the members of the serf cluster, as the node knows them.
+func (c *Client) Members() ([]Member, error) {
+	members := []Member{}
+	return members, c.do("GET", "/ansqd/members", nil, &members)
+}
+
+// Roles lists the held polity roles beginning with prefix, and their holders.
+func (c *Client) Roles(prefix string) (map[string]string, error) {
+	roles := map[string]string{}
+	return roles, c.do("GET", "/ansqd/roles", url.Values{"prefix": {prefix}}, &roles)
+}
+
+// Hosts summarizes the audit of every host the node has heard from.
+func (c *Client) Hosts() ([]Host, error) {
+	hosts := []Host{}
+	return hosts, c.do("GET", "/ansqd/hosts", nil, &hosts)
+}
+
+// Host summarizes the audit of a single host.
+func (c *Client) Host(host string) (*Host, error) {
+	h := &Host{}
+	return h, c.do("GET", "/ansqd/hosts/"+url.PathEscape(host), nil, h)
+}
+
+// Recover starts recovering host's outstanding messages on the node without
+// waiting for them to expire. It returns once the recovery has started.
+func (c *Client) Recover(host string) error {
+	return c.do("POST", "/ansqd/hosts/"+url.PathEscape(host)+"/recover", nil, nil)
+}
+
+// CancelRecovery stops the node's recovery of host. Messages republished so
+// far are checkpointed, so a later recovery carries on from where it stopped.
+func (c *Client) CancelRecovery(host string) error {
+	return c.do("POST", "/ansqd/hosts/"+url.PathEscape(host)+"/cancel", nil, nil)
+}
+
+// Message returns a message of host's that the node is auditing. id is the ID
+// as nsqd reports it, or as it is logged.
+func (c *Client) Message(host, id string) (*Message, error) {
+	m := &Message{}
+	return m, c.do("GET", "/ansqd/hosts/"+url.PathEscape(host)+"/messages/"+url.PathEscape(id), nil, m)
+}
+
+// Drain starts draining the node ahead of its shutdown. It returns once the
+// drain has started.
+func (c *Client) Drain() error {
+	return c.do("POST", "/ansqd/drain", nil, nil)
+}
+
+// do makes a request and decodes its response into v, if v is not nil. path is
+// escaped, so that a segment may contain an escaped slash.
+func (c *Client) do(method, path string, params url.Values, v interface{}) error {
+	unescaped, err := url.PathUnescape(path)
+	if err != nil {
+		return err
+	}
+	u := url.URL{Scheme: "http", Host: c.Addr, Path: unescaped, RawPath: path}
+	var body *strings.Reader
+	if method == "GET" {
+		u.RawQuery = params.Encode()
+		body = strings.NewReader("")
+	} else {
+		body = strings.NewReader(params.Encode())
+	}
+
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return err
+	}
+	if method != "GET" {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+
+	rsp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer rsp.Body.Close()
+
+	if rsp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(rsp.Body)
+		return fmt.Errorf("%s: %s", rsp.Status, strings.TrimSpace(string(msg)))
+	}
+	if v == nil {
+		return nil
+	}
+	return json.NewDecoder(rsp.Body).Decode(v)
+}
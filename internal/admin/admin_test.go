@@ -0,0 +1,51 @@
+package admin
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestClient(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == "GET" && r.URL.Path == "/ansqd/roles":
+			if r.FormValue("prefix") != "recover:" {
+				http.Error(w, "unexpected prefix "+r.FormValue("prefix"), http.StatusBadRequest)
+				return
+			}
+			w.Write([]byte(`{"recover:nsqd-1":"ansqd-2"}`))
+		case r.Method == "POST" && r.URL.Path == "/ansqd/hosts/nsqd-1/cancel":
+			http.Error(w, "host is not being recovered", http.StatusConflict)
+		case r.Method == "GET" && r.URL.Path == "/ansqd/hosts/nsqd 1":
+			w.Write([]byte(`{"host":"nsqd 1"}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer s.Close()
+
+	c := NewClient(strings.TrimPrefix(s.URL, "http://"))
+
+	roles, err := c.Roles("recover:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if roles["recover:nsqd-1"] != "ansqd-2" {
+		t.Fatal("Expected ansqd-2 to hold recover:nsqd-1, got", roles)
+	}
+
+	h, err := c.Host("nsqd 1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.Host != "nsqd 1" {
+		t.Fatal("Expected host nsqd 1, got", h.Host)
+	}
+
+	err = c.CancelRecovery("nsqd-1")
+	if err == nil || err.Error() != "409 Conflict: host is not being recovered" {
+		t.Fatal("Expected the server's explanation as an error, got", err)
+	}
+}
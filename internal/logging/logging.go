@@ -0,0 +1,317 @@
+// Package logging writes leveled, structured log lines in logfmt or JSON.
+//
+// Each line carries a time, a level, a message and any number of key-value
+// fields. A Logger made by With adds its fields to every line it writes, so a
+// logger can be scoped to a host, a role or an election and handed down to the
+// code working on it. Loggers made from the same root share its output and
+// level.
+//
+// A nil *Logger discards everything, so that logging is optional wherever a
+// Logger is accepted.
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode"
+)
+
+// Keys of the fields used to correlate lines across ansqd.
+const (
+	NodeKey      = "node"
+	HostKey      = "host"
+	MessageIDKey = "message_id"
+	RoleKey      = "role"
+	TermKey      = "term"
+	ElectionKey  = "election"
+	ErrorKey     = "error"
+)
+
+// Level is the severity of a line.
+type Level int32
+
+const (
+	Debug Level = iota
+	Info
+	Warn
+	Error
+)
+
+func (l Level) String() string {
+	switch l {
+	case Debug:
+		return "debug"
+	case Info:
+		return "info"
+	case Warn:
+		return "warn"
+	}
+	return "error"
+}
+
+// ParseLevel parses the name of a level.
+func ParseLevel(s string) (Level, error) {
+	switch strings.ToLower(s) {
+	case "debug", "trace":
+		return Debug, nil
+	case "info":
+		return Info, nil
+	case "warn", "warning":
+		return Warn, nil
+	case "err", "error":
+		return Error, nil
+	}
+	return Info, fmt.Errorf("unknown log level %q", s)
+}
+
+// Format is how lines are written.
+type Format int
+
+const (
+	// Logfmt writes space separated key=value pairs.
+	Logfmt Format = iota
+
+	// JSON writes an object per line.
+	JSON
+)
+
+// ParseFormat parses "logfmt" or "json".
+func ParseFormat(s string) (Format, error) {
+	switch strings.ToLower(s) {
+	case "logfmt":
+		return Logfmt, nil
+	case "json":
+		return JSON, nil
+	}
+	return Logfmt, fmt.Errorf("unknown log format %q", s)
+}
+
+// sink is the output shared by a root Logger and those made from it.
+type sink struct {
+	mu     sync.Mutex
+	w      io.Writer
+	format Format
+	level  int32
+	now    func() time.Time
+}
+
+// Logger writes lines at or above its level.
+type Logger struct {
+	sink   *sink
+	fields []interface{}
+}
+
+// New creates a Logger writing lines at or above level to w.
+func New(w io.Writer, format Format, level Level) *Logger {
+	return &Logger{sink: &sink{
+		w:      w,
+		format: format,
+		level:  int32(level),
+		now:    time.Now,
+	}}
+}
+
+// With returns a Logger that adds the key-value pairs kv to every line.
+func (l *Logger) With(kv ...interface{}) *Logger {
+	if l == nil {
+		return nil
+	}
+	fields := make([]interface{}, 0, len(l.fields)+len(kv))
+	fields = append(fields, l.fields...)
+	fields = append(fields, kv...)
+	return &Logger{sink: l.sink, fields: fields}
+}
+
+// SetLevel changes the level of l and every Logger sharing its output.
+func (l *Logger) SetLevel(level Level) {
+	if l == nil {
+		return
+	}
+	atomic.StoreInt32(&l.sink.level, int32(level))
+}
+
+// Enabled tests whether lines at level are written.
+func (l *Logger) Enabled(level Level) bool {
+	return l != nil && int32(level) >= atomic.LoadInt32(&l.sink.level)
+}
+
+// Debug writes a line at Debug level.
+func (l *Logger) Debug(msg string, kv ...interface{}) { l.Log(Debug, msg, kv...) }
+
+// Info writes a line at Info level.
+func (l *Logger) Info(msg string, kv ...interface{}) { l.Log(Info, msg, kv...) }
+
+// Warn writes a line at Warn level.
+func (l *Logger) Warn(msg string, kv ...interface{}) { l.Log(Warn, msg, kv...) }
+
+// Error writes a line at Error level.
+func (l *Logger) Error(msg string, kv ...interface{}) { l.Log(Error, msg, kv...) }
+
+// Fatal writes a line at Error level and exits.
+func (l *Logger) Fatal(msg string, kv ...interface{}) {
+	l.Log(Error, msg, kv...)
+	os.Exit(1)
+}
+
+// Log writes a line at level with the message msg and the key-value pairs kv
+// following l's own fields.
+func (l *Logger) Log(level Level, msg string, kv ...interface{}) {
+	if !l.Enabled(level) {
+		return
+	}
+
+	fields := make([]interface{}, 0, 6+len(l.fields)+len(kv))
+	fields = append(fields, "ts", l.sink.now().UTC().Format(time.RFC3339Nano), "level", level.String(), "msg", msg)
+	fields = append(fields, l.fields...)
+	fields = append(fields, kv...)
+	if len(fields)%2 != 0 {
+		fields = append(fields, "(missing)")
+	}
+
+	var buf bytes.Buffer
+	switch l.sink.format {
+	case JSON:
+		writeJSON(&buf, fields)
+	default:
+		writeLogfmt(&buf, fields)
+	}
+	buf.WriteByte('\n')
+
+	l.sink.mu.Lock()
+	defer l.sink.mu.Unlock()
+	l.sink.w.Write(buf.Bytes())
+}
+
+func writeLogfmt(buf *bytes.Buffer, fields []interface{}) {
+	for i := 0; i < len(fields); i += 2 {
+		if i > 0 {
+			buf.WriteByte(' ')
+		}
+		buf.WriteString(logfmtKey(fmt.Sprint(fields[i])))
+		buf.WriteByte('=')
+
+		v := formatValue(fields[i+1])
+		if v == "" || strings.IndexFunc(v, needsQuote) >= 0 {
+			v = strconv.Quote(v)
+		}
+		buf.WriteString(v)
+	}
+}
+
+func writeJSON(buf *bytes.Buffer, fields []interface{}) {
+	buf.WriteByte('{')
+	for i := 0; i < len(fields); i += 2 {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		k, _ := json.Marshal(fmt.Sprint(fields[i]))
+		buf.Write(k)
+		buf.WriteByte(':')
+
+		v, err := json.Marshal(jsonValue(fields[i+1]))
+		if err != nil {
+			v, _ = json.Marshal(formatValue(fields[i+1]))
+		}
+		buf.Write(v)
+	}
+	buf.WriteByte('}')
+}
+
+// jsonValue keeps numbers and booleans as they are in JSON, and formats other
+// values as strings.
+func jsonValue(v interface{}) interface{} {
+	switch v.(type) {
+	case bool, int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, float32, float64:
+		return v
+	}
+	return formatValue(v)
+}
+
+func formatValue(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return "nil"
+	case string:
+		return v
+	case error:
+		return v.Error()
+	case []byte:
+		return fmt.Sprintf("%x", v)
+	case time.Duration:
+		return v.String()
+	case time.Time:
+		return v.UTC().Format(time.RFC3339Nano)
+	}
+	return fmt.Sprint(v)
+}
+
+func logfmtKey(k string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '=' || needsQuote(r) {
+			return '_'
+		}
+		return r
+	}, k)
+}
+
+func needsQuote(r rune) bool {
+	return r == '"' || r == '=' || r == '\\' || unicode.IsSpace(r) || !unicode.IsPrint(r)
+}
+
+// Writer adapts l to libraries that write plain log lines, such as serf. Each
+// line written becomes the message of a line at level, or at the level named
+// by a "[LEVEL]" tag in the line, and a leading standard log timestamp is
+// dropped.
+func (l *Logger) Writer(level Level) io.Writer {
+	return &lineWriter{l: l, level: level}
+}
+
+// StdLogger returns a *log.Logger that writes through l at level.
+func (l *Logger) StdLogger(level Level) *log.Logger {
+	return log.New(l.Writer(level), "", 0)
+}
+
+type lineWriter struct {
+	l     *Logger
+	level Level
+}
+
+func (w *lineWriter) Write(b []byte) (int, error) {
+	for _, line := range strings.Split(strings.TrimRight(string(b), "\n"), "\n") {
+		if line == "" {
+			continue
+		}
+		level, msg := w.level, stripTimestamp(line)
+		if strings.HasPrefix(msg, "[") {
+			if end := strings.Index(msg, "]"); end > 0 {
+				if parsed, err := ParseLevel(msg[1:end]); err == nil {
+					level = parsed
+					msg = strings.TrimSpace(msg[end+1:])
+				}
+			}
+		}
+		w.l.Log(level, msg)
+	}
+	return len(b), nil
+}
+
+// stripTimestamp removes the "2006/01/02 15:04:05 " prefix the log package
+// writes by default.
+func stripTimestamp(line string) string {
+	const layout = "2006/01/02 15:04:05"
+	if len(line) > len(layout) && line[len(layout)] == ' ' {
+		if _, err := time.Parse(layout, line[:len(layout)]); err == nil {
+			return line[len(layout)+1:]
+		}
+	}
+	return line
+}
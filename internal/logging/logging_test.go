@@ -0,0 +1,69 @@
+package logging
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"testing"
+	"time"
+)
+
+func newTestLogger(format Format) (*Logger, *bytes.Buffer) {
+	var buf bytes.Buffer
+	l := New(&buf, format, Info)
+	l.sink.now = func() time.Time { return time.Date(2015, 6, 1, 12, 0, 0, 0, time.UTC) }
+	return l, &buf
+}
+
+func TestLogfmt(t *testing.T) {
+	l, buf := newTestLogger(Logfmt)
+
+	l = l.With(HostKey, "nsqd-1")
+	l.Debug("hidden")
+	l.Info("recovering", MessageIDKey, []byte{0x0a, 0xff}, "count", 3)
+	l.With(RoleKey, "recover:nsqd-1").Warn("lost \"lock\"", ErrorKey, errors.New("timed out"), "odd")
+
+	expected := `ts=2015-06-01T12:00:00Z level=info msg=recovering host=nsqd-1 message_id=0aff count=3
+ts=2015-06-01T12:00:00Z level=warn msg="lost \"lock\"" host=nsqd-1 role=recover:nsqd-1 error="timed out" odd=(missing)
+`
+	if buf.String() != expected {
+		t.Fatalf("Expected:\n%s\nGot:\n%s", expected, buf.String())
+	}
+}
+
+func TestJSON(t *testing.T) {
+	l, buf := newTestLogger(JSON)
+
+	l.SetLevel(Debug)
+	l.Debug("vote", NodeKey, "a", TermKey, uint64(7), "yes", true)
+
+	expected := `{"ts":"2015-06-01T12:00:00Z","level":"debug","msg":"vote","node":"a","term":7,"yes":true}
+`
+	if buf.String() != expected {
+		t.Fatalf("Expected:\n%s\nGot:\n%s", expected, buf.String())
+	}
+}
+
+func TestWriter(t *testing.T) {
+	l, buf := newTestLogger(Logfmt)
+
+	std := log.New(l.With("component", "serf").Writer(Info), "", log.LstdFlags)
+	std.Printf("[DEBUG] serf: hidden")
+	std.Printf("[WARN] memberlist: Was able to connect to b but other probes failed")
+	std.Printf("no level")
+
+	expected := `ts=2015-06-01T12:00:00Z level=warn msg="memberlist: Was able to connect to b but other probes failed" component=serf
+ts=2015-06-01T12:00:00Z level=info msg="no level" component=serf
+`
+	if buf.String() != expected {
+		t.Fatalf("Expected:\n%s\nGot:\n%s", expected, buf.String())
+	}
+}
+
+func TestNilLogger(t *testing.T) {
+	var l *Logger
+	l.With(HostKey, "a").Error("discarded")
+	if l.Enabled(Error) {
+		t.Fatal("A nil logger should not be enabled")
+	}
+}
@@ -0,0 +1,359 @@
+// Package metrics keeps counters, gauges and histograms in a Registry and
+// writes them in the Prometheus text exposition format.
+//
+// Every metric is a family of series distinguished by label values, which are
+// given in the order the label names were registered. Registering two metrics
+// with the same name, or recording a series with the wrong number of label
+// values, is a programming error and panics.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultBuckets are histogram upper bounds suited to latencies in seconds.
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30}
+
+const (
+	counterType   = "counter"
+	gaugeType     = "gauge"
+	histogramType = "histogram"
+)
+
+// Registry holds a set of metrics.
+type Registry struct {
+	mu       sync.Mutex
+	families []*family
+	names    map[string]bool
+}
+
+// NewRegistry creates an empty registry.
+func NewRegistry() *Registry {
+	return &Registry{names: make(map[string]bool)}
+}
+
+func (r *Registry) register(f *family) *family {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.names[f.name] {
+		panic("metrics: " + f.name + " registered twice")
+	}
+	r.names[f.name] = true
+	r.families = append(r.families, f)
+	return f
+}
+
+// Counter is a value that only increases.
+type Counter struct{ f *family }
+
+// NewCounter registers a counter.
+func (r *Registry) NewCounter(name, help string, labels ...string) *Counter {
+	return &Counter{r.register(newFamily(name, help, counterType, labels, nil))}
+}
+
+// Inc adds one to the series identified by labelValues.
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add adds v, which must not be negative, to the series identified by
+// labelValues.
+func (c *Counter) Add(v float64, labelValues ...string) {
+	if v < 0 {
+		panic("metrics: counter " + c.f.name + " decreased")
+	}
+	c.f.update(labelValues, func(s *series) { s.value += v })
+}
+
+// Value returns the current value of the series identified by labelValues.
+func (c *Counter) Value(labelValues ...string) float64 {
+	return c.f.value(labelValues)
+}
+
+// Gauge is a value that may go up and down.
+type Gauge struct{ f *family }
+
+// NewGauge registers a gauge.
+func (r *Registry) NewGauge(name, help string, labels ...string) *Gauge {
+	return &Gauge{r.register(newFamily(name, help, gaugeType, labels, nil))}
+}
+
+// Set sets the series identified by labelValues to v.
+func (g *Gauge) Set(v float64, labelValues ...string) {
+	g.f.update(labelValues, func(s *series) { s.value = v })
+}
+
+// Add adds v to the series identified by labelValues.
+func (g *Gauge) Add(v float64, labelValues ...string) {
+	g.f.update(labelValues, func(s *series) { s.value += v })
+}
+
+// Value returns the current value of the series identified by labelValues.
+func (g *Gauge) Value(labelValues ...string) float64 {
+	return g.f.value(labelValues)
+}
+
+// NewGaugeFunc registers a gauge whose series are computed by f each time the
+// registry is written. f maps values of the single label to the value of that
+// series. If label is empty the gauge is unlabeled, and f should return its
+// value under the empty string.
+func (r *Registry) NewGaugeFunc(name, help, label string, f func() map[string]float64) {
+	fam := newFamily(name, help, gaugeType, funcLabels(label), nil)
+	fam.fn = f
+	r.register(fam)
+}
+
+// NewCounterFunc registers a counter whose series are read from f each time
+// the registry is written, for counts kept elsewhere. f maps values of the
+// single label to the value of that series. If label is empty the counter is
+// unlabeled, and f should return its value under the empty string.
+func (r *Registry) NewCounterFunc(name, help, label string, f func() map[string]float64) {
+	fam := newFamily(name, help, counterType, funcLabels(label), nil)
+	fam.fn = f
+	r.register(fam)
+}
+
+func funcLabels(label string) []string {
+	if label == "" {
+		return nil
+	}
+	return []string{label}
+}
+
+// Histogram counts observations in buckets.
+type Histogram struct{ f *family }
+
+// NewHistogram registers a histogram with the given bucket upper bounds, which
+// must be in increasing order.
+func (r *Registry) NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	return &Histogram{r.register(newFamily(name, help, histogramType, labels, buckets))}
+}
+
+// Observe records v in the series identified by labelValues.
+func (h *Histogram) Observe(v float64, labelValues ...string) {
+	h.f.update(labelValues, func(s *series) {
+		for i, bound := range h.f.buckets {
+			if v <= bound {
+				s.buckets[i]++
+			}
+		}
+		s.count++
+		s.sum += v
+	})
+}
+
+// Count returns the number of observations in the series identified by
+// labelValues.
+func (h *Histogram) Count(labelValues ...string) uint64 {
+	h.f.mu.Lock()
+	defer h.f.mu.Unlock()
+
+	if s, ok := h.f.series[h.f.key(labelValues)]; ok {
+		return s.count
+	}
+	return 0
+}
+
+type family struct {
+	name, help, kind string
+	labels           []string
+	buckets          []float64
+	fn               func() map[string]float64
+
+	mu     sync.Mutex
+	series map[string]*series
+}
+
+type series struct {
+	labels []string
+	value  float64
+
+	buckets []uint64
+	count   uint64
+	sum     float64
+}
+
+func newFamily(name, help, kind string, labels []string, buckets []float64) *family {
+	return &family{
+		name:    name,
+		help:    help,
+		kind:    kind,
+		labels:  labels,
+		buckets: buckets,
+		series:  make(map[string]*series),
+	}
+}
+
+func (f *family) key(labelValues []string) string {
+	if len(labelValues) != len(f.labels) {
+		panic(fmt.Sprintf("metrics: %s takes %d label values, got %d", f.name, len(f.labels), len(labelValues)))
+	}
+	return strings.Join(labelValues, "\xff")
+}
+
+func (f *family) update(labelValues []string, fn func(*series)) {
+	k := f.key(labelValues)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	s, ok := f.series[k]
+	if !ok {
+		s = &series{
+			labels:  append([]string(nil), labelValues...),
+			buckets: make([]uint64, len(f.buckets)),
+		}
+		f.series[k] = s
+	}
+	fn(s)
+}
+
+func (f *family) value(labelValues []string) float64 {
+	k := f.key(labelValues)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if s, ok := f.series[k]; ok {
+		return s.value
+	}
+	return 0
+}
+
+// snapshot copies the family's series, sorted by label values.
+func (f *family) snapshot() []series {
+	if f.fn != nil {
+		values := f.fn()
+		snap := make([]series, 0, len(values))
+		for label, v := range values {
+			snap = append(snap, series{labels: []string{label}[:len(f.labels)], value: v})
+		}
+		sort.Sort(byLabels(snap))
+		return snap
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	snap := make([]series, 0, len(f.series))
+	for _, s := range f.series {
+		c := *s
+		c.buckets = append([]uint64(nil), s.buckets...)
+		snap = append(snap, c)
+	}
+	sort.Sort(byLabels(snap))
+	return snap
+}
+
+type byLabels []series
+
+func (b byLabels) Len() int      { return len(b) }
+func (b byLabels) Swap(i, j int) { b[i], b[j] = b[j], b[i] }
+func (b byLabels) Less(i, j int) bool {
+	for n := range b[i].labels {
+		if b[i].labels[n] != b[j].labels[n] {
+			return b[i].labels[n] < b[j].labels[n]
+		}
+	}
+	return false
+}
+
+// WriteTo writes every metric in the registry to w in the Prometheus text
+// format.
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	families := append([]*family(nil), r.families...)
+	r.mu.Unlock()
+
+	cw := &countingWriter{w: w}
+	bw := bufio.NewWriter(cw)
+	for _, f := range families {
+		fmt.Fprintf(bw, "# HELP %s %s\n", f.name, escapeHelp(f.help))
+		fmt.Fprintf(bw, "# TYPE %s %s\n", f.name, f.kind)
+
+		for _, s := range f.snapshot() {
+			if f.kind != histogramType {
+				writeSample(bw, f.name, f.labels, s.labels, "", "", s.value)
+				continue
+			}
+
+			for i, bound := range f.buckets {
+				writeSample(bw, f.name+"_bucket", f.labels, s.labels, "le", formatFloat(bound), float64(s.buckets[i]))
+			}
+			writeSample(bw, f.name+"_bucket", f.labels, s.labels, "le", "+Inf", float64(s.count))
+			writeSample(bw, f.name+"_sum", f.labels, s.labels, "", "", s.sum)
+			writeSample(bw, f.name+"_count", f.labels, s.labels, "", "", float64(s.count))
+		}
+	}
+	err := bw.Flush()
+	return cw.n, err
+}
+
+// Handler serves the metrics of every given registry.
+func Handler(registries ...*Registry) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		for _, r := range registries {
+			_, err := r.WriteTo(w)
+			if err != nil {
+				return
+			}
+		}
+	})
+}
+
+func writeSample(w io.Writer, name string, labels, values []string, extraLabel, extraValue string, v float64) {
+	pairs := make([]string, 0, len(labels)+1)
+	for i, l := range labels {
+		pairs = append(pairs, l+"="+quoteLabel(values[i]))
+	}
+	if extraLabel != "" {
+		pairs = append(pairs, extraLabel+"="+quoteLabel(extraValue))
+	}
+
+	if len(pairs) > 0 {
+		fmt.Fprintf(w, "%s{%s} %s\n", name, strings.Join(pairs, ","), formatFloat(v))
+	} else {
+		fmt.Fprintf(w, "%s %s\n", name, formatFloat(v))
+	}
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func escapeHelp(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(s)
+}
+
+func quoteLabel(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s) + `"`
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	c.n += int64(n)
+	return n, err
+}
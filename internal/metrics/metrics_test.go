@@ -0,0 +1,76 @@
+package metrics
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestWriteTo(t *testing.T) {
+	r := NewRegistry()
+
+	c := r.NewCounter("elections_total", "Elections by outcome.", "outcome")
+	c.Inc("won")
+	c.Inc("won")
+	c.Add(3, "lost")
+
+	g := r.NewGauge("members", "Known members.")
+	g.Set(5)
+	g.Add(-1)
+
+	h := r.NewHistogram("latency_seconds", "Query latency.", []float64{0.1, 1}, "kind")
+	h.Observe(0.05, "role")
+	h.Observe(0.5, "role")
+	h.Observe(2, "role")
+
+	r.NewGaugeFunc("roles", "Roles by status.", "status", func() map[string]float64 {
+		return map[string]float64{"running": 1, "confirmed": 2}
+	})
+
+	r.NewCounterFunc("expirations_total", "Expirations.", "", func() map[string]float64 {
+		return map[string]float64{"": 7}
+	})
+
+	r.NewCounter("escaped_total", "Help with a \\ and\na newline.", "value").Inc("a \"quoted\"\nvalue")
+
+	expected := `# HELP elections_total Elections by outcome.
+# TYPE elections_total counter
+elections_total{outcome="lost"} 3
+elections_total{outcome="won"} 2
+# HELP members Known members.
+# TYPE members gauge
+members 4
+# HELP latency_seconds Query latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{kind="role",le="0.1"} 1
+latency_seconds_bucket{kind="role",le="1"} 2
+latency_seconds_bucket{kind="role",le="+Inf"} 3
+latency_seconds_sum{kind="role"} 2.55
+latency_seconds_count{kind="role"} 3
+# HELP roles Roles by status.
+# TYPE roles gauge
+roles{status="confirmed"} 2
+roles{status="running"} 1
+# HELP expirations_total Expirations.
+# TYPE expirations_total counter
+expirations_total 7
+# HELP escaped_total Help with a \\ and\na newline.
+# TYPE escaped_total counter
+escaped_total{value="a \"quoted\"\nvalue"} 1
+`
+
+	buf := &bytes.Buffer{}
+	n, err := r.WriteTo(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != expected {
+		t.Fatalf("Expected\n%s\ngot\n%s", expected, buf.String())
+	}
+	if n != int64(buf.Len()) {
+		t.Fatalf("WriteTo reported %d bytes, wrote %d", n, buf.Len())
+	}
+
+	if c.Value("won") != 2 || g.Value() != 4 || h.Count("role") != 3 {
+		t.Fatal("Values read back did not match those recorded")
+	}
+}
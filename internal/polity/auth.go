@@ -0,0 +1,378 @@
+package polity
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// PublicKeyTag is the member tag through which a node advertises the ed25519
+// public key its messages are signed with.
+const PublicKeyTag = "polity-key"
+
+// MaxClockSkew bounds how old, or how far in the future, a signed query or
+// event may be. Older messages are rejected so that recorded ones cannot be
+// replayed later, and newer ones are remembered until then so that they cannot
+// be replayed in the meantime.
+var MaxClockSkew = time.Minute
+
+// Authenticator signs messages sent by the local node and verifies messages
+// from others.
+type Authenticator interface {
+	// Sign signs msg as the local node.
+	Sign(msg []byte) []byte
+
+	// Verify tests whether sig is signer's signature of msg.
+	Verify(signer string, msg, sig []byte) bool
+}
+
+// NewHMACAuthenticator creates an Authenticator from a key shared by every
+// node. Any holder of the key may sign as any node.
+func NewHMACAuthenticator(key []byte) Authenticator {
+	return hmacAuthenticator{key}
+}
+
+type hmacAuthenticator struct {
+	key []byte
+}
+
+func (a hmacAuthenticator) Sign(msg []byte) []byte {
+	mac := hmac.New(sha256.New, a.key)
+	mac.Write(msg)
+	return mac.Sum(nil)
+}
+
+func (a hmacAuthenticator) Verify(signer string, msg, sig []byte) bool {
+	return hmac.Equal(a.Sign(msg), sig)
+}
+
+// NewEd25519Authenticator creates an Authenticator that signs with key and
+// verifies other nodes' messages against the public keys they advertise in
+// their PublicKeyTag on t. Since any member may advertise any key, only the
+// trusted keys are accepted; key's public key is always trusted. The local
+// node must advertise key's public key as well.
+func NewEd25519Authenticator(key ed25519.PrivateKey, t Transport, trusted []ed25519.PublicKey) Authenticator {
+	return ed25519Authenticator{key, t, append([]ed25519.PublicKey{key.Public().(ed25519.PublicKey)}, trusted...)}
+}
+
+// EncodePublicKey formats a public key as the value of PublicKeyTag.
+func EncodePublicKey(key ed25519.PublicKey) string {
+	return base64.StdEncoding.EncodeToString(key)
+}
+
+type ed25519Authenticator struct {
+	key     ed25519.PrivateKey
+	t       Transport
+	trusted []ed25519.PublicKey
+}
+
+func (a ed25519Authenticator) Sign(msg []byte) []byte {
+	return ed25519.Sign(a.key, msg)
+}
+
+func (a ed25519Authenticator) Verify(signer string, msg, sig []byte) bool {
+	for _, m := range a.t.Members() {
+		if m.Name != signer {
+			continue
+		}
+		key, err := base64.StdEncoding.DecodeString(m.Tags[PublicKeyTag])
+		if err != nil || len(key) != ed25519.PublicKeySize || !a.trusts(key) {
+			return false
+		}
+		return ed25519.Verify(ed25519.PublicKey(key), msg, sig)
+	}
+	return false
+}
+
+func (a ed25519Authenticator) trusts(key []byte) bool {
+	for _, k := range a.trusted {
+		if bytes.Equal(k, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// Authenticate wraps t so that every query, response and event sent over it is
+// signed by auth, and every one received is verified. Messages that cannot be
+// verified are dropped before they reach the polity, and counted by its
+// polity_auth_rejections_total metric.
+func Authenticate(t Transport, auth Authenticator) Transport {
+	at := &authTransport{
+		Transport:  t,
+		auth:       auth,
+		events:     make(chan Event, 10),
+		seen:       make(map[string]time.Time),
+		rejections: make(map[string]*uint64),
+	}
+	for _, kind := range []string{"query", "response", "event"} {
+		at.rejections[kind] = new(uint64)
+	}
+	go at.translate()
+	return at
+}
+
+// authTransport signs and verifies the messages of the Transport it wraps.
+//
+// A signed query or event carries its signer, the time it was signed and the
+// signature ahead of the original payload. A signed response carries only its
+// signature, which also covers the query it answers, so that a response cannot
+// be replayed to a different query.
+type authTransport struct {
+	Transport
+	auth   Authenticator
+	events chan Event
+
+	// seen holds the signatures of the queries and events received, until
+	// they are too old to be accepted anyway, so that none is accepted twice.
+	seen      map[string]time.Time
+	seenMutex sync.Mutex
+	swept     time.Time
+
+	// rejections counts dropped messages by kind. The map is not modified
+	// after construction.
+	rejections map[string]*uint64
+}
+
+func (t *authTransport) reject(kind string) {
+	atomic.AddUint64(t.rejections[kind], 1)
+}
+
+// rejectionCounts returns the number of messages dropped, by kind.
+func (t *authTransport) rejectionCounts() map[string]float64 {
+	counts := make(map[string]float64, len(t.rejections))
+	for kind, n := range t.rejections {
+		counts[kind] = float64(atomic.LoadUint64(n))
+	}
+	return counts
+}
+
+func (t *authTransport) translate() {
+	for {
+		select {
+		case e := <-t.Transport.Events():
+			if evt := t.verify(e); evt != nil {
+				select {
+				case t.events <- evt:
+				case <-t.ShutdownCh():
+					return
+				}
+			}
+		case <-t.ShutdownCh():
+			return
+		}
+	}
+}
+
+// verify checks a received event, returning it with its signature removed, or
+// nil if it could not be verified.
+func (t *authTransport) verify(e Event) Event {
+	switch evt := e.(type) {
+	case *Query:
+		signer, ts, payload, ok := t.open("query", evt.Name, evt.Payload)
+		if !ok {
+			t.reject("query")
+			return nil
+		}
+		q := &Query{
+			Name:    evt.Name,
+			Payload: payload,
+			LTime:   evt.LTime,
+		}
+		q.respond = func(b []byte) error {
+			sig := t.auth.Sign(responseMessage(evt.Name, t.LocalName(), signer, ts, payload, b))
+			return evt.Respond(append([]byte(encodeSignature(sig)+" "), b...))
+		}
+		return q
+	case UserEvent:
+		signer, _, payload, ok := t.open("event", evt.Name, evt.Payload)
+		if !ok {
+			t.reject("event")
+			return nil
+		}
+		evt.Payload = payload
+		evt.From = signer
+		return evt
+	}
+	return e
+}
+
+// seal signs payload as the local node.
+func (t *authTransport) seal(kind, name string, payload []byte) (ts int64, sealed []byte) {
+	signer := t.LocalName()
+	ts = time.Now().UnixNano()
+	sig := t.auth.Sign(signedMessage(kind, name, signer, ts, payload))
+
+	header := signer + " " + strconv.FormatInt(ts, 10) + " " + encodeSignature(sig) + " "
+	return ts, append([]byte(header), payload...)
+}
+
+// open verifies a sealed payload, returning its signer, the time it was signed
+// and the original payload.
+func (t *authTransport) open(kind, name string, sealed []byte) (signer string, ts int64, payload []byte, ok bool) {
+	parts := bytes.SplitN(sealed, []byte(" "), 4)
+	if len(parts) != 4 {
+		return "", 0, nil, false
+	}
+	signer = string(parts[0])
+	ts, err := strconv.ParseInt(string(parts[1]), 10, 64)
+	if err != nil {
+		return "", 0, nil, false
+	}
+	sig, err := decodeSignature(string(parts[2]))
+	if err != nil {
+		return "", 0, nil, false
+	}
+	payload = parts[3]
+
+	if skew := time.Since(time.Unix(0, ts)); skew > MaxClockSkew || skew < -MaxClockSkew {
+		return "", 0, nil, false
+	}
+	if !t.auth.Verify(signer, signedMessage(kind, name, signer, ts, payload), sig) {
+		return "", 0, nil, false
+	}
+	if t.replayed(kind, sig, time.Unix(0, ts)) {
+		return "", 0, nil, false
+	}
+	return signer, ts, payload, true
+}
+
+// replayed tests whether a query or event signed at ts has been received
+// before, and remembers it if not.
+func (t *authTransport) replayed(kind string, sig []byte, ts time.Time) bool {
+	t.seenMutex.Lock()
+	defer t.seenMutex.Unlock()
+
+	now := time.Now()
+	if now.Sub(t.swept) > MaxClockSkew {
+		for key, expires := range t.seen {
+			if now.After(expires) {
+				delete(t.seen, key)
+			}
+		}
+		t.swept = now
+	}
+
+	key := kind + " " + string(sig)
+	if _, ok := t.seen[key]; ok {
+		return true
+	}
+	t.seen[key] = ts.Add(MaxClockSkew)
+	return false
+}
+
+func (t *authTransport) Query(name string, payload []byte, timeout time.Duration) (QueryResponse, error) {
+	ts, sealed := t.seal("query", name, payload)
+	qr, err := t.Transport.Query(name, sealed, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &authQueryResponse{
+		qr:   qr,
+		ch:   make(chan NodeResponse),
+		done: make(chan struct{}),
+	}
+	go r.relay(t, name, ts, payload)
+	return r, nil
+}
+
+func (t *authTransport) Broadcast(name string, payload []byte) error {
+	_, sealed := t.seal("event", name, payload)
+	return t.Transport.Broadcast(name, sealed)
+}
+
+func (t *authTransport) Events() <-chan Event {
+	return t.events
+}
+
+// authQueryResponse relays the responses to a signed query that can be
+// verified.
+type authQueryResponse struct {
+	qr        QueryResponse
+	ch        chan NodeResponse
+	done      chan struct{}
+	closeOnce sync.Once
+	finished  int32
+}
+
+func (r *authQueryResponse) relay(t *authTransport, name string, ts int64, query []byte) {
+	defer func() {
+		atomic.StoreInt32(&r.finished, 1)
+		close(r.ch)
+	}()
+
+	sender := t.LocalName()
+	for rsp := range r.qr.ResponseCh() {
+		parts := bytes.SplitN(rsp.Payload, []byte(" "), 2)
+		var sig []byte
+		var err error
+		if len(parts) == 2 {
+			sig, err = decodeSignature(string(parts[0]))
+		}
+		if len(parts) != 2 || err != nil || !t.auth.Verify(rsp.From, responseMessage(name, rsp.From, sender, ts, query, parts[1]), sig) {
+			t.reject("response")
+			continue
+		}
+
+		select {
+		case r.ch <- NodeResponse{From: rsp.From, Payload: parts[1]}:
+		case <-r.done:
+			return
+		}
+	}
+}
+
+func (r *authQueryResponse) ResponseCh() <-chan NodeResponse {
+	return r.ch
+}
+
+func (r *authQueryResponse) Finished() bool {
+	return atomic.LoadInt32(&r.finished) == 1
+}
+
+func (r *authQueryResponse) Close() {
+	r.closeOnce.Do(func() {
+		close(r.done)
+		r.qr.Close()
+	})
+}
+
+// signedMessage is what is signed for a query or event.
+func signedMessage(kind, name, signer string, ts int64, payload []byte) []byte {
+	msg := &bytes.Buffer{}
+	for _, field := range []string{kind, name, signer, strconv.FormatInt(ts, 10)} {
+		msg.WriteString(field)
+		msg.WriteByte(0)
+	}
+	msg.Write(payload)
+	return msg.Bytes()
+}
+
+// responseMessage is what is signed for a response, binding it to the query it
+// answers.
+func responseMessage(name, responder, sender string, ts int64, query, response []byte) []byte {
+	digest := sha256.Sum256(query)
+	msg := &bytes.Buffer{}
+	for _, field := range []string{"response", name, responder, sender, strconv.FormatInt(ts, 10), hex.EncodeToString(digest[:])} {
+		msg.WriteString(field)
+		msg.WriteByte(0)
+	}
+	msg.Write(response)
+	return msg.Bytes()
+}
+
+func encodeSignature(sig []byte) string {
+	return base64.StdEncoding.EncodeToString(sig)
+}
+
+func decodeSignature(s string) ([]byte, error) {
+	return base64.StdEncoding.DecodeString(s)
+}
@@ -0,0 +1,85 @@
+package polity
+
+import (
+	"context"
+	"time"
+
+	"github.com/shipwire/ansqd/internal/logging"
+)
+
+// campaignResignTimeout bounds how long a campaign spends resigning its role
+// once its context is done.
+var campaignResignTimeout = 5 * time.Second
+
+// Campaign keeps the local node running for role until ctx is done. Each time
+// it wins, onElected is called with a context that is cancelled once the node
+// loses the role, whether by impeachment or because ctx is done. When
+// onElected has returned, onDemoted is called and, unless ctx is done, the
+// campaign begins again.
+//
+// When ctx is done the role is resigned and ctx's error is returned. Resigning
+// gives up after campaignResignTimeout, since without a quorum it could not
+// finish; ResignAll may be used to try again. Other errors from running for the
+// role are returned immediately.
+func (p *Polity) Campaign(ctx context.Context, role string, onElected func(context.Context), onDemoted func()) error {
+	m := p.NewMutex(role)
+	for {
+		err := m.Lock(ctx)
+		if err != nil {
+			return err
+		}
+
+		p.logger().Info("elected", logging.RoleKey, role)
+
+		term, cancel := context.WithCancel(ctx)
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			onElected(term)
+		}()
+
+		p.waitDemoted(term, role)
+		cancel()
+		<-done
+
+		p.logger().Info("demoted", logging.RoleKey, role)
+		if onDemoted != nil {
+			onDemoted()
+		}
+
+		if ctx.Err() != nil {
+			abort := make(chan struct{})
+			timer := time.AfterFunc(campaignResignTimeout, func() { close(abort) })
+			err := m.unlock(abort)
+			timer.Stop()
+			if err != nil {
+				p.logger().Warn("error resigning", logging.RoleKey, role, logging.ErrorKey, err)
+			}
+			return ctx.Err()
+		}
+
+		// the role was taken from us, so there is nothing to recall
+		m.unlockLocal(m.local)
+	}
+}
+
+// waitDemoted blocks until the local node's view of role shows that it no
+// longer holds it, or until ctx is done.
+func (p *Polity) waitDemoted(ctx context.Context, role string) {
+	local := p.t.LocalName()
+	for {
+		changed := p.Watch(role)
+
+		r, ok := p.lookup(role)
+		if ok && (r.node != local || (r.status != running && r.status != confirmed)) {
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			p.unwatch(changed, role)
+			return
+		case <-changed:
+		}
+	}
+}
@@ -0,0 +1,425 @@
+package polity
+
+import (
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// chaosSeed seeds TestChaos's clients and nemesis. Scheduling and network delays
+// still vary between runs, so a seed narrows down a failure rather than
+// reproducing it exactly.
+var chaosSeed = flag.Int64("chaos.seed", 0, "seed for TestChaos, or 0 to seed from the clock")
+
+// TestChaos runs randomized elections, recalls and queries against a polity on a
+// MemoryNetwork while partitioning, healing, crashing and restarting its
+// members. It then checks that the recorded elections and recalls of each role
+// are linearizable, and that queries only returned nodes that ran for the role.
+// Queries are answered by a quorum without read repair, so they are not
+// expected to be linearizable and are not checked as though they were.
+func TestChaos(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping chaos test in short mode")
+	}
+
+	dir, err := ioutil.TempDir("", "polity-chaos")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := newChaosCluster(t, dir, 5)
+	c.network.SetLatency(time.Millisecond, 10*time.Millisecond)
+	c.network.SetLoss(0.01)
+	c.network.SetTimeout(200 * time.Millisecond)
+
+	seed := *chaosSeed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	t.Logf("seed %d (rerun with -chaos.seed=%d)", seed, seed)
+
+	stop := make(chan struct{})
+	clients := &sync.WaitGroup{}
+	for i := 0; i < 4; i++ {
+		clients.Add(1)
+		go func(seed int64) {
+			defer clients.Done()
+			c.client(rand.New(rand.NewSource(seed)), []string{"a", "b"}, stop)
+		}(seed + 1 + int64(i))
+	}
+
+	c.nemesis(t, rand.New(rand.NewSource(seed)), 5*time.Second)
+	close(stop)
+
+	c.network.Heal()
+	c.restartAll(t)
+
+	done := make(chan struct{})
+	go func() {
+		clients.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Minute):
+		t.Fatal("operations did not complete after the network healed")
+	}
+
+	for role, ops := range c.history.byRole() {
+		err := checkOwnership(ops)
+		if err != nil {
+			t.Errorf("role %s: %s\n%s", role, err, formatHistory(ops))
+		}
+		err = checkQueries(ops)
+		if err != nil {
+			t.Errorf("role %s: %s\n%s", role, err, formatHistory(ops))
+		}
+	}
+}
+
+// chaosCluster is a set of polities on a MemoryNetwork whose members may be
+// crashed and restarted. Each member persists its roles so that it remembers its
+// votes across restarts.
+type chaosCluster struct {
+	network *MemoryNetwork
+	dir     string
+	history *history
+
+	mu       sync.Mutex
+	names    []string
+	polities map[string]*Polity
+	crashed  map[string]bool
+}
+
+func newChaosCluster(t *testing.T, dir string, n int) *chaosCluster {
+	c := &chaosCluster{
+		network:  NewMemoryNetwork(),
+		dir:      dir,
+		history:  &history{},
+		names:    names[:n],
+		polities: make(map[string]*Polity),
+		crashed:  make(map[string]bool),
+	}
+	for _, name := range c.names {
+		c.start(t, name)
+	}
+	return c
+}
+
+func (c *chaosCluster) start(t *testing.T, name string) {
+	p, err := New(c.network.Join(name), filepath.Join(c.dir, name))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.mu.Lock()
+	c.polities[name] = p
+	delete(c.crashed, name)
+	c.mu.Unlock()
+}
+
+func (c *chaosCluster) crash(name string) {
+	c.mu.Lock()
+	c.crashed[name] = true
+	c.mu.Unlock()
+
+	c.network.Crash(name)
+}
+
+func (c *chaosCluster) restartAll(t *testing.T) {
+	c.mu.Lock()
+	crashed := []string{}
+	for name := range c.crashed {
+		crashed = append(crashed, name)
+	}
+	c.mu.Unlock()
+
+	for _, name := range crashed {
+		c.start(t, name)
+	}
+}
+
+func (c *chaosCluster) polity(name string) *Polity {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.polities[name]
+}
+
+// client runs random operations against random members until stop is closed.
+func (c *chaosCluster) client(r *rand.Rand, roles []string, stop <-chan struct{}) {
+	for {
+		select {
+		case <-stop:
+			return
+		case <-time.After(time.Duration(r.Intn(20)) * time.Millisecond):
+		}
+
+		op := chaosOp{
+			node: c.names[r.Intn(len(c.names))],
+			role: roles[r.Intn(len(roles))],
+		}
+		p := c.polity(op.node)
+
+		op.start = time.Now()
+		switch n := r.Intn(100); {
+		case n < 45:
+			op.kind = "elect"
+			op.err = <-p.RunElection(op.role)
+		case n < 75:
+			op.kind = "recall"
+			op.err = <-p.RunRecallElection(op.role)
+		default:
+			op.kind = "query"
+			op.value, op.err = p.QueryRole(op.role)
+		}
+		op.end = time.Now()
+
+		c.history.add(op)
+	}
+}
+
+// nemesis disrupts the network for the given duration. It never crashes a
+// majority of the cluster.
+func (c *chaosCluster) nemesis(t *testing.T, r *rand.Rand, duration time.Duration) {
+	deadline := time.Now().Add(duration)
+	for time.Now().Before(deadline) {
+		time.Sleep(time.Duration(200+r.Intn(200)) * time.Millisecond)
+
+		c.mu.Lock()
+		crashed := []string{}
+		for name := range c.crashed {
+			crashed = append(crashed, name)
+		}
+		c.mu.Unlock()
+
+		switch r.Intn(4) {
+		case 0:
+			perm := r.Perm(len(c.names))
+			split := 1 + r.Intn(len(c.names)-1)
+			a, b := []string{}, []string{}
+			for i, n := range perm {
+				if i < split {
+					a = append(a, c.names[n])
+				} else {
+					b = append(b, c.names[n])
+				}
+			}
+			c.network.Partition(a, b)
+		case 1:
+			c.network.Heal()
+		case 2:
+			if len(crashed) < (len(c.names)-1)/2 {
+				c.crash(c.names[r.Intn(len(c.names))])
+			}
+		case 3:
+			if len(crashed) > 0 {
+				c.start(t, crashed[r.Intn(len(crashed))])
+			}
+		}
+	}
+}
+
+// chaosOp is a single operation in a history.
+type chaosOp struct {
+	kind       string
+	node       string
+	role       string
+	start, end time.Time
+	value      string
+	err        error
+}
+
+func (o chaosOp) String() string {
+	result := "ok"
+	if o.err != nil {
+		result = o.err.Error()
+	}
+	value := ""
+	if o.kind == "query" && o.err == nil {
+		value = " -> " + o.value
+	}
+	return fmt.Sprintf("%s %s %s%s [%s] %s..%s", o.node, o.kind, o.role, value, result,
+		o.start.Format("15:04:05.000"), o.end.Format("15:04:05.000"))
+}
+
+// history records completed operations.
+type history struct {
+	mu  sync.Mutex
+	ops []chaosOp
+}
+
+func (h *history) add(op chaosOp) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.ops = append(h.ops, op)
+}
+
+func (h *history) byRole() map[string][]chaosOp {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	roles := make(map[string][]chaosOp)
+	for _, op := range h.ops {
+		roles[op.role] = append(roles[op.role], op)
+	}
+	return roles
+}
+
+func formatHistory(ops []chaosOp) string {
+	sorted := append([]chaosOp(nil), ops...)
+	sort.Sort(byStart(sorted))
+
+	lines := make([]string, len(sorted))
+	for i, op := range sorted {
+		lines[i] = op.String()
+	}
+	return strings.Join(lines, "\n")
+}
+
+type byStart []chaosOp
+
+func (b byStart) Len() int           { return len(b) }
+func (b byStart) Less(i, j int) bool { return b[i].start.Before(b[j].start) }
+func (b byStart) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+
+// checkOwnership searches for a linearization of the elections and recalls of a
+// role against a register holding the role's owner, as Wing and Gong's
+// algorithm does, memoizing the register and set of linearized operations at
+// each dead end. A successful election of c
+// requires the role to be vacant or held by c and leaves it held by c. A
+// successful recall leaves it vacant. A failed election or recall may or may not
+// have taken effect at any point after it began, since it may have timed out
+// after some of its confirmations were applied.
+func checkOwnership(history []chaosOp) error {
+	type entry struct {
+		op       chaosOp
+		required bool
+	}
+
+	entries := []entry{}
+	for _, op := range history {
+		switch {
+		case op.kind == "elect" && op.err == nil:
+			entries = append(entries, entry{op, true})
+		case op.kind == "recall" && op.err == nil:
+			entries = append(entries, entry{op, true})
+		case op.kind == "elect", op.kind == "recall":
+			entries = append(entries, entry{op, false})
+		}
+	}
+
+	required := 0
+	for _, e := range entries {
+		if e.required {
+			required++
+		}
+	}
+
+	done := make(opSet, (len(entries)+63)/64)
+	visited := make(map[string]bool)
+
+	var search func(holder string, remaining int) bool
+	search = func(holder string, remaining int) bool {
+		if remaining == 0 {
+			return true
+		}
+
+		key := holder + " " + done.key()
+		if visited[key] {
+			return false
+		}
+		visited[key] = true
+
+		// an operation may only be linearized next if it began before every
+		// other outstanding required operation ended
+		var horizon time.Time
+		for i, e := range entries {
+			if !done.has(i) && e.required && (horizon.IsZero() || e.op.end.Before(horizon)) {
+				horizon = e.op.end
+			}
+		}
+
+		for i, e := range entries {
+			if done.has(i) || e.op.start.After(horizon) {
+				continue
+			}
+
+			next := ""
+			if e.op.kind == "elect" {
+				if holder != "" && holder != e.op.node {
+					continue
+				}
+				next = e.op.node
+			}
+
+			left := remaining
+			if e.required {
+				left--
+			}
+
+			done.set(i)
+			ok := search(next, left)
+			done.clear(i)
+			if ok {
+				return true
+			}
+		}
+		return false
+	}
+
+	if !search("", required) {
+		return fmt.Errorf("ownership is not linearizable")
+	}
+	return nil
+}
+
+// checkQueries verifies that every successful query returned a node that had
+// begun running for the role before the query finished. This is a sanity check
+// on the values queries return, not a linearizability check.
+func checkQueries(history []chaosOp) error {
+	for _, q := range history {
+		if q.kind != "query" || q.err != nil {
+			continue
+		}
+
+		found := false
+		for _, op := range history {
+			if op.kind == "elect" && op.node == q.value && op.start.Before(q.end) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("query returned %s, which never ran for the role", q.value)
+		}
+	}
+	return nil
+}
+
+// opSet is a bitset of the operations linearized so far.
+type opSet []uint64
+
+func (s opSet) has(i int) bool { return s[i/64]&(1<<uint(i%64)) != 0 }
+func (s opSet) set(i int)      { s[i/64] |= 1 << uint(i%64) }
+func (s opSet) clear(i int)    { s[i/64] &^= 1 << uint(i%64) }
+
+// key encodes the set compactly for use as a map key.
+func (s opSet) key() string {
+	b := make([]byte, 8*len(s))
+	for i, w := range s {
+		binary.LittleEndian.PutUint64(b[8*i:], w)
+	}
+	return string(b)
+}
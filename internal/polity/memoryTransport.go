@@ -0,0 +1,421 @@
+package polity
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// MemoryNetwork connects polities in memory. It can partition members from each
+// other, delay messages and drop them at random, which makes it useful for
+// testing a polity without starting serf agents.
+//
+// Membership changes only when members join or leave. A crashed member, or one
+// partitioned from the member asking, is still counted by NumMembers but is
+// reported as not alive, as serf reports members its failure detection has
+// declared dead.
+type MemoryNetwork struct {
+	mu         sync.Mutex
+	members    map[string]*memoryTransport
+	tags       map[string]map[string]string
+	blocked    map[[2]string]bool
+	minLatency time.Duration
+	maxLatency time.Duration
+	loss       float64
+	timeout    time.Duration
+	queryLimit int
+	eventLimit int
+	clock      LamportTime
+	rand       *rand.Rand
+}
+
+// NewMemoryNetwork creates an empty network with no latency or message loss.
+func NewMemoryNetwork() *MemoryNetwork {
+	return &MemoryNetwork{
+		members: make(map[string]*memoryTransport),
+		tags:    make(map[string]map[string]string),
+		blocked: make(map[[2]string]bool),
+		rand:    rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// Join adds a member to the network and returns its Transport. Joining with the
+// name of a crashed member restarts it.
+func (n *MemoryNetwork) Join(name string) Transport {
+	t := &memoryTransport{
+		net:        n,
+		name:       name,
+		events:     make(chan Event, 1024),
+		shutdownCh: make(chan struct{}),
+	}
+
+	n.mu.Lock()
+	if old, ok := n.members[name]; ok {
+		old.shutdown()
+	}
+	n.members[name] = t
+
+	existing := []string{}
+	others := []*memoryTransport{}
+	for other, m := range n.members {
+		existing = append(existing, other)
+		if other != name {
+			others = append(others, m)
+		}
+	}
+	n.mu.Unlock()
+
+	go t.push(MemberJoin{existing})
+	for _, m := range others {
+		go m.push(MemberJoin{[]string{name}})
+	}
+	return t
+}
+
+// Leave removes a member from the network.
+func (n *MemoryNetwork) Leave(name string) {
+	n.mu.Lock()
+	t, ok := n.members[name]
+	delete(n.members, name)
+	delete(n.tags, name)
+	n.mu.Unlock()
+
+	if ok {
+		t.shutdown()
+	}
+}
+
+// Crash stops a member without removing it from the network. It stays a member
+// but can no longer send or receive messages.
+func (n *MemoryNetwork) Crash(name string) {
+	n.mu.Lock()
+	t, ok := n.members[name]
+	n.mu.Unlock()
+
+	if ok {
+		t.shutdown()
+	}
+}
+
+// SetTags replaces the tags a member advertises to the rest of the network.
+func (n *MemoryNetwork) SetTags(name string, tags map[string]string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.tags[name] = tags
+}
+
+// Partition prevents members in different groups from exchanging messages.
+// Messages already in flight between them are lost.
+func (n *MemoryNetwork) Partition(groups ...[]string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	for i, a := range groups {
+		for _, b := range groups[i+1:] {
+			for _, x := range a {
+				for _, y := range b {
+					n.blocked[[2]string{x, y}] = true
+					n.blocked[[2]string{y, x}] = true
+				}
+			}
+		}
+	}
+}
+
+// Heal removes all partitions.
+func (n *MemoryNetwork) Heal() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.blocked = make(map[[2]string]bool)
+}
+
+// SetLatency delays each message by a random duration between min and max.
+func (n *MemoryNetwork) SetLatency(min, max time.Duration) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.minLatency, n.maxLatency = min, max
+}
+
+// SetLoss drops each message with probability p.
+func (n *MemoryNetwork) SetLoss(p float64) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.loss = p
+}
+
+// SetTimeout overrides the timeout of every query sent over the network. Since
+// messages are delivered within the configured latency, a short timeout keeps
+// tests fast. A zero timeout uses the timeout requested by the sender.
+func (n *MemoryNetwork) SetTimeout(timeout time.Duration) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.timeout = timeout
+}
+
+// SetSizeLimits rejects queries and broadcasts whose name and payload together
+// are larger than queryLimit and eventLimit bytes, as serf does. Serf's query
+// limit also covers its own framing of the query, which is not counted here. A
+// zero limit leaves the size unlimited.
+func (n *MemoryNetwork) SetSizeLimits(queryLimit, eventLimit int) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.queryLimit, n.eventLimit = queryLimit, eventLimit
+}
+
+func (n *MemoryNetwork) sizeLimits() (queryLimit, eventLimit int) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	return n.queryLimit, n.eventLimit
+}
+
+func (n *MemoryNetwork) timeoutOverride() time.Duration {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	return n.timeout
+}
+
+// tick advances the network's Lamport clock.
+func (n *MemoryNetwork) tick() LamportTime {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.clock++
+	return n.clock
+}
+
+// recipients lists the current members of the network.
+func (n *MemoryNetwork) recipients() []string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	names := make([]string, 0, len(n.members))
+	for name := range n.members {
+		names = append(names, name)
+	}
+	return names
+}
+
+// memberList lists the members of the network as viewer sees them.
+func (n *MemoryNetwork) memberList(viewer string) []Member {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	members := make([]Member, 0, len(n.members))
+	for name, t := range n.members {
+		alive := !t.stopped() && !n.blocked[[2]string{viewer, name}]
+		members = append(members, Member{Name: name, Tags: n.tags[name], Alive: alive})
+	}
+	return members
+}
+
+func (n *MemoryNetwork) numMembers() int {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	return len(n.members)
+}
+
+// reachable tests whether from can currently send a message to to, returning
+// the recipient's transport if so.
+func (n *MemoryNetwork) reachable(from *memoryTransport, to string) (*memoryTransport, bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.members[from.name] != from || from.stopped() {
+		return nil, false
+	}
+	t, ok := n.members[to]
+	if !ok || t.stopped() || n.blocked[[2]string{from.name, to}] {
+		return nil, false
+	}
+	return t, true
+}
+
+// send delivers a message from one member to another, subject to the network's
+// partitions, latency and loss. deliver is called with the recipient's
+// transport if the message arrives.
+func (n *MemoryNetwork) send(from *memoryTransport, to string, deliver func(*memoryTransport)) {
+	if _, ok := n.reachable(from, to); !ok {
+		return
+	}
+
+	n.mu.Lock()
+	lost := n.loss > 0 && n.rand.Float64() < n.loss
+	delay := n.minLatency
+	if n.maxLatency > n.minLatency {
+		delay += time.Duration(n.rand.Int63n(int64(n.maxLatency - n.minLatency)))
+	}
+	n.mu.Unlock()
+
+	if lost {
+		return
+	}
+
+	time.AfterFunc(delay, func() {
+		if t, ok := n.reachable(from, to); ok {
+			deliver(t)
+		}
+	})
+}
+
+// memoryTransport is one member's Transport on a MemoryNetwork.
+type memoryTransport struct {
+	net        *MemoryNetwork
+	name       string
+	events     chan Event
+	shutdownCh chan struct{}
+	stopOnce   sync.Once
+}
+
+func (t *memoryTransport) shutdown() {
+	t.stopOnce.Do(func() {
+		close(t.shutdownCh)
+	})
+}
+
+func (t *memoryTransport) stopped() bool {
+	select {
+	case <-t.shutdownCh:
+		return true
+	default:
+		return false
+	}
+}
+
+func (t *memoryTransport) push(e Event) {
+	select {
+	case t.events <- e:
+	case <-t.shutdownCh:
+	}
+}
+
+func (t *memoryTransport) LocalName() string {
+	return t.name
+}
+
+func (t *memoryTransport) NumMembers() int {
+	return t.net.numMembers()
+}
+
+func (t *memoryTransport) Members() []Member {
+	return t.net.memberList(t.name)
+}
+
+func (t *memoryTransport) Query(name string, payload []byte, timeout time.Duration) (QueryResponse, error) {
+	if t.stopped() {
+		return nil, ErrTransportShutdown
+	}
+
+	if limit, _ := t.net.sizeLimits(); limit > 0 && len(name)+len(payload) > limit {
+		return nil, fmt.Errorf("query exceeds limit of %d bytes", limit)
+	}
+	if override := t.net.timeoutOverride(); override > 0 {
+		timeout = override
+	}
+
+	recipients := t.net.recipients()
+	ltime := t.net.tick()
+	qr := &memoryQueryResponse{ch: make(chan NodeResponse, len(recipients))}
+	time.AfterFunc(timeout, qr.Close)
+
+	for _, to := range recipients {
+		t.net.send(t, to, func(recipient *memoryTransport) {
+			var once sync.Once
+			recipient.push(&Query{
+				Name:    name,
+				Payload: append([]byte(nil), payload...),
+				LTime:   ltime,
+				respond: func(b []byte) error {
+					once.Do(func() {
+						rsp := NodeResponse{From: recipient.name, Payload: append([]byte(nil), b...)}
+						t.net.send(recipient, t.name, func(*memoryTransport) {
+							qr.add(rsp)
+						})
+					})
+					return nil
+				},
+			})
+		})
+	}
+	return qr, nil
+}
+
+func (t *memoryTransport) Broadcast(name string, payload []byte) error {
+	if t.stopped() {
+		return ErrTransportShutdown
+	}
+
+	if _, limit := t.net.sizeLimits(); limit > 0 && len(name)+len(payload) > limit {
+		return fmt.Errorf("user event exceeds limit of %d bytes", limit)
+	}
+
+	ltime := t.net.tick()
+	for _, to := range t.net.recipients() {
+		t.net.send(t, to, func(recipient *memoryTransport) {
+			recipient.push(UserEvent{
+				Name:    name,
+				Payload: append([]byte(nil), payload...),
+				LTime:   ltime,
+			})
+		})
+	}
+	return nil
+}
+
+func (t *memoryTransport) Events() <-chan Event {
+	return t.events
+}
+
+func (t *memoryTransport) ShutdownCh() <-chan struct{} {
+	return t.shutdownCh
+}
+
+// memoryQueryResponse collects the responses to a query on a MemoryNetwork.
+type memoryQueryResponse struct {
+	mu     sync.Mutex
+	ch     chan NodeResponse
+	closed bool
+}
+
+func (r *memoryQueryResponse) add(rsp NodeResponse) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.closed {
+		return
+	}
+	select {
+	case r.ch <- rsp:
+	default:
+	}
+}
+
+func (r *memoryQueryResponse) ResponseCh() <-chan NodeResponse {
+	return r.ch
+}
+
+func (r *memoryQueryResponse) Finished() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.closed
+}
+
+func (r *memoryQueryResponse) Close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.closed {
+		r.closed = true
+		close(r.ch)
+	}
+}
@@ -0,0 +1,119 @@
+package polity
+
+import (
+	"time"
+
+	"github.com/shipwire/ansqd/internal/metrics"
+)
+
+// polityMetrics instruments a polity. Its registry is exposed through
+// Polity.Metrics.
+type polityMetrics struct {
+	registry *metrics.Registry
+
+	electionsStarted   *metrics.Counter
+	elections          *metrics.Counter
+	recalls            *metrics.Counter
+	confirmationRounds *metrics.Counter
+	queryDuration      *metrics.Histogram
+	parseErrors        *metrics.Counter
+}
+
+func newPolityMetrics(p *Polity) *polityMetrics {
+	r := metrics.NewRegistry()
+	m := &polityMetrics{
+		registry: r,
+
+		electionsStarted: r.NewCounter("polity_elections_started_total",
+			"Elections run by this node."),
+		elections: r.NewCounter("polity_elections_total",
+			"Elections run by this node that have finished, by outcome (won, lost or failed).", "outcome"),
+		recalls: r.NewCounter("polity_recalls_total",
+			"Recalls run by this node that have finished, by outcome (succeeded or failed).", "outcome"),
+		confirmationRounds: r.NewCounter("polity_confirmation_rounds_total",
+			"Rounds of confirmation queries sent by this node, by what was confirmed (election or recall).", "kind"),
+		queryDuration: r.NewHistogram("polity_query_duration_seconds",
+			"Time taken to query the cluster for roles, by kind (role or prefix) and outcome (found, no_quorum or failed).",
+			metrics.DefaultBuckets, "kind", "outcome"),
+		parseErrors: r.NewCounter("polity_parse_errors_total",
+			"Messages from peers that could not be parsed, by message.", "message"),
+	}
+	r.NewGaugeFunc("polity_roles", "Roles in the local role table, by status.", "status", p.countRoles)
+	if at, ok := p.t.(*authTransport); ok {
+		r.NewCounterFunc("polity_auth_rejections_total",
+			"Messages dropped because they could not be verified, by kind (query, response or event).", "message", at.rejectionCounts)
+	}
+	return m
+}
+
+// Metrics returns the registry the polity records its metrics in.
+func (p *Polity) Metrics() *metrics.Registry {
+	return p.metrics.registry
+}
+
+// countRoles counts the entries in the local role table by status.
+func (p *Polity) countRoles() map[string]float64 {
+	p.voteMutex.Lock()
+	defer p.voteMutex.Unlock()
+
+	counts := map[string]float64{}
+	for _, s := range []status{running, confirmed, impeached, recalled} {
+		counts[s.String()] = 0
+	}
+	for _, r := range p.roles {
+		counts[r.status.String()]++
+	}
+	return counts
+}
+
+// electionResult records the outcome of an election run by this node.
+func (m *polityMetrics) electionResult(err error) {
+	switch err {
+	case nil:
+		m.elections.Inc("won")
+	case ErrLostElection:
+		m.elections.Inc("lost")
+	default:
+		m.elections.Inc("failed")
+	}
+}
+
+// recallResult records the outcome of a recall run by this node.
+func (m *polityMetrics) recallResult(err error) {
+	if err == nil {
+		m.recalls.Inc("succeeded")
+	} else {
+		m.recalls.Inc("failed")
+	}
+}
+
+// confirmationKind names what a confirmation query confirms.
+func confirmationKind(query string) string {
+	if query == recallConfirm {
+		return "recall"
+	}
+	return "election"
+}
+
+// confirmationResult records the outcome of an election or recall that reached
+// confirmation.
+func (m *polityMetrics) confirmationResult(query string, err error) {
+	if query == recallConfirm {
+		m.recallResult(err)
+	} else {
+		m.electionResult(err)
+	}
+}
+
+// queryResult records how long a query took and how it turned out.
+func (m *polityMetrics) queryResult(kind string, start time.Time, err error) {
+	outcome := "found"
+	switch err {
+	case nil:
+	case ErrLostElection:
+		outcome = "no_quorum"
+	default:
+		outcome = "failed"
+	}
+	m.queryDuration.Observe(time.Since(start).Seconds(), kind, outcome)
+}
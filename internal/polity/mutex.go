@@ -0,0 +1,205 @@
+package polity
+
+import (
+	"context"
+	"math/rand"
+	"sort"
+	"time"
+)
+
+const (
+	mutexMinBackoff = 100 * time.Millisecond
+	mutexMaxBackoff = 10 * time.Second
+)
+
+// Mutex is a cluster-wide lock. It is held by the node that wins the election for
+// its roles and released by recalling them.
+type Mutex struct {
+	p     *Polity
+	roles []string
+
+	// local holds the polity's local lock on each of the roles, in order, which
+	// serializes holders on the local node: they would otherwise all win the
+	// same election.
+	local []chan struct{}
+}
+
+// NewMutex creates a lock over roles, which are acquired and released together.
+func (p *Polity) NewMutex(roles ...string) *Mutex {
+	return &Mutex{
+		p:     p,
+		roles: roles,
+		local: p.localLocks(roles),
+	}
+}
+
+// localLocks returns the local lock on each of roles, creating those that do
+// not yet exist. They are ordered by role so that mutexes over overlapping roles
+// take them in the same order.
+func (p *Polity) localLocks(roles []string) []chan struct{} {
+	sorted := append([]string(nil), roles...)
+	sort.Strings(sorted)
+
+	p.locksMutex.Lock()
+	defer p.locksMutex.Unlock()
+
+	locks := []chan struct{}{}
+	for i, role := range sorted {
+		if i > 0 && role == sorted[i-1] {
+			continue
+		}
+		l, ok := p.locks[role]
+		if !ok {
+			l = make(chan struct{}, 1)
+			p.locks[role] = l
+		}
+		locks = append(locks, l)
+	}
+	return locks
+}
+
+// lockLocal takes the local locks on m's roles, waiting for them if ctx is not
+// nil and giving up with ErrLostElection otherwise.
+func (m *Mutex) lockLocal(ctx context.Context) error {
+	for i, l := range m.local {
+		if ctx == nil {
+			select {
+			case l <- struct{}{}:
+				continue
+			default:
+				m.unlockLocal(m.local[:i])
+				return ErrLostElection
+			}
+		}
+
+		select {
+		case l <- struct{}{}:
+		case <-ctx.Done():
+			m.unlockLocal(m.local[:i])
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// unlockLocal releases local locks taken by lockLocal.
+func (m *Mutex) unlockLocal(locks []chan struct{}) {
+	for _, l := range locks {
+		<-l
+	}
+}
+
+// TryLock makes a single attempt to acquire m. It returns ErrLostElection if m
+// is held, locally or elsewhere in the cluster.
+func (m *Mutex) TryLock() error {
+	err := m.lockLocal(nil)
+	if err != nil {
+		return err
+	}
+
+	err = <-m.p.RunElection(m.roles...)
+	if err != nil {
+		m.unlockLocal(m.local)
+	}
+	return err
+}
+
+// Lock acquires m, waiting until it is released if it is held. Between attempts
+// it watches the role for release and otherwise backs off exponentially. It
+// returns early with the context's error if ctx is done, abandoning any
+// election it is running.
+func (m *Mutex) Lock(ctx context.Context) error {
+	err := m.lockLocal(ctx)
+	if err != nil {
+		return err
+	}
+
+	backoff := mutexMinBackoff
+	for {
+		before := m.lookup()
+
+		err = (<-m.p.elect(ctx.Done(), m.roles...)).Err
+		if err == nil {
+			return nil
+		}
+		if err == ErrAborted {
+			err = ctx.Err()
+		}
+		if err != ErrLostElection {
+			m.unlockLocal(m.local)
+			return err
+		}
+
+		err = m.waitRelease(ctx, before, backoff)
+		if err != nil {
+			m.unlockLocal(m.local)
+			return err
+		}
+
+		backoff *= 2
+		if backoff > mutexMaxBackoff {
+			backoff = mutexMaxBackoff
+		}
+	}
+}
+
+// waitRelease waits until a node that held one of m's roles, as of before, is
+// seen to give it up, or until a jittered backoff elapses.
+func (m *Mutex) waitRelease(ctx context.Context, before map[string]role, backoff time.Duration) error {
+	timer := time.NewTimer(backoff/2 + time.Duration(rand.Int63n(int64(backoff/2))))
+	defer timer.Stop()
+
+	local := m.p.t.LocalName()
+	for {
+		changed, err := m.waitChange(ctx, timer.C)
+		if !changed {
+			return err
+		}
+
+		after := m.lookup()
+		for name, r := range before {
+			if r.node != local && !r.status.vacant() && after[name].status.vacant() {
+				return nil
+			}
+		}
+		before = after
+	}
+}
+
+// waitChange waits until the local node's view of any of m's roles changes,
+// reporting whether it did, or until expired fires or ctx is done.
+func (m *Mutex) waitChange(ctx context.Context, expired <-chan time.Time) (bool, error) {
+	changed := m.p.Watch(m.roles...)
+	// a change to one role leaves the watch on the others in place
+	defer m.p.unwatch(changed, m.roles...)
+
+	select {
+	case <-ctx.Done():
+		return false, ctx.Err()
+	case <-expired:
+		return false, nil
+	case <-changed:
+		return true, nil
+	}
+}
+
+// lookup returns the local node's view of m's roles.
+func (m *Mutex) lookup() map[string]role {
+	roles := make(map[string]role, len(m.roles))
+	for _, name := range m.roles {
+		roles[name], _ = m.p.lookup(name)
+	}
+	return roles
+}
+
+// Unlock releases m by recalling its roles.
+func (m *Mutex) Unlock() error {
+	return m.unlock(nil)
+}
+
+// unlock releases m as Unlock does, giving up with ErrAborted once abort is
+// closed. Either way the local node no longer holds m.
+func (m *Mutex) unlock(abort <-chan struct{}) error {
+	defer m.unlockLocal(m.local)
+	return (<-m.p.recall(abort, m.roles...)).Err
+}
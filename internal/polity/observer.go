@@ -0,0 +1,89 @@
+package polity
+
+import "sort"
+
+// ObserverTag marks a member as an observer when set to "true". Observers track
+// roles and may query and watch them, but they do not vote, do not run for
+// roles and are not counted towards quorum.
+const ObserverTag = "polity-observer"
+
+// IsObserver tests whether m is an observer.
+func IsObserver(m Member) bool {
+	return m.Tags[ObserverTag] == "true"
+}
+
+// population counts the members that vote: those that have not left and are not
+// observers.
+func (p *Polity) population() int {
+	return len(p.electorate())
+}
+
+// Quorum reports how many voters the local node knows of, failed ones included,
+// and how many votes an election would need from them.
+func (p *Polity) Quorum() (voters, required int) {
+	voters = p.population()
+	return voters, p.electionQuorum(voters)
+}
+
+// electionQuorum is the number of votes an election needs from population
+// voters. However few voters there are, an election needs as many votes as it
+// would from three.
+func (p *Polity) electionQuorum(population int) int {
+	required := p.QuorumFunc(3)
+	if n := p.QuorumFunc(population); n > required {
+		required = n
+	}
+	return required
+}
+
+// Observer tests whether the local node is an observer.
+func (p *Polity) Observer() bool {
+	for _, m := range p.t.Members() {
+		if m.Name == p.name {
+			return IsObserver(m)
+		}
+	}
+	return false
+}
+
+// observe prepares a query for handling by an observer. Queries that ask for a
+// vote or an answer are ignored, and reported as such. Confirmations and writes
+// are still applied so that the observer's view of roles stays current, but are
+// not acknowledged, since only voters' acknowledgements count.
+func (p *Polity) observe(q *Query) (handle bool) {
+	switch q.Name {
+	case electionBegin, recallBegin, query, queryPrefix:
+		return false
+	case syncQuery:
+		return true
+	}
+	q.respond = func([]byte) error { return nil }
+	return true
+}
+
+// electorate is the set of members entitled to vote in an election, keyed by
+// name.
+type electorate map[string]bool
+
+// electorate snapshots the members that vote. Failed members are counted:
+// during a partition each side sees the other as failed, and counting only the
+// live members would let both sides reach a quorum.
+func (p *Polity) electorate() electorate {
+	voters := make(electorate)
+	for _, m := range p.t.Members() {
+		if !IsObserver(m) {
+			voters[m.Name] = true
+		}
+	}
+	return voters
+}
+
+// names lists the voters in order.
+func (e electorate) names() []string {
+	names := make([]string, 0, len(e))
+	for name := range e {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
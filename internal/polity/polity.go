@@ -6,27 +6,56 @@ gossip-based network (serf).
 With a polity, you can run elections to elect the current node into a unique
 role. The election will broadcast to all peers that it would like to assume a role.
 If the remote node sees that role as unfilled, it will vote for the candidate and fill
-the role, otherwise it will vote no.
+the role, otherwise it will vote no. An election may be run for several roles at
+once, in which case they are won or lost together, as long as their names fit in
+MaxRolesSize; SplitRoles divides larger sets into batches.
 
-By default, the quorum required is (n/2)+1 where n is the maximum population known of all nodes
-that voted. (This is configurable by providing a different QuorumFunc to a Polity.)
+By default, the quorum required is (n/2)+1 where n is the number of voters the
+candidate knows of when the election begins, failed ones included. (This is configurable by providing a different
+QuorumFunc to a Polity.) Elect and Recall report this electorate along with the votes cast.
 
 A node will hold a position until it is recalled. Nodes will always vote yes to a recall,
-but a quorum must still reply for the recall to succeed.
+but a quorum must still reply for the recall to succeed. A candidate that loses an
+election withdraws the votes cast for it so that the role may be contested again.
+
+The holder of a role may attach a small value to it with SetValue. Writes are
+versioned and must be accepted by a quorum; any node can read the value back with
+QueryRoleInfo. A value stays with the role as it passes from holder to holder.
+
+Role names may be hierarchical, with parts joined by RoleSeparator (see RoleName).
+QueryPrefix lists the holders of every role within a namespace in one query.
+
+Elections, recalls and queries carry a trace context to the peers that take part in
+them. Set Exporter to receive the resulting spans from both sides.
+
+Wrapping a transport with Authenticate signs every message with a shared HMAC key or
+a per-node ed25519 key, and drops any message that cannot be verified.
+
+Members tagged with ObserverTag are observers. They follow the role table and may
+query and watch roles, but they never vote and are not counted towards quorum.
+
+Whenever a member joins, nodes exchange their role tables with their peers so that
+a late joiner learns of roles that are already held before it is asked to vote.
+
+A polity communicates over a Transport. SerfTransport and AgentTransport carry its
+messages over serf, while a MemoryNetwork connects polities in memory for testing.
 
 */
 package polity
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
 	"fmt"
-	"log"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/hashicorp/serf/command/agent"
 	"github.com/hashicorp/serf/serf"
+	"github.com/shipwire/ansqd/internal/logging"
 )
 
 const (
@@ -39,178 +68,328 @@ const (
 
 	updateTime = "polity.updateTime"
 
-	query = "polity.query"
+	syncQuery = "polity.sync"
+
+	query       = "polity.query"
+	queryPrefix = "polity.query.prefix"
+
+	valueWrite = "polity.value.write"
 
 	yes = "YES"
 	no  = "NO"
 )
 
+// MaxRolesSize is the combined length of the role names, each counted with a
+// separator, that a single election or recall may carry. Its requests travel in
+// queries and events along with a trace context and a signature, and must fit
+// within serf's default size limits of 1024 bytes for a query and 512 for an
+// event, which leaves room for node names of up to about 50 bytes. Larger sets
+// of roles can be claimed in batches made by SplitRoles.
+const MaxRolesSize = 256
+
 // Errors
 var (
-	ErrAborted      = errors.New("election aborted")
-	ErrLostElection = errors.New("lost election")
-	ErrRoleUnfilled = errors.New("cannot recall unfilled role")
+	ErrAborted       = errors.New("election aborted")
+	ErrLostElection  = errors.New("lost election")
+	ErrRoleUnfilled  = errors.New("cannot recall unfilled role")
+	ErrResignTimeout = errors.New("timed out resigning roles")
+	ErrNotHolder     = errors.New("role is not held by this node")
+	ErrValueTooLarge = errors.New("role value too large")
+	ErrWriteFailed   = errors.New("value write not confirmed by quorum")
+	ErrNoRoles       = errors.New("no roles given")
+	ErrObserver      = errors.New("observers cannot run for roles")
+	ErrTooManyRoles  = errors.New("roles too large for a single election")
 )
 
 // Polity represents a distributed cluster capable of electing nodes for particular roles.
 type Polity struct {
 	name              string
-	s                 *serf.Serf
-	eventCh           <-chan serf.Event
+	t                 Transport
 	abortConfirmation <-chan struct{}
 	roles             map[string]role
+	watchers          map[string][]chan struct{}
+	locks             map[string]chan struct{}
+	locksMutex        sync.Mutex
+	store             *store
 	voteMutex         *sync.Mutex
-	Log               *log.Logger
-	QuorumFunc        QuorumFunc
+	syncCh            chan struct{}
+	metrics           *polityMetrics
+
+	// Log, if set, receives this node's log lines. Routine traffic such as
+	// votes is logged at debug level.
+	Log        *logging.Logger
+	QuorumFunc QuorumFunc
+
+	// Exporter, if set, receives a span for every election, recall and query
+	// this node runs or takes part in.
+	Exporter SpanExporter
+
+	// OnEvent, if set, receives the events broadcast over the polity's
+	// transport that the polity does not handle itself.
+	OnEvent func(UserEvent)
 }
 
-// Create initializes a polity based on a serf instance and event channel.
-func Create(s *serf.Serf, eventCh <-chan serf.Event) *Polity {
+// New initializes a polity that communicates over t. If stateDir is not empty,
+// the role table is persisted there and reloaded from any previous run.
+func New(t Transport, stateDir string) (*Polity, error) {
+	st, err := openStore(stateDir)
+	if err != nil {
+		return nil, err
+	}
+	roles, err := st.load()
+	if err != nil {
+		return nil, err
+	}
+
 	p := &Polity{
-		s:                 s,
-		eventCh:           eventCh,
-		roles:             make(map[string]role),
+		name:              t.LocalName(),
+		t:                 t,
+		roles:             roles,
+		watchers:          make(map[string][]chan struct{}),
+		locks:             make(map[string]chan struct{}),
+		store:             st,
 		voteMutex:         &sync.Mutex{},
 		abortConfirmation: make(chan struct{}),
+		syncCh:            make(chan struct{}, 1),
 		QuorumFunc:        SimpleMajority,
 	}
+	p.metrics = newPolityMetrics(p)
 
 	go p.voteLoop()
-	return p
+	go p.syncLoop()
+	return p, nil
 }
 
-// CreateWithAgent initializes a polity based on a serf.Agent. The polity
-// will register a handler to receive events.
-func CreateWithAgent(a *agent.Agent) *Polity {
-	eventCh := make(chan serf.Event, 10)
-	p := &Polity{
-		s:                 a.Serf(),
-		eventCh:           eventCh,
-		roles:             make(map[string]role),
-		voteMutex:         &sync.Mutex{},
-		abortConfirmation: make(chan struct{}),
-		QuorumFunc:        SimpleMajority,
-	}
+// Create initializes a polity based on a serf instance and event channel. If
+// stateDir is not empty, the role table is persisted there and reloaded from
+// any previous run.
+func Create(s *serf.Serf, eventCh <-chan serf.Event, stateDir string) (*Polity, error) {
+	return New(SerfTransport(s, eventCh), stateDir)
+}
 
-	a.RegisterEventHandler(p.agentHandler(eventCh))
+// CreateWithAgent initializes a polity based on a serf.Agent. The polity
+// will register a handler to receive events. If stateDir is not empty, the
+// role table is persisted there and reloaded from any previous run.
+func CreateWithAgent(a *agent.Agent, stateDir string) (*Polity, error) {
+	return New(AgentTransport(a), stateDir)
+}
 
-	go p.voteLoop()
-	return p
+// Serf returns the polity's underlying serf instance, or nil if the polity's
+// transport is not serf.
+func (p *Polity) Serf() *serf.Serf {
+	t := p.t
+	if at, ok := t.(*authTransport); ok {
+		t = at.Transport
+	}
+	if st, ok := t.(*serfTransport); ok {
+		return st.s
+	}
+	return nil
 }
 
-func (p *Polity) agentHandler(eventCh chan<- serf.Event) agent.EventHandler {
-	return eventHandler{eventCh}
+// Transport returns the transport the polity communicates over.
+func (p *Polity) Transport() Transport {
+	return p.t
 }
 
-type eventHandler struct {
-	c chan<- serf.Event
+// Result describes the outcome of an election or recall.
+type Result struct {
+	// Err is nil if the election was won or the recall succeeded.
+	Err error
+
+	// Electorate lists the voters: the members, failed or not, that had not
+	// left and were not observers when the vote began. Responses from anyone
+	// else are ignored.
+	Electorate []string
+
+	// YesVotes is the number of voters that voted yes, and VotesRequired the
+	// number needed to win. VotesRequired is fixed when the vote begins, so
+	// members joining or failing during the vote do not change it.
+	YesVotes      int
+	VotesRequired int
 }
 
-func (e eventHandler) HandleEvent(s serf.Event) {
-	e.c <- s
+// RunElection initiates an election for roles with the local node as the
+// candidate. The roles are won or lost together: nodes vote for the candidate
+// only if every role is vacant, and confirmation fills all of them at once.
+func (p *Polity) RunElection(roles ...string) <-chan error {
+	return resultErr(p.Elect(roles...))
 }
 
-// Serf returns the polity's underlying serf instance.
-func (p *Polity) Serf() *serf.Serf {
-	return p.s
+// Elect runs an election as RunElection does, reporting the electorate and the
+// votes it cast.
+func (p *Polity) Elect(roles ...string) <-chan Result {
+	return p.elect(nil, roles...)
 }
 
-// RunElection initiates an election for role with the local node as the candidate.
-func (p *Polity) RunElection(role string) <-chan error {
-	votesRequired := p.QuorumFunc(3)
-	yesVotes := 0
+// elect runs an election, giving up on confirmation with ErrAborted once abort
+// is closed.
+func (p *Polity) elect(abort <-chan struct{}, roles ...string) <-chan Result {
+	if len(roles) == 0 {
+		return resultChan(Result{Err: ErrNoRoles})
+	}
+	if rolesSize(roles) > MaxRolesSize {
+		return resultChan(Result{Err: ErrTooManyRoles})
+	}
+	if p.Observer() {
+		return resultChan(Result{Err: ErrObserver})
+	}
 
-	p.logf("%s running for role %s", p.name, role)
+	voters := p.electorate()
+	result := Result{
+		Electorate:    voters.names(),
+		VotesRequired: p.electionQuorum(len(voters)),
+	}
 
-	request := fmt.Sprintf("%s %s", p.Serf().LocalMember().Name, role)
-	qr, err := p.s.Query(electionBegin, []byte(request), &serf.QueryParam{Timeout: 5 * time.Second})
+	election := newElectionID()
+	l := p.logger().With(logging.RoleKey, strings.Join(roles, " "), logging.ElectionKey, election)
+	l.Info("running for election", "electorate", strings.Join(result.Electorate, " "))
+	p.metrics.electionsStarted.Inc()
+
+	span := p.startSpan("polity.election", spanContext{})
+	span.set("roles", strings.Join(roles, " "))
+	span.set("electorate", strings.Join(voters.names(), " "))
+	round := span.child("polity.election.begin")
+
+	request := fmt.Sprintf("%s %s %s", p.t.LocalName(), election, strings.Join(roles, " "))
+	qr, err := p.t.Query(electionBegin, withTrace(round.context(), []byte(request)), 5*time.Second)
 	if err != nil {
-		return errChan(err)
+		p.metrics.electionResult(err)
+		round.finish(err)
+		span.finish(err)
+		result.Err = err
+		return resultChan(result)
 	}
 
+	voted := make(map[string]bool)
 	for rsp := range qr.ResponseCh() {
 		var vote, node string
-		population := p.s.Memberlist().NumMembers()
 
 		_, err := fmt.Sscanln(string(rsp.Payload), &vote, &node)
 		if err != nil {
-			p.logf("%s: error parsing response: %s: %s", p.name, err, strconv.Quote(string(rsp.Payload)))
+			l.Warn("error parsing vote", "from", rsp.From, logging.ErrorKey, err, "payload", strconv.Quote(string(rsp.Payload)))
+			p.metrics.parseErrors.Inc("vote")
 			continue
 		}
 
-		p.logf("%s: got %s vote from %s on election", p.name, vote, rsp.From)
+		l.Debug("received vote", "from", rsp.From, "vote", vote)
+		round.event("response", "from", rsp.From, "vote", vote)
 
-		if newVotesRequired := p.QuorumFunc(population); newVotesRequired > votesRequired {
-			votesRequired = newVotesRequired
+		if voted[rsp.From] || !voters[rsp.From] {
+			continue
 		}
+		voted[rsp.From] = true
 
 		if vote == yes {
-			yesVotes++
+			result.YesVotes++
 		}
 
-		if yesVotes >= votesRequired {
+		if result.YesVotes >= result.VotesRequired {
 			qr.Close()
 		}
 	}
 
-	p.logf("Received %d votes. %d required", yesVotes, votesRequired)
+	l.Info("counted votes", "yes", result.YesVotes, "required", result.VotesRequired, "electorate", strings.Join(result.Electorate, " "))
+	round.finish(nil)
 
-	if yesVotes < votesRequired {
-		return errChan(ErrLostElection)
+	if result.YesVotes < result.VotesRequired {
+		err := p.t.Broadcast(electionFailed, []byte(request))
+		if err != nil {
+			l.Warn("error withdrawing from election", logging.ErrorKey, err)
+		}
+		p.metrics.electionResult(ErrLostElection)
+		span.finish(ErrLostElection)
+		result.Err = ErrLostElection
+		return resultChan(result)
 	}
-	return p.runConfirmation(electionConfirm, request, role, votesRequired)
+	return p.runConfirmation(electionConfirm, request, roles, result, voters, span, abort)
 }
 
-func (p *Polity) runConfirmation(query, request, role string, votesRequired int) <-chan error {
-	ch := make(chan error, 1)
+// runConfirmation sends rounds of confirmation queries until a quorum of voters
+// has confirmed, or until abort is closed. Each round is recorded as a child of
+// span, which is finished with the result.
+func (p *Polity) runConfirmation(query, request string, roles []string, result Result, voters electorate, span *activeSpan, abort <-chan struct{}) <-chan Result {
+	ch := make(chan Result, 1)
+	finish := func(err error) {
+		p.metrics.confirmationResult(query, err)
+		span.finish(err)
+		result.Err = err
+		ch <- result
+		close(ch)
+	}
+
 	go func() {
 		for {
 		doConfirmation:
-			confirmations := 0
+			confirmed := make(map[string]bool)
+			p.metrics.confirmationRounds.Inc(confirmationKind(query))
+			round := span.child(query)
 
-			qr, err := p.s.Query(query, []byte(request), &serf.QueryParam{Timeout: 15 * time.Second})
+			qr, err := p.t.Query(query, withTrace(round.context(), []byte(request)), 15*time.Second)
 			if err != nil {
-				ch <- err
-				close(ch)
+				round.finish(err)
+				finish(err)
 				return
 			}
 
 			for {
 				select {
 				case <-p.abortConfirmation:
-					ch <- ErrAborted
-					close(ch)
+					qr.Close()
+					round.finish(ErrAborted)
+					finish(ErrAborted)
+					return
+				case <-abort:
+					qr.Close()
+					round.finish(ErrAborted)
+					finish(ErrAborted)
 					return
-				case rsp := <-qr.ResponseCh():
-					if rsp.From != "" {
-						confirmations++
-						p.logf("%s: %s confirmed %s", p.name, rsp.From, query)
+				case rsp, ok := <-qr.ResponseCh():
+					if !ok {
+						if len(confirmed) >= result.VotesRequired {
+							goto finishConfirmation
+						}
+						round.finish(nil)
+						goto doConfirmation
 					}
 
-					if qr.Finished() && confirmations >= votesRequired {
+					if rsp.From != "" && voters[rsp.From] {
+						confirmed[rsp.From] = true
+						p.logger().Debug("received confirmation", logging.RoleKey, strings.Join(roles, " "), "query", query, "from", rsp.From)
+						round.event("response", "from", rsp.From)
+					}
+
+					if qr.Finished() && len(confirmed) >= result.VotesRequired {
 						goto finishConfirmation
 					}
 
-					if confirmations >= p.s.Memberlist().NumMembers() {
+					if len(confirmed) >= len(voters) {
 						qr.Close()
 						goto finishConfirmation
 					}
 
 				case <-time.After(50 * time.Millisecond):
-					if confirmations >= p.s.Memberlist().NumMembers() {
+					if len(confirmed) >= len(voters) {
 						qr.Close()
 						goto finishConfirmation
 					}
-					if qr.Finished() && confirmations >= votesRequired {
+					if qr.Finished() && len(confirmed) >= result.VotesRequired {
 						goto finishConfirmation
 					} else if qr.Finished() {
+						round.finish(nil)
 						goto doConfirmation
 					}
 				}
 			}
 		finishConfirmation:
-			ch <- p.updateRole(role)
-			close(ch)
+			round.finish(nil)
+			err = nil
+			for _, role := range roles {
+				if updateErr := p.updateRole(role); updateErr != nil && err == nil {
+					err = updateErr
+				}
+			}
+			finish(err)
 			return
 		}
 	}()
@@ -218,125 +397,305 @@ func (p *Polity) runConfirmation(query, request, role string, votesRequired int)
 	return ch
 }
 
-func errChan(err error) <-chan error {
-	ch := make(chan error, 1)
-	ch <- err
+// newElectionID identifies an election so that votes cast in it can be withdrawn
+// if it is lost.
+// rolesSize is the space roles take in an election or recall request.
+func rolesSize(roles []string) int {
+	size := 0
+	for _, r := range roles {
+		size += len(r) + 1
+	}
+	return size
+}
+
+// SplitRoles divides roles, in order, into batches that each fit in a single
+// election or recall. A role too large to fit on its own is given a batch of
+// its own, which fails with ErrTooManyRoles.
+func SplitRoles(roles []string) [][]string {
+	batches := [][]string{}
+	var batch []string
+	size := 0
+	for _, r := range roles {
+		if len(batch) > 0 && size+len(r)+1 > MaxRolesSize {
+			batches = append(batches, batch)
+			batch, size = nil, 0
+		}
+		batch = append(batch, r)
+		size += len(r) + 1
+	}
+	if len(batch) > 0 {
+		batches = append(batches, batch)
+	}
+	return batches
+}
+
+func newElectionID() string {
+	b := make([]byte, 8)
+	_, err := rand.Read(b)
+	if err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
+
+func resultChan(r Result) <-chan Result {
+	ch := make(chan Result, 1)
+	ch <- r
 	close(ch)
 	return ch
 }
 
-// RunRecallElection starts a vote to empty a role.
-func (p *Polity) RunRecallElection(role string) <-chan error {
-	votesRequired := 3
-	yesVotes := 0
+// resultErr relays the error of a result.
+func resultErr(results <-chan Result) <-chan error {
+	ch := make(chan error, 1)
+	go func() {
+		ch <- (<-results).Err
+		close(ch)
+	}()
+	return ch
+}
+
+// RunRecallElection starts a vote to empty roles. The roles are recalled
+// together.
+func (p *Polity) RunRecallElection(roles ...string) <-chan error {
+	return resultErr(p.Recall(roles...))
+}
+
+// Recall runs a recall as RunRecallElection does, reporting the electorate and
+// the votes it cast.
+func (p *Polity) Recall(roles ...string) <-chan Result {
+	return p.recall(nil, roles...)
+}
 
-	qr, err := p.s.Query(recallBegin, []byte(role), &serf.QueryParam{Timeout: 5 * time.Second})
+// recall runs a recall, giving up with ErrAborted once abort is closed.
+func (p *Polity) recall(abort <-chan struct{}, roles ...string) <-chan Result {
+	if len(roles) == 0 {
+		return resultChan(Result{Err: ErrNoRoles})
+	}
+	if rolesSize(roles) > MaxRolesSize {
+		return resultChan(Result{Err: ErrTooManyRoles})
+	}
+
+	voters := p.electorate()
+	result := Result{
+		Electorate:    voters.names(),
+		VotesRequired: 3,
+	}
+	if n := p.QuorumFunc(len(voters)); n > result.VotesRequired {
+		result.VotesRequired = n
+	}
+
+	l := p.logger().With(logging.RoleKey, strings.Join(roles, " "))
+	l.Info("running recall", "electorate", strings.Join(result.Electorate, " "))
+
+	span := p.startSpan("polity.recall", spanContext{})
+	span.set("roles", strings.Join(roles, " "))
+	span.set("electorate", strings.Join(voters.names(), " "))
+	round := span.child("polity.recall.begin")
+
+	request := strings.Join(roles, " ")
+	qr, err := p.t.Query(recallBegin, withTrace(round.context(), []byte(request)), 5*time.Second)
 	if err != nil {
-		return errChan(err)
+		p.metrics.recallResult(err)
+		round.finish(err)
+		span.finish(err)
+		result.Err = err
+		return resultChan(result)
 	}
 
-	for rsp := range qr.ResponseCh() {
+	voted := make(map[string]bool)
+	for {
+		var rsp NodeResponse
+		var ok bool
+		select {
+		case <-abort:
+			qr.Close()
+			p.metrics.recallResult(ErrAborted)
+			round.finish(ErrAborted)
+			span.finish(ErrAborted)
+			result.Err = ErrAborted
+			return resultChan(result)
+		case rsp, ok = <-qr.ResponseCh():
+		}
+		if !ok {
+			break
+		}
+
 		var vote, node string
-		population := p.s.Memberlist().NumMembers()
 
 		_, err := fmt.Sscanln(string(rsp.Payload), &vote, &node)
 		if err != nil {
-			p.logf("recall: %s: error parsing response: %s: %s", p.name, err, strconv.Quote(string(rsp.Payload)))
+			l.Warn("error parsing recall vote", "from", rsp.From, logging.ErrorKey, err, "payload", strconv.Quote(string(rsp.Payload)))
+			p.metrics.parseErrors.Inc("recall")
 			continue
 		}
 
-		if newVotesRequired := p.QuorumFunc(population); newVotesRequired > votesRequired {
-			votesRequired = newVotesRequired
+		round.event("response", "from", rsp.From, "vote", vote)
+
+		if voted[rsp.From] || !voters[rsp.From] {
+			continue
 		}
+		voted[rsp.From] = true
 
 		if vote == yes {
-			yesVotes++
+			result.YesVotes++
 		}
 
-		if yesVotes >= votesRequired {
+		if result.YesVotes >= result.VotesRequired {
 			qr.Close()
 		}
 	}
 
-	p.logf("Received %d votes. %d required for recall", yesVotes, votesRequired)
+	l.Info("counted recall votes", "yes", result.YesVotes, "required", result.VotesRequired, "electorate", strings.Join(result.Electorate, " "))
+	round.finish(nil)
 
-	if yesVotes < votesRequired {
-		return errChan(ErrLostElection)
+	if result.YesVotes < result.VotesRequired {
+		p.metrics.recallResult(ErrLostElection)
+		span.finish(ErrLostElection)
+		result.Err = ErrLostElection
+		return resultChan(result)
 	}
 
-	return p.runConfirmation(recallConfirm, role, role, votesRequired)
+	return p.runConfirmation(recallConfirm, request, roles, result, voters, span, abort)
+}
+
+// ResignAll runs recall elections for every role held by the local node so that
+// other candidates may assume them. It waits at most timeout for the recalls to
+// complete, returning ErrResignTimeout and abandoning them if they do not.
+func (p *Polity) ResignAll(timeout time.Duration) error {
+	held := p.heldRoles()
+	if len(held) == 0 {
+		return nil
+	}
+
+	p.logger().Info("resigning", logging.RoleKey, strings.Join(held, " "))
+
+	abort := make(chan struct{})
+	defer close(abort)
+
+	errs := make(chan error, len(held))
+	for _, r := range held {
+		go func(r string) {
+			errs <- (<-p.recall(abort, r)).Err
+		}(r)
+	}
+
+	deadline := time.After(timeout)
+	var firstErr error
+	for range held {
+		select {
+		case err := <-errs:
+			if err != nil && firstErr == nil {
+				firstErr = err
+			}
+		case <-deadline:
+			return ErrResignTimeout
+		}
+	}
+	return firstErr
+}
+
+// heldRoles lists the roles the local node is running for or has been confirmed in.
+func (p *Polity) heldRoles() []string {
+	local := p.t.LocalName()
+
+	p.voteMutex.Lock()
+	defer p.voteMutex.Unlock()
+
+	held := []string{}
+	for name, r := range p.roles {
+		if r.node == local && (r.status == running || r.status == confirmed) {
+			held = append(held, name)
+		}
+	}
+	return held
 }
 
 func (p *Polity) updateRole(roleString string) error {
+	p.voteMutex.Lock()
 	r, ok := p.roles[roleString]
+	p.voteMutex.Unlock()
 	if !ok {
 		return nil
 	}
 
 	payload := fmt.Sprintf("%s %s %d", r.node, roleString, r.status)
-	return p.s.UserEvent(updateTime, []byte(payload), false)
+	return p.t.Broadcast(updateTime, []byte(payload))
 }
 
 func (p *Polity) voteLoop() {
 	for {
 		select {
-		case evt := <-p.eventCh:
+		case evt := <-p.t.Events():
 			go p.handleEvent(evt)
-		case <-p.s.ShutdownCh():
+		case <-p.t.ShutdownCh():
 			return
 		}
 	}
 }
 
-func (p *Polity) handleEvent(e serf.Event) {
+func (p *Polity) handleEvent(e Event) {
 	switch evt := e.(type) {
-	case *serf.Query:
+	case *Query:
+		if p.Observer() && !p.observe(evt) {
+			return
+		}
 		switch evt.Name {
 		case electionBegin:
-			p.vote(evt)
+			p.traced(evt, "polity.vote", p.vote)
 		case recallBegin:
-			p.voteRecall(evt)
+			p.traced(evt, "polity.voteRecall", p.voteRecall)
 		case query:
-			p.query(evt)
+			p.traced(evt, "polity.query", p.query)
 		case electionConfirm:
-			p.confirmElection(evt)
+			p.traced(evt, "polity.confirmElection", p.confirmElection)
 		case recallConfirm:
-			p.confirmRecall(evt)
+			p.traced(evt, "polity.confirmRecall", p.confirmRecall)
+		case syncQuery:
+			p.syncDigest(evt)
+		case valueWrite:
+			p.writeValue(evt)
+		case queryPrefix:
+			p.prefixDigest(evt)
 		}
-	case serf.UserEvent:
+	case MemberJoin:
+		p.requestSync()
+	case UserEvent:
 		switch evt.Name {
 		case updateTime:
 			p.updateTime(evt)
+		case electionFailed:
+			p.withdraw(evt)
+		default:
+			if p.OnEvent != nil {
+				p.OnEvent(evt)
+			}
 		}
 	}
 }
 
-func (p *Polity) updateTime(q serf.UserEvent) {
+func (p *Polity) updateTime(q UserEvent) {
 	var node, r string
 	var status status
 
 	_, err := fmt.Sscanln(string(q.Payload), &node, &r, &status)
 	if err != nil {
-		p.logf("%s: error parsing response: %s: %s", p.name, err, strconv.Quote(string(q.Payload)))
+		p.logger().Warn("error parsing update", logging.ErrorKey, err, "payload", strconv.Quote(string(q.Payload)))
+		p.metrics.parseErrors.Inc("update")
 		return
 	}
 
 	p.voteMutex.Lock()
 	defer p.voteMutex.Unlock()
 
-	if existing, ok := p.roles[r]; ok && existing.node == node && existing.status.confirmed(status) {
-		existing.time = q.LTime
-		existing.status = status
-		p.roles[r] = existing
-	} else if !ok {
-		p.roles[r] = role{node: node, status: status, time: q.LTime}
+	if p.mergeRole(r, role{node: node, status: status, time: q.LTime}) {
+		p.persist([]string{r})
 	}
 }
 
-func (p *Polity) logf(f string, i ...interface{}) {
-	if p.Log != nil {
-		p.Log.Printf(f, i...)
-	}
+// logger returns p.Log with the local node's name added.
+func (p *Polity) logger() *logging.Logger {
+	return p.Log.With(logging.NodeKey, p.name)
 }
 
 func (p *Polity) tags() map[string]string {
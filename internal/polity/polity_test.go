@@ -1,10 +1,19 @@
 package polity
 
 import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
 	"fmt"
 	"io/ioutil"
 	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/bradfitz/iter"
 	"github.com/hashicorp/serf/command/agent"
@@ -43,104 +52,1197 @@ var names = []string{
 }
 
 func TestPolity(t *testing.T) {
-	polities, ag := getAgents(t, 3)
-	joinAgents(t, ag)
+	eachTransport(t, func(t *testing.T, newCluster clusterFunc) {
+		polities := newCluster(t, 3, mesh).polities
 
-	err := <-polities[0].RunElection("leader")
+		err := <-polities[0].RunElection("leader")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		leader, err := polities[1].QueryRole("leader")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if leader != polities[0].name {
+			t.Fatal(polities[0].name, "should be leader. Got", leader)
+		}
+
+		err = <-polities[1].RunRecallElection("leader")
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestChain(t *testing.T) {
+	eachTransport(t, func(t *testing.T, newCluster clusterFunc) {
+		polities := newCluster(t, 7, chain).polities
+
+		err := <-polities[0].RunElection("leader")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = <-polities[1].RunRecallElection("leader")
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestChainSync(t *testing.T) {
+	eachTransport(t, func(t *testing.T, newCluster clusterFunc) {
+		c := newCluster(t, 7, chain)
+		polities := c.polities
+
+		err := <-polities[0].RunElection("leader")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		p := c.add(t, names[7], "", 6)
+
+		waitFor(t, 10*time.Second, func() bool {
+			p.voteMutex.Lock()
+			defer p.voteMutex.Unlock()
+
+			r, ok := p.roles["leader"]
+			return ok && r.node == polities[0].name && r.status == confirmed
+		}, "%s did not learn of leader", p.name)
+
+		err = <-p.RunElection("leader")
+		if err != ErrLostElection {
+			t.Fatal("Election should have been lost, got", err)
+		}
+	})
+}
+
+func TestPolityWithFailures(t *testing.T) {
+	eachTransport(t, func(t *testing.T, newCluster clusterFunc) {
+		c := newCluster(t, 7, mesh)
+		polities := c.polities
+
+		err := <-polities[0].RunElection("leader")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = <-polities[1].RunRecallElection("leader")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		shutdown := rand.Perm(7)[:2]
+		next := shutdown[1]
+		shutdown = shutdown[:1]
+
+		for _, n := range shutdown {
+			c.crash(n)
+			polities[n].logger().Info("shutting down")
+		}
+
+		err = <-polities[next].RunElection("leader")
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestLostElection(t *testing.T) {
+	eachTransport(t, func(t *testing.T, newCluster clusterFunc) {
+		c := newCluster(t, 7, mesh)
+		polities := c.polities
+
+		err := <-polities[0].RunElection("leader")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = <-polities[1].RunRecallElection("leader")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		shutdown := rand.Perm(7)[:5]
+		next := shutdown[4]
+		shutdown = shutdown[:4]
+
+		for _, n := range shutdown {
+			c.crash(n)
+		}
+
+		err = <-polities[next].RunElection("leader")
+		if err != ErrLostElection {
+			t.Fatal("Election should have been lost")
+		}
+	})
+}
+
+func TestMetrics(t *testing.T) {
+	eachTransport(t, func(t *testing.T, newCluster clusterFunc) {
+		polities := newCluster(t, 3, mesh).polities
+
+		err := <-polities[0].RunElection("leader")
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = <-polities[1].RunElection("leader")
+		if err != ErrLostElection {
+			t.Fatal("Election should have been lost, got", err)
+		}
+		_, err = polities[1].QueryRole("leader")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		m := polities[0].metrics
+		if m.electionsStarted.Value() != 1 || m.elections.Value("won") != 1 || m.confirmationRounds.Value("election") < 1 {
+			t.Fatal("Won election was not counted")
+		}
+		m = polities[1].metrics
+		if m.electionsStarted.Value() != 1 || m.elections.Value("lost") != 1 {
+			t.Fatal("Lost election was not counted")
+		}
+		if m.queryDuration.Count("role", "found") != 1 {
+			t.Fatal("Query was not timed")
+		}
+
+		buf := &bytes.Buffer{}
+		_, err = polities[0].Metrics().WriteTo(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(buf.String(), `polity_roles{status="confirmed"} 1`) {
+			t.Fatalf("Roles by status missing from\n%s", buf)
+		}
+	})
+}
+
+func TestTracing(t *testing.T) {
+	eachTransport(t, func(t *testing.T, newCluster clusterFunc) {
+		polities := newCluster(t, 3, mesh).polities
+
+		exporters := make([]*MemoryExporter, len(polities))
+		for i, p := range polities {
+			exporters[i] = NewMemoryExporter()
+			p.Exporter = exporters[i]
+		}
+
+		err := <-polities[0].RunElection("leader")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var root, begin Span
+		for _, s := range exporters[0].Spans() {
+			switch s.Name {
+			case "polity.election":
+				root = s
+			case "polity.election.begin":
+				begin = s
+			}
+		}
+		if root.TraceID == "" || root.Error != "" || root.Attributes["roles"] != "leader" {
+			t.Fatalf("Election span missing or incomplete: %+v", root)
+		}
+		if begin.TraceID != root.TraceID || begin.ParentID != root.SpanID || len(begin.Events) < 2 {
+			t.Fatalf("Voting round span should be a child of the election with a response per voter: %+v", begin)
+		}
+
+		for i, e := range exporters {
+			waitFor(t, 5*time.Second, func() bool {
+				for _, s := range e.Spans() {
+					if s.Name == "polity.vote" && s.TraceID == root.TraceID && s.ParentID == begin.SpanID {
+						return true
+					}
+				}
+				return false
+			}, "%s did not record its vote in the election's trace", polities[i].name)
+		}
+	})
+}
+
+func TestAuthentication(t *testing.T) {
+	newNetwork := func() *MemoryNetwork {
+		network := NewMemoryNetwork()
+		network.SetLatency(time.Millisecond, 5*time.Millisecond)
+		network.SetTimeout(250 * time.Millisecond)
+		return network
+	}
+	join := func(t *testing.T, network *MemoryNetwork, name string, auth func(Transport) Authenticator) *Polity {
+		tr := network.Join(name)
+		p, err := New(Authenticate(tr, auth(tr)), "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+	rejected := func(p *Polity, kind string) float64 {
+		return p.t.(*authTransport).rejectionCounts()[kind]
+	}
+
+	t.Run("hmac", func(t *testing.T) {
+		network := newNetwork()
+		shared := func(Transport) Authenticator { return NewHMACAuthenticator([]byte("secret")) }
+
+		polities := []*Polity{}
+		for _, name := range names[:3] {
+			polities = append(polities, join(t, network, name, shared))
+		}
+		rogue := join(t, network, names[3], func(Transport) Authenticator {
+			return NewHMACAuthenticator([]byte("guessed"))
+		})
+
+		err := <-polities[0].RunElection("leader")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = <-rogue.RunElection("other")
+		if err != ErrLostElection {
+			t.Fatal("Election with the wrong key should have been lost, got", err)
+		}
+
+		forged := fmt.Sprintf("%s %s %d", rogue.name, "leader", confirmed)
+		rogue.t.Broadcast(updateTime, []byte(forged))
+		rogue.t.(*authTransport).Transport.Broadcast(updateTime, []byte(forged))
+
+		waitFor(t, 5*time.Second, func() bool {
+			return rejected(polities[1], "event") >= 2 && rejected(polities[1], "query") >= 1
+		}, "forged messages were not rejected")
+
+		leader, err := polities[2].QueryRole("leader")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if leader != polities[0].name {
+			t.Fatal(polities[0].name, "should still hold leader. Got", leader)
+		}
+	})
+
+	t.Run("ed25519", func(t *testing.T) {
+		network := newNetwork()
+		trusted := []ed25519.PublicKey{}
+		keys := []ed25519.PrivateKey{}
+		for range names[:3] {
+			pub, key, err := ed25519.GenerateKey(nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			trusted = append(trusted, pub)
+			keys = append(keys, key)
+		}
+		keyed := func(name string, advertised ed25519.PublicKey, key ed25519.PrivateKey) *Polity {
+			network.SetTags(name, map[string]string{PublicKeyTag: EncodePublicKey(advertised)})
+			return join(t, network, name, func(tr Transport) Authenticator {
+				return NewEd25519Authenticator(key, tr, trusted)
+			})
+		}
+
+		polities := []*Polity{}
+		for i, name := range names[:3] {
+			polities = append(polities, keyed(name, trusted[i], keys[i]))
+		}
+
+		err := <-polities[0].RunElection("leader")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// an impostor advertising one key but signing with another
+		advertised, _, _ := ed25519.GenerateKey(nil)
+		_, other, _ := ed25519.GenerateKey(nil)
+		impostor := keyed(names[3], advertised, other)
+
+		err = <-impostor.RunRecallElection("leader")
+		if err != ErrLostElection {
+			t.Fatal("Recall by an impostor should have been lost, got", err)
+		}
+
+		// a rogue member advertising and signing with a key no one trusts
+		pub, key, _ := ed25519.GenerateKey(nil)
+		rogue := keyed(names[4], pub, key)
+
+		err = <-rogue.RunRecallElection("leader")
+		if err != ErrLostElection {
+			t.Fatal("Recall by an untrusted member should have been lost, got", err)
+		}
+
+		leader, err := polities[1].QueryRole("leader")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if leader != polities[0].name {
+			t.Fatal(polities[0].name, "should still hold leader. Got", leader)
+		}
+		if rejected(polities[1], "query") < 2 {
+			t.Fatal("Impostor's and rogue's recalls were not counted as rejected")
+		}
+	})
+
+	t.Run("sender", func(t *testing.T) {
+		network := newNetwork()
+		shared := func(Transport) Authenticator { return NewHMACAuthenticator([]byte("secret")) }
+
+		sender := join(t, network, names[0], shared)
+		receiver := join(t, network, names[1], shared)
+
+		received := make(chan UserEvent, 1)
+		receiver.OnEvent = func(e UserEvent) { received <- e }
+		sender.t.Broadcast("test.sender", []byte("payload"))
+
+		select {
+		case e := <-received:
+			if e.From != sender.name || string(e.Payload) != "payload" {
+				t.Fatalf("Expected payload from %s, got %q from %s", sender.name, e.Payload, e.From)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("event was not delivered")
+		}
+	})
+
+	t.Run("replay", func(t *testing.T) {
+		network := newNetwork()
+		shared := func(Transport) Authenticator { return NewHMACAuthenticator([]byte("secret")) }
+
+		sender := join(t, network, names[0], shared)
+		receiver := join(t, network, names[1], shared)
+
+		_, sealed := sender.t.(*authTransport).seal("event", "test.replay", []byte("payload"))
+		raw := sender.t.(*authTransport).Transport
+		raw.Broadcast("test.replay", sealed)
+		raw.Broadcast("test.replay", sealed)
+
+		waitFor(t, 5*time.Second, func() bool {
+			return rejected(receiver, "event") >= 1
+		}, "replayed event was not rejected")
+		if n := rejected(receiver, "event"); n != 1 {
+			t.Fatal("Only the replayed event should have been rejected, got", n)
+		}
+	})
+}
+
+func TestObservers(t *testing.T) {
+	network := NewMemoryNetwork()
+	network.SetLatency(time.Millisecond, 5*time.Millisecond)
+	network.SetTimeout(250 * time.Millisecond)
+
+	polities := []*Polity{}
+	for i, name := range names[:7] {
+		if i >= 4 {
+			network.SetTags(name, map[string]string{ObserverTag: "true"})
+		}
+		p, err := New(network.Join(name), "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		polities = append(polities, p)
+	}
+	voters, observers := polities[:4], polities[4:]
+
+	if n := observers[0].population(); n != 4 {
+		t.Fatal("Observers should not be counted towards quorum. Population was", n)
+	}
+	if voters, required := observers[0].Quorum(); voters != 4 || required != 3 {
+		t.Fatalf("Expected 3 of 4 voters to be a quorum, got %d of %d", required, voters)
+	}
+
+	changed := observers[0].Watch("leader")
+	err := <-voters[0].RunElection("leader")
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	leader, err := polities[1].QueryRole("leader")
+	select {
+	case <-changed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Observer was not notified of the election")
+	}
+	leader, err := observers[0].QueryRole("leader")
 	if err != nil {
 		t.Fatal(err)
 	}
+	if leader != voters[0].name {
+		t.Fatal(voters[0].name, "should be leader. Got", leader)
+	}
 
-	if leader != polities[0].name {
-		t.Fatal(polities[0].name, "should be leader. Got", leader)
+	err = <-observers[1].RunElection("other")
+	if err != ErrObserver {
+		t.Fatal("Observers should not be able to run for roles, got", err)
 	}
 
-	err = <-polities[1].RunRecallElection("leader")
-	if err != nil {
-		t.Fatal(err)
+	// three of four voters are a quorum, even though they are not a majority of
+	// all members
+	network.Crash(voters[3].name)
+	result := <-voters[1].Elect("second")
+	if result.Err != nil {
+		t.Fatal(result.Err)
+	}
+
+	electorate := []string{}
+	for _, p := range voters {
+		electorate = append(electorate, p.name)
+	}
+	sort.Strings(electorate)
+	if !reflect.DeepEqual(result.Electorate, electorate) {
+		t.Fatal("Electorate should be the voters", electorate, "got", result.Electorate)
+	}
+	if result.VotesRequired != 3 || result.YesVotes != 3 {
+		t.Fatalf("Expected 3 of 3 required votes, got %d of %d", result.YesVotes, result.VotesRequired)
 	}
 }
 
-func TestChain(t *testing.T) {
-	polities, agents := getAgents(t, 7)
+func TestPartitionedQuorum(t *testing.T) {
+	network := NewMemoryNetwork()
+	network.SetLatency(time.Millisecond, 5*time.Millisecond)
+	network.SetTimeout(250 * time.Millisecond)
 
-	for n := range agents[1:] {
-		joinAgents(t, []*agent.Agent{agents[n], agents[n+1]})
+	polities := map[string]*Polity{}
+	for _, name := range names[:7] {
+		p, err := New(network.Join(name), "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		polities[name] = p
 	}
 
-	err := <-polities[0].RunElection("leader")
-	if err != nil {
-		t.Fatal(err)
+	// each side of the partition sees the other as failed
+	majority, minority := names[:4], names[4:7]
+	network.Partition(majority, minority)
+	for _, m := range polities[minority[0]].t.Members() {
+		if m.Alive != (m.Name >= minority[0]) {
+			t.Fatalf("%s should see %s as alive only if it is on the same side", minority[0], m.Name)
+		}
 	}
 
-	err = <-polities[1].RunRecallElection("leader")
+	result := <-polities[minority[0]].Elect("leader")
+	if result.Err != ErrLostElection {
+		t.Fatal("The minority side of a partition should not win an election, got", result.Err)
+	}
+	if result.VotesRequired != 4 || len(result.Electorate) != 7 {
+		t.Fatalf("Expected 4 of 7 voters to be required, got %d of %d", result.VotesRequired, len(result.Electorate))
+	}
+
+	err := <-polities[majority[0]].RunElection("leader")
 	if err != nil {
-		t.Fatal(err)
+		t.Fatal("The majority side of a partition should win an election, got", err)
 	}
+}
+
+func TestResignAll(t *testing.T) {
+	eachTransport(t, func(t *testing.T, newCluster clusterFunc) {
+		polities := newCluster(t, 3, mesh).polities
+
+		err := <-polities[0].RunElection("leader")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = polities[0].ResignAll(10 * time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
 
+		err = <-polities[1].RunElection("leader")
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
 }
 
-func TestPolityWithFailures(t *testing.T) {
-	polities, agents := getAgents(t, 7)
-	joinAgents(t, agents)
+func TestPersistentRoles(t *testing.T) {
+	eachTransport(t, func(t *testing.T, newCluster clusterFunc) {
+		dir, err := ioutil.TempDir("", "polity")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+
+		c := newCluster(t, 3, mesh)
+		polities := c.polities
+
+		joined := c.add(t, names[3], dir, 0)
+		waitFor(t, 10*time.Second, func() bool {
+			return polities[0].t.NumMembers() == 4
+		}, "%s did not join", names[3])
+
+		err = <-polities[0].RunElection("leader")
+		if err != nil {
+			t.Fatal(err)
+		}
 
-	err := <-polities[0].RunElection("leader")
+		// the election may finish before the joined node confirms; it is
+		// notified of the confirmation once it has been persisted
+		for {
+			changed := joined.Watch("leader")
+			joined.voteMutex.Lock()
+			r := joined.roles["leader"]
+			joined.voteMutex.Unlock()
+			if r.status == confirmed {
+				joined.unwatch(changed, "leader")
+				break
+			}
+
+			select {
+			case <-changed:
+			case <-time.After(10 * time.Second):
+				t.Fatal(names[3], "did not confirm", polities[0].name, "as leader")
+			}
+		}
+
+		c.crash(3)
+		p := c.add(t, names[3], dir, 0)
+
+		p.voteMutex.Lock()
+		r, ok := p.roles["leader"]
+		p.voteMutex.Unlock()
+
+		if !ok || r.node != polities[0].name || r.status != confirmed {
+			t.Fatalf("%s should have reloaded %s as leader. Got %+v", names[3], polities[0].name, r)
+		}
+	})
+}
+
+func TestStoreJournal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "polity")
 	if err != nil {
 		t.Fatal(err)
 	}
+	defer os.RemoveAll(dir)
 
-	err = <-polities[1].RunRecallElection("leader")
-	if err != nil {
+	s, _ := openStore(dir)
+	first := map[string]role{
+		"a": {node: "A", status: running, time: 1},
+		"b": {node: "B", status: confirmed, time: 2},
+	}
+	if err := s.save(first); err != nil {
 		t.Fatal(err)
 	}
-
-	shutdown := rand.Perm(7)[:2]
-	next := shutdown[1]
-	shutdown = shutdown[:1]
-
-	for _, n := range shutdown {
-		agents[n].Shutdown()
-		<-agents[n].ShutdownCh()
-		polities[n].logf("Shutting down node %s", polities[n].name)
+	if err := s.append(map[string]role{"a": {node: "A", status: confirmed, time: 3}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.append(map[string]role{"c": {node: "C", status: running, time: 4}}); err != nil {
+		t.Fatal(err)
 	}
 
-	err = <-polities[next].RunElection("leader")
+	// an entry cut short by a crash
+	f, err := os.OpenFile(filepath.Join(dir, journalFile), os.O_WRONLY|os.O_APPEND, 0644)
 	if err != nil {
 		t.Fatal(err)
 	}
-}
+	f.WriteString(`{"d":{"node":`)
+	f.Close()
 
-func TestLostElection(t *testing.T) {
-	polities, agents := getAgents(t, 7)
-	joinAgents(t, agents)
-
-	err := <-polities[0].RunElection("leader")
+	expected := map[string]role{
+		"a": {node: "A", status: confirmed, time: 3},
+		"b": {node: "B", status: confirmed, time: 2},
+		"c": {node: "C", status: running, time: 4},
+	}
+	reopened, _ := openStore(dir)
+	roles, err := reopened.load()
 	if err != nil {
 		t.Fatal(err)
 	}
+	if !reflect.DeepEqual(roles, expected) {
+		t.Fatalf("Expected %+v, got %+v", expected, roles)
+	}
+	if reopened.entries != 2 {
+		t.Fatal("Expected 2 journal entries, got", reopened.entries)
+	}
 
-	err = <-polities[1].RunRecallElection("leader")
+	// folding the journal into the table leaves the same roles
+	if err := reopened.save(roles); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, journalFile)); !os.IsNotExist(err) {
+		t.Fatal("Saving the table should remove the journal, got", err)
+	}
+	roles, err = (&store{path: reopened.path, journal: reopened.journal}).load()
 	if err != nil {
 		t.Fatal(err)
 	}
+	if !reflect.DeepEqual(roles, expected) {
+		t.Fatalf("Expected %+v after compaction, got %+v", expected, roles)
+	}
+}
+
+func TestMutex(t *testing.T) {
+	eachTransport(t, func(t *testing.T, newCluster clusterFunc) {
+		polities := newCluster(t, 3, mesh).polities
+
+		held := polities[0].NewMutex("lock")
+		err := held.TryLock()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		waiting := polities[1].NewMutex("lock")
+		err = waiting.TryLock()
+		if err != ErrLostElection {
+			t.Fatal("Lock should have been held, got", err)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+
+		locked := make(chan error, 1)
+		go func() {
+			locked <- waiting.Lock(ctx)
+		}()
+
+		time.Sleep(500 * time.Millisecond)
+		err = held.Unlock()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = <-locked
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		leader, err := polities[2].QueryRole("lock")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if leader != polities[1].name {
+			t.Fatal(polities[1].name, "should hold lock. Got", leader)
+		}
+	})
+}
+
+func TestMutexUnwatch(t *testing.T) {
+	p := memoryCluster(t, 3, mesh).polities[0]
+	m := p.NewMutex("lock", "other")
+	watching := func(role string) bool {
+		p.voteMutex.Lock()
+		defer p.voteMutex.Unlock()
+		return len(p.watchers[role]) > 0
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	waited := make(chan error, 1)
+	go func() {
+		waited <- m.waitRelease(ctx, m.lookup(), time.Minute)
+	}()
+
+	// a change to one role that does not release it starts a new watch
+	waitFor(t, 5*time.Second, func() bool { return watching("lock") }, "mutex did not watch its roles")
+	p.voteMutex.Lock()
+	p.notify("lock")
+	p.voteMutex.Unlock()
+	waitFor(t, 5*time.Second, func() bool { return watching("lock") }, "mutex did not watch its roles again")
+
+	cancel()
+	if err := <-waited; err != context.Canceled {
+		t.Fatal("Expected the wait to be canceled, got", err)
+	}
+
+	p.voteMutex.Lock()
+	defer p.voteMutex.Unlock()
+	if len(p.watchers) != 0 {
+		t.Fatal("Abandoned waits should not leave watchers behind, got", p.watchers)
+	}
+}
+
+func TestLocalMutex(t *testing.T) {
+	eachTransport(t, func(t *testing.T, newCluster clusterFunc) {
+		polities := newCluster(t, 3, mesh).polities
+
+		held := polities[0].NewMutex("lock", "other")
+		err := held.TryLock()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// another mutex over one of the roles on the same node must wait too
+		waiting := polities[0].NewMutex("lock")
+		err = waiting.TryLock()
+		if err != ErrLostElection {
+			t.Fatal("Lock should have been held, got", err)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+		defer cancel()
+		err = waiting.Lock(ctx)
+		if err != context.DeadlineExceeded {
+			t.Fatal("Lock should have timed out, got", err)
+		}
+
+		// a mutex held elsewhere is waited on by watching its roles, which
+		// must be given up on each attempt
+		remote := polities[1].NewMutex("lock")
+		ctx, cancel = context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		err = remote.Lock(ctx)
+		if err != context.DeadlineExceeded {
+			t.Fatal("Lock should have timed out, got", err)
+		}
+
+		p := polities[1]
+		p.voteMutex.Lock()
+		watchers := len(p.watchers["lock"])
+		p.voteMutex.Unlock()
+		if watchers != 0 {
+			t.Fatal("Lock left", watchers, "watchers behind")
+		}
+
+		err = held.Unlock()
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = waiting.TryLock()
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestMultiRoleElection(t *testing.T) {
+	eachTransport(t, func(t *testing.T, newCluster clusterFunc) {
+		polities := newCluster(t, 3, mesh).polities
+
+		err := <-polities[0].RunElection("b")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = <-polities[1].RunElection("a", "b")
+		if err != ErrLostElection {
+			t.Fatal("Election should have been lost while b was held, got", err)
+		}
+
+		_, err = polities[2].QueryRole("a")
+		if err == nil {
+			t.Fatal("a should not have been filled by a lost election")
+		}
+
+		err = <-polities[0].RunRecallElection("b")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = <-polities[1].RunElection("a", "b")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, r := range []string{"a", "b"} {
+			leader, err := polities[2].QueryRole(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if leader != polities[1].name {
+				t.Fatal(polities[1].name, "should hold", r, "Got", leader)
+			}
+		}
+
+		err = <-polities[1].RunRecallElection("a", "b")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = <-polities[2].RunElection("a")
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestTally(t *testing.T) {
+	tl := newTally()
+	add := func(from string) bool {
+		return tl.add(5, from, names[0], confirmed, 5, 0, nil)
+	}
+
+	if add(names[1]) {
+		t.Fatal("One response should not agree on a holder")
+	}
+	if add(names[2]) {
+		t.Fatal("Two of five responders should not agree on a holder")
+	}
+	if add(names[2]) {
+		t.Fatal("A repeated response should not be counted again")
+	}
+	if !add(names[3]) {
+		t.Fatal("Three of five responders should agree on a holder")
+	}
+	if tl.info.Holder != names[0] {
+		t.Fatal("Expected holder", names[0], "got", tl.info.Holder)
+	}
+}
+
+func TestRoleSizeLimit(t *testing.T) {
+	network := NewMemoryNetwork()
+	network.SetLatency(time.Millisecond, 5*time.Millisecond)
+	network.SetTimeout(250 * time.Millisecond)
+	// serf's defaults, less an allowance for its framing of queries
+	network.SetSizeLimits(1024-128, 512)
+
+	// signed requests from nodes with long names are the largest
+	members := []string{}
+	trusted := []ed25519.PublicKey{}
+	keys := []ed25519.PrivateKey{}
+	for _, name := range names[:3] {
+		members = append(members, strings.Repeat(name, 48))
+		pub, key, err := ed25519.GenerateKey(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		trusted = append(trusted, pub)
+		keys = append(keys, key)
+	}
+	polities := []*Polity{}
+	for i, name := range members {
+		network.SetTags(name, map[string]string{PublicKeyTag: EncodePublicKey(trusted[i])})
+		tr := network.Join(name)
+		p, err := New(Authenticate(tr, NewEd25519Authenticator(keys[i], tr, trusted)), "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		polities = append(polities, p)
+	}
+
+	roles := []string{}
+	for i := 0; i < 40; i++ {
+		roles = append(roles, RoleName("partition", strings.Repeat("h", 32), fmt.Sprintf("topic-%02d", i)))
+	}
+
+	err := <-polities[0].RunElection(roles...)
+	if err != ErrTooManyRoles {
+		t.Fatal("Expected too many roles to be refused, got", err)
+	}
+
+	batches := SplitRoles(roles)
+	if len(batches) < 2 {
+		t.Fatal("Expected the roles to be split, got", len(batches), "batch")
+	}
+
+	// a candidate cut off from the rest votes for itself, loses and withdraws
+	// its vote with a broadcast
+	network.Partition([]string{members[1]}, []string{members[0], members[2]})
+	err = <-polities[1].RunElection(batches[0]...)
+	if err != ErrLostElection {
+		t.Fatal("A candidate cut off from a quorum should have lost, got", err)
+	}
+	waitFor(t, 5*time.Second, func() bool {
+		polities[1].voteMutex.Lock()
+		defer polities[1].voteMutex.Unlock()
+		for _, r := range batches[0] {
+			if role := polities[1].roles[r]; role.status == running && role.node == polities[1].name {
+				return false
+			}
+		}
+		return true
+	}, "the lost election's votes were not withdrawn")
+	network.Heal()
+
+	for _, batch := range batches {
+		err = <-polities[0].RunElection(batch...)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, batch := range batches {
+		err = <-polities[0].RunRecallElection(batch...)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestQueryPrefix(t *testing.T) {
+	eachTransport(t, func(t *testing.T, newCluster clusterFunc) {
+		polities := newCluster(t, 3, mesh).polities
+
+		expected := map[string]string{}
+		for i, p := range polities[:2] {
+			r := RoleName("recover", names[i])
+			err := <-p.RunElection(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			expected[r] = p.name
+		}
+
+		err := <-polities[2].RunElection("unrelated")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// enough roles that each node's answer spans several pages
+		paged := []string{}
+		for i := 0; i < 40; i++ {
+			r := RoleName("recover", "paged", fmt.Sprint(i))
+			paged = append(paged, r)
+			expected[r] = polities[2].name
+		}
+		for _, batch := range SplitRoles(paged) {
+			err = <-polities[2].RunElection(batch...)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		err = <-polities[2].RunRecallElection(RoleName("recover", "paged", "0"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		delete(expected, RoleName("recover", "paged", "0"))
+
+		holders, err := polities[0].QueryPrefix(Namespace("recover"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(holders, expected) {
+			t.Fatalf("Expected %v, got %v", expected, holders)
+		}
+	})
+}
+
+func TestQueryPrefixOversized(t *testing.T) {
+	polities := memoryCluster(t, 3, mesh).polities
+
+	// too large to be elected, but a role table may hold one from before
+	// elections were limited
+	long := RoleName("recover", strings.Repeat("x", syncChunkSize))
+	for _, p := range polities {
+		p.voteMutex.Lock()
+		p.roles[long] = role{node: polities[0].name, status: confirmed, time: 1}
+		p.voteMutex.Unlock()
+	}
+
+	_, err := polities[1].QueryPrefix(Namespace("recover"))
+	if err == nil {
+		t.Fatal("A role too large for a page should fail the query, not be left out")
+	}
+}
+
+func TestRoleValue(t *testing.T) {
+	eachTransport(t, func(t *testing.T, newCluster clusterFunc) {
+		polities := newCluster(t, 3, mesh).polities
+
+		err := <-polities[0].RunElection("cursor")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = polities[1].SetValue("cursor", []byte("ignored"))
+		if err != ErrNotHolder {
+			t.Fatal("Only the holder should be able to write, got", err)
+		}
+
+		err = polities[0].SetValue("cursor", []byte("first"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		info, err := polities[2].QueryRoleInfo("cursor")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Holder != polities[0].name || string(info.Value) != "first" || info.Version != 1 {
+			t.Fatalf("Unexpected role info %+v", info)
+		}
+
+		err = <-polities[0].RunRecallElection("cursor")
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = <-polities[1].RunElection("cursor")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = polities[1].SetValue("cursor", []byte("second"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		info, err = polities[0].QueryRoleInfo("cursor")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Holder != polities[1].name || string(info.Value) != "second" || info.Version != 2 {
+			t.Fatalf("Value should have passed to the new holder, got %+v", info)
+		}
+	})
+}
+
+func TestCampaign(t *testing.T) {
+	eachTransport(t, func(t *testing.T, newCluster clusterFunc) {
+		polities := newCluster(t, 3, mesh).polities
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		elected := make(chan struct{}, 2)
+		demoted := make(chan struct{}, 2)
+		result := make(chan error, 1)
+		go func() {
+			result <- polities[0].Campaign(ctx, "coordinator", func(term context.Context) {
+				elected <- struct{}{}
+				<-term.Done()
+			}, func() {
+				demoted <- struct{}{}
+			})
+		}()
+
+		select {
+		case <-elected:
+		case <-time.After(30 * time.Second):
+			t.Fatal(polities[0].name, "was not elected")
+		}
+
+		err := <-polities[1].RunRecallElection("coordinator")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		select {
+		case <-demoted:
+		case <-time.After(30 * time.Second):
+			t.Fatal(polities[0].name, "was not demoted")
+		}
+
+		select {
+		case <-elected:
+		case <-time.After(30 * time.Second):
+			t.Fatal(polities[0].name, "was not re-elected")
+		}
+
+		cancel()
+		err = <-result
+		if err != context.Canceled {
+			t.Fatal("Campaign should have been cancelled, got", err)
+		}
+	})
+}
+
+// cluster is a set of polities connected by one of the transports under test.
+type cluster struct {
+	polities []*Polity
+
+	// add starts a polity named name that persists its roles in stateDir and
+	// joins it to the cluster through polities[peer].
+	add func(t *testing.T, name, stateDir string, peer int) *Polity
+
+	// crash stops polities[n] without it leaving the cluster.
+	crash func(n int)
+}
+
+// topology describes how the members of a new cluster are joined.
+type topology int
+
+const (
+	mesh topology = iota
+	chain
+)
+
+type clusterFunc func(t *testing.T, n int, top topology) *cluster
+
+var transports = []struct {
+	name       string
+	newCluster clusterFunc
+}{
+	{"serf", serfCluster},
+	{"memory", memoryCluster},
+}
+
+// eachTransport runs test once over each transport.
+func eachTransport(t *testing.T, test func(t *testing.T, newCluster clusterFunc)) {
+	for _, tr := range transports {
+		newCluster := tr.newCluster
+		t.Run(tr.name, func(t *testing.T) {
+			test(t, newCluster)
+		})
+	}
+}
 
-	shutdown := rand.Perm(7)[:5]
-	next := shutdown[4]
-	shutdown = shutdown[:4]
+func serfCluster(t *testing.T, n int, top topology) *cluster {
+	polities, agents := getAgents(t, n)
 
-	for _, n := range shutdown {
+	switch top {
+	case mesh:
+		joinAgents(t, agents)
+	case chain:
+		for n := range agents[1:] {
+			joinAgents(t, []*agent.Agent{agents[n], agents[n+1]})
+		}
+		// voters a candidate has not heard of cannot vote for it, so wait
+		// for gossip, or failing that a push-pull sync, to carry every
+		// member along the chain
+		waitFor(t, 45*time.Second, func() bool {
+			for _, p := range polities {
+				if p.t.NumMembers() != n {
+					return false
+				}
+			}
+			return true
+		}, "members did not learn of each other along the chain")
+	}
+
+	c := &cluster{polities: polities}
+	c.add = func(t *testing.T, name, stateDir string, peer int) *Polity {
+		a := getAgent(t, name)
+		p, err := CreateWithAgent(a, stateDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		joinAgents(t, []*agent.Agent{agents[peer], a})
+
+		agents = append(agents, a)
+		c.polities = append(c.polities, p)
+		return p
+	}
+	c.crash = func(n int) {
 		agents[n].Shutdown()
 		<-agents[n].ShutdownCh()
 	}
+	return c
+}
 
-	err = <-polities[next].RunElection("leader")
-	if err != ErrLostElection {
-		t.Fatal("Election should have been lost")
+// memoryCluster creates a cluster on a MemoryNetwork. Every member of the
+// network can reach every other, so tests of any topology but a mesh are
+// skipped rather than run as though they were one.
+func memoryCluster(t *testing.T, n int, top topology) *cluster {
+	if top != mesh {
+		t.Skip("memory network members are always fully meshed")
+	}
+
+	network := NewMemoryNetwork()
+	network.SetLatency(time.Millisecond, 5*time.Millisecond)
+	network.SetTimeout(250 * time.Millisecond)
+
+	c := &cluster{}
+	c.add = func(t *testing.T, name, stateDir string, peer int) *Polity {
+		p, err := New(network.Join(name), stateDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.polities = append(c.polities, p)
+		return p
+	}
+	c.crash = func(n int) {
+		network.Crash(c.polities[n].name)
+	}
+
+	for _, name := range names[:n] {
+		c.add(t, name, "", 0)
+	}
+	return c
+}
+
+// waitFor polls cond until it is true, failing the test after timeout.
+func waitFor(t *testing.T, timeout time.Duration, cond func() bool, format string, args ...interface{}) {
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf(format, args...)
+		}
+		time.Sleep(50 * time.Millisecond)
 	}
 }
 
@@ -165,9 +1267,12 @@ func getAgents(t *testing.T, n int) ([]*Polity, []*agent.Agent) {
 	for n := range iter.N(n) {
 		a := getAgent(t, names[n])
 		ag[n] = a
-		pl[n] = CreateWithAgent(a)
-		pl[n].name = names[n]
-		//pl[n].Log = log.New(os.Stdout, "", 0)
+		p, err := CreateWithAgent(a, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		pl[n] = p
+		//pl[n].Log = logging.New(os.Stdout, logging.Logfmt, logging.Debug)
 	}
 	return pl, ag
 }
@@ -0,0 +1,168 @@
+package polity
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/shipwire/ansqd/internal/logging"
+)
+
+// RoleSeparator separates the parts of a hierarchical role name.
+const RoleSeparator = ":"
+
+// RoleName joins parts into a hierarchical role name, such as "recover:host1".
+func RoleName(parts ...string) string {
+	return strings.Join(parts, RoleSeparator)
+}
+
+// Namespace returns the prefix shared by every role named beneath parts, for use
+// with QueryPrefix. Namespace("recover") is "recover:".
+func Namespace(parts ...string) string {
+	return RoleName(parts...) + RoleSeparator
+}
+
+// QueryPrefix asks the cluster which roles beginning with prefix are held, and by
+// whom. Every role is tallied as QueryRole would, so only roles whose holder is
+// agreed by a quorum are returned. All roles are gathered by the same query
+// unless the answers are too large to fit in a single response, in which case
+// they are fetched in pages. If a responder cannot fit even one role in a page,
+// an error is returned rather than leaving its roles out.
+func (p *Polity) QueryPrefix(prefix string) (holders map[string]string, err error) {
+	start := time.Now()
+	defer func() { p.metrics.queryResult("prefix", start, err) }()
+
+	type view struct {
+		from   string
+		node   string
+		status status
+		time   LamportTime
+	}
+
+	order := []string{}
+	views := make(map[string][]view)
+	seen := make(map[string]map[string]bool)
+
+	cursor := "-"
+	for {
+		qr, err := p.t.Query(queryPrefix, []byte(cursor+" "+prefix), 5*time.Second)
+		if err != nil {
+			return nil, err
+		}
+
+		next := ""
+		responders := 0
+		for rsp := range qr.ResponseCh() {
+			responders++
+			more := false
+			last := ""
+			for _, line := range strings.Split(string(rsp.Payload), "\n") {
+				if line == "" {
+					continue
+				}
+				if line == syncMore {
+					more = true
+					continue
+				}
+
+				var r string
+				v := view{from: rsp.From}
+				_, err := fmt.Sscan(line, &r, &v.node, &v.status, &v.time)
+				if err != nil {
+					p.logger().Warn("error parsing prefix query response", "prefix", prefix, logging.ErrorKey, err, "line", strconv.Quote(line))
+					p.metrics.parseErrors.Inc("query")
+					continue
+				}
+				last = r
+
+				if seen[r] == nil {
+					seen[r] = make(map[string]bool)
+					order = append(order, r)
+				}
+				if seen[r][rsp.From] {
+					// already counted from an earlier page
+					continue
+				}
+				seen[r][rsp.From] = true
+				views[r] = append(views[r], v)
+			}
+			if more && last == "" {
+				qr.Close()
+				return nil, fmt.Errorf("prefix query response from %s truncated before its first role", rsp.From)
+			}
+			if more && (next == "" || last < next) {
+				next = last
+			}
+
+			if responders >= p.population() {
+				break
+			}
+		}
+		qr.Close()
+
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+
+	population := p.population()
+	holders = make(map[string]string)
+	for _, r := range order {
+		t := newTally()
+		for _, v := range views[r] {
+			if t.add(population, v.from, v.node, v.status, v.time, 0, nil) {
+				holders[r] = t.info.Holder
+				break
+			}
+		}
+	}
+	return holders, nil
+}
+
+// prefixDigest answers a prefix query with the roles held locally beneath the
+// requested prefix, beginning after the role named in the request. Vacant roles
+// are left out.
+func (p *Polity) prefixDigest(q *Query) {
+	fields := strings.SplitN(string(q.Payload), " ", 2)
+	cursor, prefix := fields[0], ""
+	if len(fields) > 1 {
+		prefix = fields[1]
+	}
+
+	p.voteMutex.Lock()
+	names := []string{}
+	for name, r := range p.roles {
+		if r.status.vacant() || !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		if cursor == "-" || name > cursor {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	buf := &bytes.Buffer{}
+	for _, name := range names {
+		r := p.roles[name]
+		line := fmt.Sprintf("%s %s %d %d\n", name, r.node, r.status, r.time)
+		if len(line)+len(syncMore) > syncChunkSize {
+			// the page ends empty, which the requester reports as an error
+			p.logger().Warn("role too large to answer a prefix query", logging.RoleKey, name, "size", len(line))
+		}
+		if buf.Len()+len(line)+len(syncMore) > syncChunkSize {
+			buf.WriteString(syncMore)
+			break
+		}
+		buf.WriteString(line)
+	}
+	p.voteMutex.Unlock()
+
+	err := q.Respond(buf.Bytes())
+	if err != nil {
+		p.logger().Warn("error responding to prefix query", logging.ErrorKey, err)
+	}
+}
@@ -5,71 +5,139 @@ import (
 	"strconv"
 	"time"
 
-	"github.com/hashicorp/serf/serf"
+	"github.com/shipwire/ansqd/internal/logging"
 )
 
+// RoleInfo describes a role as agreed by a quorum of the cluster.
+type RoleInfo struct {
+	// Holder is the node that holds the role.
+	Holder string
+
+	// Value is the value attached to the role with SetValue, and Version the
+	// number of the write that stored it. Both are zero if nothing was written.
+	Value   []byte
+	Version uint64
+}
+
 // QueryRole submits a query to the cluster asking which node, if any, has a particular role.
 func (p *Polity) QueryRole(role string) (string, error) {
-	votesRequired := 3
+	info, err := p.QueryRoleInfo(role)
+	return info.Holder, err
+}
+
+// QueryRoleInfo submits a query to the cluster asking which node, if any, has a
+// particular role and what value is attached to it. The newest value among the
+// agreeing responses is returned; since every accepted write reaches a quorum,
+// at least one of them has seen the latest.
+func (p *Polity) QueryRoleInfo(role string) (info RoleInfo, err error) {
+	return p.QueryRoleInfoWithin(role, 10*time.Second)
+}
+
+// QueryRoleInfoWithin queries a role as QueryRoleInfo does, giving up with
+// ErrLostElection if a quorum has not agreed within timeout.
+func (p *Polity) QueryRoleInfoWithin(role string, timeout time.Duration) (info RoleInfo, err error) {
+	start := time.Now()
+	defer func() { p.metrics.queryResult("role", start, err) }()
 
-	var (
-		answer       string
-		answerStatus status
-	)
+	span := p.startSpan("polity.queryRole", spanContext{})
+	span.set("role", role)
+	defer func() { span.finish(err) }()
 
-	votes := 0
-	window := &LamportWindow{}
+	t := newTally()
 
-	qr, err := p.s.Query(query, []byte(role), &serf.QueryParam{Timeout: 10 * time.Second})
+	qr, err := p.t.Query(query, withTrace(span.context(), []byte(role)), timeout)
 	if err != nil {
-		return "", err
+		return RoleInfo{}, err
 	}
+	defer qr.Close()
 
 	for rsp := range qr.ResponseCh() {
 		var node string
 		var status status
-		var time serf.LamportTime
-		population := p.s.Memberlist().NumMembers()
+		var time LamportTime
+		var version uint64
+		var encoded string
 
-		_, err := fmt.Sscanln(string(rsp.Payload), &node, &status, &time)
+		_, err := fmt.Sscan(string(rsp.Payload), &node, &status, &time, &version, &encoded)
 		if err != nil {
-			p.logf("query: %s: error parsing response: %s: %s", p.name, err, strconv.Quote(string(rsp.Payload)))
+			p.logger().Warn("error parsing query response", logging.RoleKey, role, "from", rsp.From, logging.ErrorKey, err, "payload", strconv.Quote(string(rsp.Payload)))
+			p.metrics.parseErrors.Inc("query")
 			continue
 		}
 
-		if newVotesRequired := (population / 2) + 1; newVotesRequired > votesRequired {
-			votesRequired = newVotesRequired
-		}
+		span.event("response", "from", rsp.From, "holder", node)
 
-		if node == "-" {
-			// this response is *really* old. disregard
+		value, err := decodeValue(encoded)
+		if err != nil {
+			p.logger().Warn("error decoding value", logging.RoleKey, role, "from", rsp.From, logging.ErrorKey, err)
+			p.metrics.parseErrors.Inc("query")
 			continue
 		}
 
-		if node != answer && window.Before(time) {
-			// this response is old. disregard
-			continue
+		if t.add(p.population(), rsp.From, node, status, time, version, value) {
+			return t.info, nil
 		}
+	}
 
-		if !status.eq(answerStatus) && window.After(time) {
-			// this response is newer than what we knew. use it instead
-			votes = 1
-			window = &LamportWindow{}
-			window.Witness(time)
-			answer = node
-			answerStatus = status
-		}
+	return RoleInfo{}, ErrLostElection
+}
 
-		if node == answer {
-			// this response is what we know already
-			votes++
-			window.Witness(time)
-		}
+// tally counts the responses to a query about a single role until enough of them
+// agree on its holder.
+type tally struct {
+	votesRequired int
+	agreeing      map[string]bool
+	window        *LamportWindow
+	answer        string
+	answerStatus  status
+	info          RoleInfo
+}
+
+func newTally() *tally {
+	return &tally{
+		votesRequired: 3,
+		agreeing:      make(map[string]bool),
+		window:        &LamportWindow{},
+	}
+}
+
+// add counts from's view of the role, given the cluster's population at the
+// time. Each responder is counted once. It reports whether the holder has been
+// agreed on, in which case it is described by t.info.
+func (t *tally) add(population int, from, node string, status status, time LamportTime, version uint64, value []byte) bool {
+	if newVotesRequired := (population / 2) + 1; newVotesRequired > t.votesRequired {
+		t.votesRequired = newVotesRequired
+	}
+
+	if node == "-" {
+		// this response is *really* old. disregard
+		return false
+	}
+
+	if node != t.answer && t.window.Before(time) {
+		// this response is old. disregard
+		return false
+	}
+
+	if !status.eq(t.answerStatus) && t.window.After(time) {
+		// this response is newer than what we knew. use it instead
+		t.agreeing = make(map[string]bool)
+		t.window = &LamportWindow{}
+		t.window.Witness(time)
+		t.answer = node
+		t.answerStatus = status
+		t.info = RoleInfo{Holder: node}
+	}
+
+	if node == t.answer {
+		// this response is what we know already
+		t.agreeing[from] = true
+		t.window.Witness(time)
 
-		if votes >= votesRequired {
-			return node, nil
+		if version > t.info.Version {
+			t.info.Value, t.info.Version = value, version
 		}
 	}
 
-	return "", ErrLostElection
+	return len(t.agreeing) >= t.votesRequired
 }
@@ -0,0 +1,173 @@
+package polity
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hashicorp/serf/command/agent"
+	"github.com/hashicorp/serf/serf"
+)
+
+// serfTransport is a Transport over a serf cluster.
+type serfTransport struct {
+	s      *serf.Serf
+	events chan Event
+}
+
+// SerfTransport creates a Transport over s, translating the serf events
+// delivered on eventCh.
+func SerfTransport(s *serf.Serf, eventCh <-chan serf.Event) Transport {
+	t := &serfTransport{
+		s:      s,
+		events: make(chan Event, 10),
+	}
+	go t.translate(eventCh)
+	return t
+}
+
+// AgentTransport creates a Transport over a serf.Agent. The transport will
+// register a handler to receive events.
+func AgentTransport(a *agent.Agent) Transport {
+	eventCh := make(chan serf.Event, 10)
+	a.RegisterEventHandler(eventHandler{eventCh})
+	return SerfTransport(a.Serf(), eventCh)
+}
+
+type eventHandler struct {
+	c chan<- serf.Event
+}
+
+func (e eventHandler) HandleEvent(s serf.Event) {
+	e.c <- s
+}
+
+func (t *serfTransport) translate(eventCh <-chan serf.Event) {
+	for {
+		select {
+		case e := <-eventCh:
+			if evt := t.event(e); evt != nil {
+				t.events <- evt
+			}
+		case <-t.s.ShutdownCh():
+			return
+		}
+	}
+}
+
+func (t *serfTransport) event(e serf.Event) Event {
+	switch evt := e.(type) {
+	case *serf.Query:
+		return &Query{
+			Name:    evt.Name,
+			Payload: evt.Payload,
+			LTime:   LamportTime(evt.LTime),
+			respond: evt.Respond,
+		}
+	case serf.UserEvent:
+		return UserEvent{
+			Name:    evt.Name,
+			Payload: evt.Payload,
+			LTime:   LamportTime(evt.LTime),
+		}
+	case serf.MemberEvent:
+		if evt.Type != serf.EventMemberJoin {
+			return nil
+		}
+		join := MemberJoin{}
+		for _, m := range evt.Members {
+			join.Members = append(join.Members, m.Name)
+		}
+		return join
+	}
+	return nil
+}
+
+func (t *serfTransport) LocalName() string {
+	return t.s.LocalMember().Name
+}
+
+func (t *serfTransport) NumMembers() int {
+	return t.s.Memberlist().NumMembers()
+}
+
+func (t *serfTransport) Members() []Member {
+	members := []Member{}
+	for _, m := range t.s.Members() {
+		if m.Status == serf.StatusLeft {
+			continue
+		}
+		members = append(members, Member{Name: m.Name, Tags: m.Tags, Alive: m.Status == serf.StatusAlive})
+	}
+	return members
+}
+
+func (t *serfTransport) Query(name string, payload []byte, timeout time.Duration) (QueryResponse, error) {
+	qr, err := t.s.Query(name, payload, &serf.QueryParam{Timeout: timeout})
+	if err != nil {
+		return nil, err
+	}
+	return newSerfQueryResponse(qr), nil
+}
+
+func (t *serfTransport) Broadcast(name string, payload []byte) error {
+	return t.s.UserEvent(name, payload, false)
+}
+
+func (t *serfTransport) Events() <-chan Event {
+	return t.events
+}
+
+func (t *serfTransport) ShutdownCh() <-chan struct{} {
+	return t.s.ShutdownCh()
+}
+
+// serfQueryResponse relays a serf.QueryResponse. It is only finished once every
+// response serf delivered has been relayed.
+type serfQueryResponse struct {
+	qr        *serf.QueryResponse
+	ch        chan NodeResponse
+	done      chan struct{}
+	closeOnce sync.Once
+	finished  int32
+}
+
+func newSerfQueryResponse(qr *serf.QueryResponse) *serfQueryResponse {
+	r := &serfQueryResponse{
+		qr:   qr,
+		ch:   make(chan NodeResponse),
+		done: make(chan struct{}),
+	}
+	go r.relay()
+	return r
+}
+
+func (r *serfQueryResponse) relay() {
+	defer func() {
+		atomic.StoreInt32(&r.finished, 1)
+		close(r.ch)
+	}()
+
+	for rsp := range r.qr.ResponseCh() {
+		select {
+		case r.ch <- NodeResponse{From: rsp.From, Payload: rsp.Payload}:
+		case <-r.done:
+			return
+		}
+	}
+}
+
+func (r *serfQueryResponse) ResponseCh() <-chan NodeResponse {
+	return r.ch
+}
+
+func (r *serfQueryResponse) Finished() bool {
+	return atomic.LoadInt32(&r.finished) == 1
+}
+
+func (r *serfQueryResponse) Close() {
+	r.closeOnce.Do(func() {
+		close(r.done)
+		r.qr.Close()
+	})
+}
@@ -2,14 +2,31 @@ package polity
 
 import (
 	"fmt"
+	"strconv"
+	"strings"
 
-	"github.com/hashicorp/serf/serf"
+	"github.com/shipwire/ansqd/internal/logging"
 )
 
 type role struct {
-	node   string
-	status status
-	time   serf.LamportTime
+	node     string
+	status   status
+	time     LamportTime
+	election string
+
+	// value is attached to the role by its holder and outlives any one holder.
+	// version increases with every write to it.
+	value   []byte
+	version uint64
+}
+
+// elect returns a copy of r held by node, keeping r's value.
+func (r role) elect(node string, status status, time LamportTime, election string) role {
+	r.node = node
+	r.status = status
+	r.time = time
+	r.election = election
+	return r
 }
 
 type status int
@@ -60,83 +77,170 @@ func (s status) confirmed(other status) bool {
 	return false
 }
 
-func (p *Polity) vote(q *serf.Query) {
-	var err error
-	var candidate, r string
-	fmt.Sscan(string(q.Payload), &candidate, &r)
+// parseElection splits an election request into its candidate, election ID and
+// roles.
+func parseElection(payload []byte) (candidate, election string, roles []string, err error) {
+	fields := strings.Fields(string(payload))
+	if len(fields) < 3 {
+		return "", "", nil, fmt.Errorf("malformed election %s", strconv.Quote(string(payload)))
+	}
+	return fields[0], fields[1], fields[2:], nil
+}
+
+func (p *Polity) vote(q *Query) {
+	candidate, election, roles, err := parseElection(q.Payload)
+	if err != nil {
+		p.logger().Warn("error parsing election", logging.ErrorKey, err)
+		p.metrics.parseErrors.Inc("election")
+		return
+	}
+	l := p.logger().With(logging.RoleKey, strings.Join(roles, " "), logging.ElectionKey, election, logging.TermKey, q.LTime, "candidate", candidate)
 
 	p.voteMutex.Lock()
 	defer p.voteMutex.Unlock()
 
-	if existing, ok := p.roles[r]; ok && existing.status == confirmed && existing.node == candidate {
-		err = q.Respond([]byte(fmt.Sprintln("YES", candidate)))
-		p.roles[r] = role{candidate, running, q.LTime}
-	} else if ok && !existing.status.vacant() {
-		err = q.Respond([]byte(fmt.Sprintln("NO", existing.node)))
-		p.logf("%s: voting NO on %s for %s because %s has role with status %s", p.name, candidate, r, existing.node, existing.status)
-	} else {
-		err = q.Respond([]byte(fmt.Sprintln("YES", candidate)))
-		p.roles[r] = role{candidate, running, q.LTime}
+	response := fmt.Sprintln("YES", candidate)
+	votes := make(map[string]role, len(roles))
+	for _, r := range roles {
+		existing, ok := p.roles[r]
+		if ok && !existing.status.vacant() && !(existing.status == confirmed && existing.node == candidate) {
+			response = fmt.Sprintln("NO", existing.node)
+			l.Debug("voting no", "held", r, "holder", existing.node, "status", existing.status)
+			votes = nil
+			break
+		}
+		votes[r] = existing.elect(candidate, running, q.LTime, election)
 	}
 
+	if votes != nil {
+		err = p.setRoles(votes)
+	}
+
+	if err != nil {
+		// a vote that would be forgotten on restart must not be cast
+		response = fmt.Sprintln("NO", "-")
+		l.Error("voting no because the vote could not be persisted", logging.ErrorKey, err)
+	}
+
+	err = q.Respond([]byte(response))
 	if err != nil {
-		p.logf("%s", err)
+		l.Warn("error responding to election", logging.ErrorKey, err)
 	}
 }
 
-func (p *Polity) confirmElection(q *serf.Query) {
-	var candidate, r string
-	fmt.Sscan(string(q.Payload), &candidate, &r)
+func (p *Polity) confirmElection(q *Query) {
+	candidate, election, roles, err := parseElection(q.Payload)
+	if err != nil {
+		p.logger().Warn("error parsing election", logging.ErrorKey, err)
+		p.metrics.parseErrors.Inc("election")
+		return
+	}
+	l := p.logger().With(logging.RoleKey, strings.Join(roles, " "), logging.ElectionKey, election, logging.TermKey, q.LTime, "candidate", candidate)
 
 	p.voteMutex.Lock()
 	defer p.voteMutex.Unlock()
 
-	p.roles[r] = role{candidate, confirmed, q.LTime}
-	err := q.Respond([]byte{})
+	confirmations := make(map[string]role, len(roles))
+	for _, r := range roles {
+		confirmations[r] = p.roles[r].elect(candidate, confirmed, q.LTime, election)
+	}
 
+	err = p.setRoles(confirmations)
 	if err != nil {
-		p.logf("%s: error confirming election: %s", p.name, err)
+		l.Error("error persisting confirmation", logging.ErrorKey, err)
+		return
+	}
+
+	err = q.Respond([]byte{})
+	if err != nil {
+		l.Warn("error confirming election", logging.ErrorKey, err)
+	}
+}
+
+// withdraw releases the votes cast for a candidate in an election it lost.
+// Only votes from that election are released, so a delayed withdrawal cannot
+// undo a vote in a later one.
+func (p *Polity) withdraw(e UserEvent) {
+	candidate, election, roles, err := parseElection(e.Payload)
+	if err != nil {
+		p.logger().Warn("error parsing withdrawal", logging.ErrorKey, err)
+		p.metrics.parseErrors.Inc("withdrawal")
+		return
+	}
+
+	p.voteMutex.Lock()
+	defer p.voteMutex.Unlock()
+
+	withdrawn := make(map[string]role)
+	for _, r := range roles {
+		if existing, ok := p.roles[r]; ok && existing.status == running && existing.node == candidate && existing.election == election {
+			existing.status = recalled
+			existing.time = e.LTime
+			withdrawn[r] = existing
+		}
+	}
+
+	if err := p.setRoles(withdrawn); err != nil {
+		p.logger().Error("error persisting withdrawal", logging.RoleKey, strings.Join(roles, " "), logging.ElectionKey, election, logging.ErrorKey, err)
 	}
 }
 
-func (p *Polity) voteRecall(q *serf.Query) {
+func (p *Polity) voteRecall(q *Query) {
 	var err error
-	r := string(q.Payload)
+	roles := strings.Fields(string(q.Payload))
 
 	p.voteMutex.Lock()
 	defer p.voteMutex.Unlock()
 
-	if existing, ok := p.roles[r]; ok {
-		err = q.Respond([]byte(fmt.Sprintln("YES", existing.node)))
-		existing.status = impeached
-		existing.time = q.LTime
-		p.roles[r] = existing
-	} else {
-		err = q.Respond([]byte(fmt.Sprintln("YES", "-")))
+	holder := "-"
+	impeachments := make(map[string]role)
+	for _, r := range roles {
+		if existing, ok := p.roles[r]; ok {
+			if holder == "-" {
+				holder = existing.node
+			}
+			existing.status = impeached
+			existing.time = q.LTime
+			impeachments[r] = existing
+		}
 	}
 
+	if err = p.setRoles(impeachments); err != nil {
+		p.logger().Error("error persisting impeachment", logging.RoleKey, strings.Join(roles, " "), logging.TermKey, q.LTime, logging.ErrorKey, err)
+		return
+	}
+
+	err = q.Respond([]byte(fmt.Sprintln("YES", holder)))
 	if err != nil {
-		p.logf("%s: %s", p.name, err)
+		p.logger().Warn("error responding to recall", logging.RoleKey, strings.Join(roles, " "), logging.ErrorKey, err)
 	}
 
 }
 
-func (p *Polity) confirmRecall(q *serf.Query) {
-	r := string(q.Payload)
+func (p *Polity) confirmRecall(q *Query) {
+	roles := strings.Fields(string(q.Payload))
 
 	p.voteMutex.Lock()
 	defer p.voteMutex.Unlock()
 
-	if existing, ok := p.roles[r]; ok {
-		existing.status = recalled
-		existing.time = q.LTime
-		p.roles[r] = existing
+	recalls := make(map[string]role)
+	for _, r := range roles {
+		if existing, ok := p.roles[r]; ok {
+			existing.status = recalled
+			existing.time = q.LTime
+			recalls[r] = existing
+		}
+	}
+
+	if err := p.setRoles(recalls); err != nil {
+		p.logger().Error("error persisting recall", logging.RoleKey, strings.Join(roles, " "), logging.TermKey, q.LTime, logging.ErrorKey, err)
+		return
 	}
 
 	q.Respond(nil)
 }
 
-func (p *Polity) query(q *serf.Query) {
+func (p *Polity) query(q *Query) {
 	var err error
 	var role string
 	fmt.Sscan(string(q.Payload), &role)
@@ -145,12 +249,12 @@ func (p *Polity) query(q *serf.Query) {
 	defer p.voteMutex.Unlock()
 
 	if existing, ok := p.roles[role]; ok {
-		err = q.Respond([]byte(fmt.Sprintf("%s %d %d", existing.node, existing.status, existing.time)))
+		err = q.Respond([]byte(fmt.Sprintf("%s %d %d %d %s", existing.node, existing.status, existing.time, existing.version, encodeValue(existing.value))))
 	} else {
-		err = q.Respond([]byte(fmt.Sprintln("-", invalid, q.LTime)))
+		err = q.Respond([]byte(fmt.Sprintf("- %d %d 0 -", invalid, q.LTime)))
 	}
 
 	if err != nil {
-		p.logf("%s", err)
+		p.logger().Warn("error responding to query", logging.RoleKey, role, logging.ErrorKey, err)
 	}
 }
@@ -0,0 +1,309 @@
+package polity
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/shipwire/ansqd/internal/logging"
+)
+
+const (
+	storeFile   = "polity.roles.json"
+	journalFile = "polity.roles.journal"
+)
+
+// journalLimit is the number of journal entries after which the role table is
+// written out in full and the journal started afresh.
+const journalLimit = 1000
+
+// store persists the role table to a file so that a restarted node remembers the
+// votes it has cast and the roles it has confirmed. A running entry is this
+// node's vote for a candidate, recorded with the Lamport time of the election,
+// so persisting the table also persists the vote. A nil store persists nothing.
+//
+// Each change is appended to a journal as a single line holding the changed
+// roles, so that a vote costs one small write rather than a rewrite of the whole
+// table. Once the journal grows long the table is written out in full and the
+// journal removed. Every change is journaled and each entry holds the roles'
+// full state, so replaying a journal that survived a crash during that step
+// over the table it was folded into changes nothing.
+type store struct {
+	path    string
+	journal string
+	entries int
+}
+
+type storedRole struct {
+	Node     string      `json:"node"`
+	Status   status      `json:"status"`
+	Time     LamportTime `json:"time"`
+	Election string      `json:"election,omitempty"`
+	Value    []byte      `json:"value,omitempty"`
+	Version  uint64      `json:"version,omitempty"`
+}
+
+func storeRole(r role) storedRole {
+	return storedRole{r.node, r.status, r.time, r.election, r.value, r.version}
+}
+
+func (r storedRole) role() role {
+	return role{node: r.Node, status: r.Status, time: r.Time, election: r.Election, value: r.Value, version: r.Version}
+}
+
+// openStore creates dir if needed and returns a store for the role table kept
+// within it. An empty dir disables persistence.
+func openStore(dir string) (*store, error) {
+	if dir == "" {
+		return nil, nil
+	}
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	return &store{path: filepath.Join(dir, storeFile), journal: filepath.Join(dir, journalFile)}, nil
+}
+
+// load reads the role table and replays the journal over it, returning an empty
+// table if none has been saved. A last journal entry that was only partly
+// written is ignored, since the change it held was never acknowledged.
+func (s *store) load() (map[string]role, error) {
+	roles := make(map[string]role)
+	if s == nil {
+		return roles, nil
+	}
+
+	b, err := ioutil.ReadFile(s.path)
+	if err == nil {
+		stored := map[string]storedRole{}
+		err = json.Unmarshal(b, &stored)
+		if err != nil {
+			return nil, err
+		}
+		for name, r := range stored {
+			roles[name] = r.role()
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	b, err = ioutil.ReadFile(s.journal)
+	if os.IsNotExist(err) {
+		return roles, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	lines := bytes.Split(b, []byte("\n"))
+	for i, line := range lines {
+		if len(line) == 0 {
+			continue
+		}
+		entry := map[string]storedRole{}
+		err = json.Unmarshal(line, &entry)
+		if err != nil && i == len(lines)-1 {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("journal entry %d: %s", i+1, err)
+		}
+		for name, r := range entry {
+			roles[name] = r.role()
+		}
+		s.entries++
+	}
+	return roles, nil
+}
+
+// append durably records changed in the journal. If the entry cannot be
+// written in full, the journal is cut back to where it was.
+func (s *store) append(changed map[string]role) error {
+	if s == nil {
+		return nil
+	}
+
+	entry := make(map[string]storedRole, len(changed))
+	for name, r := range changed {
+		entry[name] = storeRole(r)
+	}
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(s.journal, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	_, err = f.Write(append(b, '\n'))
+	if err == nil {
+		err = f.Sync()
+	}
+	if err != nil {
+		f.Truncate(info.Size())
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	// a new journal is only durable once its directory entry is
+	if info.Size() == 0 {
+		err = syncDir(s.journal)
+		if err != nil {
+			return err
+		}
+	}
+	s.entries++
+	return nil
+}
+
+// full tests whether the journal has grown long enough to be folded into the
+// stored table.
+func (s *store) full() bool {
+	return s != nil && s.entries >= journalLimit
+}
+
+// save atomically replaces the stored role table with roles and removes the
+// journal. The new table is fsync'd before it is renamed into place, and the
+// directory afterwards.
+func (s *store) save(roles map[string]role) error {
+	if s == nil {
+		return nil
+	}
+
+	stored := make(map[string]storedRole, len(roles))
+	for name, r := range roles {
+		stored[name] = storeRole(r)
+	}
+
+	b, err := json.Marshal(stored)
+	if err != nil {
+		return err
+	}
+
+	tmp := s.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(b)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(tmp, s.path)
+	if err != nil {
+		return err
+	}
+	err = syncDir(s.path)
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(s.journal)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	s.entries = 0
+	return nil
+}
+
+// syncDir fsyncs the directory holding path.
+func syncDir(path string) error {
+	dir, err := os.Open(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+// setRole records r in the role table and persists it. If it cannot be persisted
+// the previous entry is restored. The caller must hold voteMutex.
+func (p *Polity) setRole(name string, r role) error {
+	return p.setRoles(map[string]role{name: r})
+}
+
+// setRoles records several roles in the role table and persists them together,
+// so that either all of them or none of them survive a restart. If they cannot be
+// persisted the previous entries are restored. The caller must hold voteMutex.
+func (p *Polity) setRoles(roles map[string]role) error {
+	if len(roles) == 0 {
+		return nil
+	}
+
+	prev := make(map[string]role, len(roles))
+	for name, r := range roles {
+		if existing, had := p.roles[name]; had {
+			prev[name] = existing
+		}
+		p.roles[name] = r
+	}
+
+	err := p.store.append(roles)
+	if err != nil {
+		for name := range roles {
+			if existing, had := prev[name]; had {
+				p.roles[name] = existing
+			} else {
+				delete(p.roles, name)
+			}
+		}
+		return err
+	}
+
+	p.compact()
+
+	for name := range roles {
+		p.notify(name)
+	}
+	return nil
+}
+
+// persist saves the named roles after changes made outside of setRole. The
+// caller must hold voteMutex.
+func (p *Polity) persist(names []string) {
+	if len(names) == 0 {
+		return
+	}
+
+	changed := make(map[string]role, len(names))
+	for _, name := range names {
+		changed[name] = p.roles[name]
+	}
+	err := p.store.append(changed)
+	if err != nil {
+		p.logger().Error("error persisting roles", logging.ErrorKey, err)
+		return
+	}
+	p.compact()
+}
+
+// compact writes out the role table in full once the journal has grown long.
+// A failure leaves the journal to grow, so it is only logged. The caller must
+// hold voteMutex.
+func (p *Polity) compact() {
+	if !p.store.full() {
+		return
+	}
+	err := p.store.save(p.roles)
+	if err != nil {
+		p.logger().Error("error compacting role journal", logging.ErrorKey, err)
+	}
+}
@@ -0,0 +1,173 @@
+package polity
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/shipwire/ansqd/internal/logging"
+)
+
+// syncChunkSize bounds the size of a single sync response so that it fits within
+// serf's default query response size limit.
+const syncChunkSize = 768
+
+// syncMore terminates a sync response that was truncated at syncChunkSize.
+const syncMore = "+"
+
+// requestSync schedules an anti-entropy exchange of role tables. Requests made
+// while one is already pending are coalesced.
+func (p *Polity) requestSync() {
+	select {
+	case p.syncCh <- struct{}{}:
+	default:
+	}
+}
+
+func (p *Polity) syncLoop() {
+	for {
+		select {
+		case <-p.syncCh:
+			err := p.syncRoles()
+			if err != nil {
+				p.logger().Warn("error syncing roles", logging.ErrorKey, err)
+			}
+		case <-p.t.ShutdownCh():
+			return
+		}
+	}
+}
+
+// syncRoles asks every peer for its role table and merges the answers into the
+// local one. Peers answer in pages; the next page begins after the smallest
+// role any truncated response ended on, so nothing is skipped.
+func (p *Polity) syncRoles() error {
+	cursor := "-"
+	for {
+		qr, err := p.t.Query(syncQuery, []byte(cursor), 5*time.Second)
+		if err != nil {
+			return err
+		}
+
+		next := ""
+		for rsp := range qr.ResponseCh() {
+			last, more := p.mergeDigest(rsp.Payload)
+			if more && last == "" {
+				p.logger().Warn("sync response truncated before its first role", "from", rsp.From, "cursor", cursor)
+				continue
+			}
+			if more && (next == "" || last < next) {
+				next = last
+			}
+		}
+
+		if next == "" {
+			return nil
+		}
+		cursor = next
+	}
+}
+
+// mergeDigest merges a sync response into the local role table. It returns the
+// last role in the response and whether the responder had more to send.
+func (p *Polity) mergeDigest(payload []byte) (last string, more bool) {
+	p.voteMutex.Lock()
+	defer p.voteMutex.Unlock()
+
+	changed := []string{}
+	for _, line := range strings.Split(string(payload), "\n") {
+		if line == "" {
+			continue
+		}
+		if line == syncMore {
+			more = true
+			continue
+		}
+
+		var node, r string
+		var status status
+		var time LamportTime
+
+		_, err := fmt.Sscan(line, &node, &r, &status, &time)
+		if err != nil {
+			p.logger().Warn("error parsing sync response", logging.ErrorKey, err, "line", strconv.Quote(line))
+			p.metrics.parseErrors.Inc("sync")
+			continue
+		}
+
+		if p.mergeRole(r, role{node: node, status: status, time: time}) {
+			changed = append(changed, r)
+		}
+		last = r
+	}
+	p.persist(changed)
+	return last, more
+}
+
+// syncDigest answers a sync request with the local role table, beginning after
+// the role named in the request. Running entries are only this node's promise to
+// a candidate and are left out.
+func (p *Polity) syncDigest(q *Query) {
+	cursor := string(q.Payload)
+
+	p.voteMutex.Lock()
+	names := make([]string, 0, len(p.roles))
+	for name, r := range p.roles {
+		if r.status == running {
+			continue
+		}
+		if cursor == "-" || name > cursor {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	buf := &bytes.Buffer{}
+	for _, name := range names {
+		r := p.roles[name]
+		line := fmt.Sprintf("%s %s %d %d\n", r.node, name, r.status, r.time)
+		if len(line)+len(syncMore) > syncChunkSize {
+			// it could never be sent, and would end paging for the requester
+			p.logger().Warn("role too large to sync", logging.RoleKey, name, "size", len(line))
+			continue
+		}
+		if buf.Len()+len(line)+len(syncMore) > syncChunkSize {
+			buf.WriteString(syncMore)
+			break
+		}
+		buf.WriteString(line)
+	}
+	p.voteMutex.Unlock()
+
+	err := q.Respond(buf.Bytes())
+	if err != nil {
+		p.logger().Warn("error responding to sync", logging.ErrorKey, err)
+	}
+}
+
+// mergeRole folds what a peer knows about a role into the local table. Unknown
+// roles are adopted outright. A known role is only advanced along its own
+// lifecycle, as judged by status.confirmed, unless the local entry is vacant and
+// the peer's entry is later in Lamport time, in which case the peer's is taken.
+// It reports whether the local entry changed. The caller must hold voteMutex and
+// persist the changed roles afterwards.
+func (p *Polity) mergeRole(name string, incoming role) bool {
+	existing, ok := p.roles[name]
+	switch {
+	case !ok:
+		p.roles[name] = incoming
+	case existing.node == incoming.node && existing.status.confirmed(incoming.status):
+		existing.time = incoming.time
+		existing.status = incoming.status
+		p.roles[name] = existing
+	case existing.status.vacant() && (&LamportWindow{existing.time, existing.time}).After(incoming.time):
+		p.roles[name] = existing.elect(incoming.node, incoming.status, incoming.time, incoming.election)
+	default:
+		return false
+	}
+	p.notify(name)
+	return true
+}
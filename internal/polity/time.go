@@ -1,14 +1,15 @@
 package polity
 
-import "github.com/hashicorp/serf/serf"
+// LamportTime is a logical clock value as delivered by a Transport.
+type LamportTime uint64
 
 // LamportWindow is an interval of Lamport Times.
 type LamportWindow struct {
-	earliest, latest serf.LamportTime
+	earliest, latest LamportTime
 }
 
 // Witness grows l to encompass other.
-func (l *LamportWindow) Witness(other serf.LamportTime) {
+func (l *LamportWindow) Witness(other LamportTime) {
 	if l.earliest > other {
 		l.earliest = other
 	}
@@ -18,11 +19,11 @@ func (l *LamportWindow) Witness(other serf.LamportTime) {
 }
 
 // Before tests if t is before l.
-func (l *LamportWindow) Before(t serf.LamportTime) bool {
+func (l *LamportWindow) Before(t LamportTime) bool {
 	return t < l.earliest
 }
 
 // After tests if t is after l.
-func (l *LamportWindow) After(t serf.LamportTime) bool {
+func (l *LamportWindow) After(t LamportTime) bool {
 	return t > l.latest
 }
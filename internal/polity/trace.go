@@ -0,0 +1,208 @@
+package polity
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"strings"
+	"sync"
+	"time"
+)
+
+// traceMarker begins the trace context carried at the front of a traced query's
+// payload.
+const traceMarker = "@"
+
+// Span records one step of an election, recall or query. On the candidate a
+// span covers the whole operation, with a child span for each round of queries
+// that notes when each peer responded. On a voter a span covers the handling of
+// one query and is a child of the round that sent it.
+type Span struct {
+	TraceID  string
+	SpanID   string
+	ParentID string
+
+	Name       string
+	Node       string
+	Start, End time.Time
+	Attributes map[string]string
+	Events     []SpanEvent
+
+	// Error is the error the operation ended with, if any.
+	Error string
+}
+
+// SpanEvent is something that happened during a span, such as a response from a
+// peer.
+type SpanEvent struct {
+	Name       string
+	Time       time.Time
+	Attributes map[string]string
+}
+
+// SpanExporter receives spans as they finish. ExportSpan may be called from many
+// goroutines at once.
+type SpanExporter interface {
+	ExportSpan(Span)
+}
+
+// MemoryExporter keeps finished spans in memory. It is intended for tests.
+type MemoryExporter struct {
+	mu    sync.Mutex
+	spans []Span
+}
+
+// NewMemoryExporter creates an empty MemoryExporter.
+func NewMemoryExporter() *MemoryExporter {
+	return &MemoryExporter{}
+}
+
+// ExportSpan records s.
+func (e *MemoryExporter) ExportSpan(s Span) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.spans = append(e.spans, s)
+}
+
+// Spans returns the spans recorded so far, in the order they finished.
+func (e *MemoryExporter) Spans() []Span {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	return append([]Span(nil), e.spans...)
+}
+
+// spanContext identifies a span to the peers taking part in it.
+type spanContext struct {
+	traceID, spanID string
+}
+
+// activeSpan is a span that has not yet finished.
+type activeSpan struct {
+	p  *Polity
+	mu sync.Mutex
+	s  Span
+}
+
+// startSpan begins a span. A span without a parent begins a new trace.
+func (p *Polity) startSpan(name string, parent spanContext) *activeSpan {
+	traceID := parent.traceID
+	if traceID == "" {
+		traceID = newTraceID(16)
+	}
+	return &activeSpan{
+		p: p,
+		s: Span{
+			TraceID:    traceID,
+			SpanID:     newTraceID(8),
+			ParentID:   parent.spanID,
+			Name:       name,
+			Node:       p.name,
+			Start:      time.Now(),
+			Attributes: make(map[string]string),
+		},
+	}
+}
+
+// child begins a span within s.
+func (s *activeSpan) child(name string) *activeSpan {
+	return s.p.startSpan(name, s.context())
+}
+
+func (s *activeSpan) context() spanContext {
+	return spanContext{s.s.TraceID, s.s.SpanID}
+}
+
+// set records an attribute of the span.
+func (s *activeSpan) set(key, value string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.s.Attributes[key] = value
+}
+
+// event records that something happened now. attributes are given as
+// alternating keys and values.
+func (s *activeSpan) event(name string, attributes ...string) {
+	e := SpanEvent{
+		Name:       name,
+		Time:       time.Now(),
+		Attributes: make(map[string]string, len(attributes)/2),
+	}
+	for i := 0; i+1 < len(attributes); i += 2 {
+		e.Attributes[attributes[i]] = attributes[i+1]
+	}
+	e.Attributes["elapsed"] = e.Time.Sub(s.s.Start).String()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.s.Events = append(s.s.Events, e)
+}
+
+// finish ends the span and hands it to the polity's exporter, if it has one.
+func (s *activeSpan) finish(err error) {
+	s.mu.Lock()
+	s.s.End = time.Now()
+	if err != nil {
+		s.s.Error = err.Error()
+	}
+	span := s.s
+	s.mu.Unlock()
+
+	if s.p.Exporter != nil {
+		s.p.Exporter.ExportSpan(span)
+	}
+}
+
+// traced handles a query within a span that continues the trace carried in its
+// payload. The trace context is removed before handler sees the payload.
+func (p *Polity) traced(q *Query, name string, handler func(*Query)) {
+	sc, payload := splitTrace(q.Payload)
+	q.Payload = payload
+
+	span := p.startSpan(name, sc)
+	span.set("payload", string(payload))
+	handler(q)
+	span.finish(nil)
+}
+
+// withTrace prefixes payload with the trace context sc.
+func withTrace(sc spanContext, payload []byte) []byte {
+	prefix := traceMarker + sc.traceID + ":" + sc.spanID + " "
+	return append([]byte(prefix), payload...)
+}
+
+// splitTrace separates the trace context from the rest of a traced payload. A
+// payload without one yields an empty context.
+func splitTrace(payload []byte) (spanContext, []byte) {
+	if !bytes.HasPrefix(payload, []byte(traceMarker)) {
+		return spanContext{}, payload
+	}
+
+	end := bytes.IndexByte(payload, ' ')
+	if end < 0 {
+		end = len(payload)
+	}
+	ids := strings.SplitN(string(payload[len(traceMarker):end]), ":", 2)
+
+	rest := payload[end:]
+	if len(rest) > 0 {
+		rest = rest[1:]
+	}
+	if len(ids) != 2 {
+		return spanContext{}, rest
+	}
+	return spanContext{ids[0], ids[1]}, rest
+}
+
+// newTraceID generates a random identifier of n bytes.
+func newTraceID(n int) string {
+	b := make([]byte, n)
+	_, err := rand.Read(b)
+	if err != nil {
+		return strings.Repeat("0", 2*n)
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,98 @@
+package polity
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrTransportShutdown is returned when sending over a transport that has stopped.
+var ErrTransportShutdown = errors.New("transport is shut down")
+
+// Transport carries a polity's messages between the members of a cluster.
+type Transport interface {
+	// LocalName returns the name of the local member.
+	LocalName() string
+
+	// NumMembers returns the number of members in the cluster, including the
+	// local member.
+	NumMembers() int
+
+	// Members lists the members of the cluster, including the local member.
+	Members() []Member
+
+	// Query sends a request to every member, including the local member, and
+	// collects their responses until timeout.
+	Query(name string, payload []byte, timeout time.Duration) (QueryResponse, error)
+
+	// Broadcast sends an event to every member, including the local member,
+	// without waiting for responses.
+	Broadcast(name string, payload []byte) error
+
+	// Events delivers queries, broadcasts and membership changes from the cluster.
+	// Its values are *Query, UserEvent and MemberJoin.
+	Events() <-chan Event
+
+	// ShutdownCh is closed when the transport stops.
+	ShutdownCh() <-chan struct{}
+}
+
+// QueryResponse collects the responses to a query.
+type QueryResponse interface {
+	// ResponseCh delivers responses as they arrive. It is closed when the query
+	// finishes.
+	ResponseCh() <-chan NodeResponse
+
+	// Finished tests whether the query has timed out or been closed.
+	Finished() bool
+
+	// Close stops collecting responses.
+	Close()
+}
+
+// NodeResponse is a single member's response to a query.
+type NodeResponse struct {
+	From    string
+	Payload []byte
+}
+
+// Event is an occurrence delivered by a Transport.
+type Event interface{}
+
+// Query is a request from a member that expects a response.
+type Query struct {
+	Name    string
+	Payload []byte
+	LTime   LamportTime
+
+	respond func([]byte) error
+}
+
+// Respond sends a response to the member that sent q.
+func (q *Query) Respond(b []byte) error {
+	return q.respond(b)
+}
+
+// UserEvent is an event broadcast by a member.
+type UserEvent struct {
+	Name    string
+	Payload []byte
+	LTime   LamportTime
+
+	// From is the member that signed the event. It is empty unless the
+	// transport authenticates its members.
+	From string
+}
+
+// Member is a member of the cluster.
+type Member struct {
+	Name string
+	Tags map[string]string
+
+	// Alive is false once the member is known to have failed.
+	Alive bool
+}
+
+// MemberJoin reports that members have joined the cluster.
+type MemberJoin struct {
+	Members []string
+}
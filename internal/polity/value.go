@@ -0,0 +1,155 @@
+package polity
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/shipwire/ansqd/internal/logging"
+)
+
+const (
+	// MaxValueSize is the largest value that may be attached to a role. Values
+	// travel in single queries, which must fit in a gossip message.
+	MaxValueSize = 512
+
+	valueWriteAttempts = 3
+)
+
+// SetValue replaces the value attached to a role held by the local node. The
+// write succeeds once a quorum of nodes has accepted it, and is then seen by
+// QueryRoleInfo on any node. A write that fails may still have been accepted
+// by some nodes.
+//
+// Values outlive their holders: a node elected to a role inherits whatever
+// value the previous holder left.
+func (p *Polity) SetValue(role string, value []byte) error {
+	if len(value) > MaxValueSize {
+		return ErrValueTooLarge
+	}
+
+	current, ok := p.lookup(role)
+	if !ok || current.node != p.name || current.status != confirmed {
+		return ErrNotHolder
+	}
+
+	version := current.version + 1
+	for attempt := 0; attempt < valueWriteAttempts; attempt++ {
+		newest, err := p.runValueWrite(role, version, value)
+		if err != ErrWriteFailed || newest < version {
+			return err
+		}
+		// a previous holder wrote a version this node has not seen
+		version = newest + 1
+	}
+	return ErrWriteFailed
+}
+
+// runValueWrite asks the cluster to accept version of a role's value. If the
+// write is not accepted by a quorum it returns ErrWriteFailed along with the
+// newest version reported by a node that rejected it.
+func (p *Polity) runValueWrite(role string, version uint64, value []byte) (uint64, error) {
+	votesRequired := p.QuorumFunc(3)
+	accepted := 0
+	var newest uint64
+
+	request := fmt.Sprintf("%s %s %d %s", p.name, role, version, encodeValue(value))
+	qr, err := p.t.Query(valueWrite, []byte(request), 5*time.Second)
+	if err != nil {
+		return 0, err
+	}
+	defer qr.Close()
+
+	for rsp := range qr.ResponseCh() {
+		var vote string
+		var current uint64
+		population := p.population()
+
+		_, err := fmt.Sscan(string(rsp.Payload), &vote, &current)
+		if err != nil {
+			p.logger().Warn("error parsing write response", logging.RoleKey, role, "from", rsp.From, logging.ErrorKey, err, "payload", strconv.Quote(string(rsp.Payload)))
+			p.metrics.parseErrors.Inc("value")
+			continue
+		}
+
+		if newVotesRequired := p.QuorumFunc(population); newVotesRequired > votesRequired {
+			votesRequired = newVotesRequired
+		}
+
+		if vote == yes {
+			accepted++
+		} else if current > newest {
+			newest = current
+		}
+
+		if accepted >= votesRequired {
+			return version, nil
+		}
+	}
+
+	p.logger().Debug("counted write acceptances", logging.RoleKey, role, "accepted", accepted, "required", votesRequired)
+	return newest, ErrWriteFailed
+}
+
+// writeValue accepts a write from the confirmed holder of a role if it is newer
+// than the value already known. Repeating the latest write is accepted as well.
+func (p *Polity) writeValue(q *Query) {
+	var holder, r, encoded string
+	var version uint64
+	_, err := fmt.Sscan(string(q.Payload), &holder, &r, &version, &encoded)
+	if err != nil {
+		p.logger().Warn("error parsing value write", logging.ErrorKey, err, "payload", strconv.Quote(string(q.Payload)))
+		p.metrics.parseErrors.Inc("value")
+		return
+	}
+	value, err := decodeValue(encoded)
+	if err != nil {
+		p.logger().Warn("error decoding value", logging.RoleKey, r, logging.ErrorKey, err)
+		p.metrics.parseErrors.Inc("value")
+		return
+	}
+
+	p.voteMutex.Lock()
+	defer p.voteMutex.Unlock()
+
+	existing, ok := p.roles[r]
+	response := fmt.Sprintln(yes, version)
+	switch {
+	case !ok || existing.node != holder || existing.status != confirmed:
+		response = fmt.Sprintln(no, existing.version)
+		p.logger().Info("rejecting write from non-holder", logging.RoleKey, r, "from", holder)
+	case version == existing.version && bytes.Equal(value, existing.value):
+	case version <= existing.version:
+		response = fmt.Sprintln(no, existing.version)
+		p.logger().Info("rejecting stale write", logging.RoleKey, r, "version", version, "current", existing.version)
+	default:
+		existing.value = value
+		existing.version = version
+		if err := p.setRole(r, existing); err != nil {
+			response = fmt.Sprintln(no, "0")
+			p.logger().Error("rejecting write that could not be persisted", logging.RoleKey, r, logging.ErrorKey, err)
+		}
+	}
+
+	err = q.Respond([]byte(response))
+	if err != nil {
+		p.logger().Warn("error responding to value write", logging.RoleKey, r, logging.ErrorKey, err)
+	}
+}
+
+// encodeValue formats a value as a single token for a query payload.
+func encodeValue(value []byte) string {
+	if len(value) == 0 {
+		return "-"
+	}
+	return base64.StdEncoding.EncodeToString(value)
+}
+
+func decodeValue(encoded string) ([]byte, error) {
+	if encoded == "-" {
+		return nil, nil
+	}
+	return base64.StdEncoding.DecodeString(encoded)
+}
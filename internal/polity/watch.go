@@ -0,0 +1,59 @@
+package polity
+
+// Watch returns a channel that is closed the next time the local node's view of
+// any of roles changes.
+func (p *Polity) Watch(roles ...string) <-chan struct{} {
+	ch := make(chan struct{})
+
+	p.voteMutex.Lock()
+	defer p.voteMutex.Unlock()
+
+	for _, role := range roles {
+		p.watchers[role] = append(p.watchers[role], ch)
+	}
+	return ch
+}
+
+// unwatch stops watching roles on a channel returned by Watch, for watchers that
+// give up before it is closed.
+func (p *Polity) unwatch(ch <-chan struct{}, roles ...string) {
+	p.voteMutex.Lock()
+	defer p.voteMutex.Unlock()
+
+	for _, role := range roles {
+		watchers := p.watchers[role]
+		for i, w := range watchers {
+			if w == ch {
+				watchers = append(watchers[:i], watchers[i+1:]...)
+				break
+			}
+		}
+		if len(watchers) == 0 {
+			delete(p.watchers, role)
+		} else {
+			p.watchers[role] = watchers
+		}
+	}
+}
+
+// notify wakes everything watching name. The caller must hold voteMutex.
+func (p *Polity) notify(name string) {
+	for _, ch := range p.watchers[name] {
+		select {
+		case <-ch:
+			// already woken through another role
+		default:
+			close(ch)
+		}
+	}
+	delete(p.watchers, name)
+}
+
+// lookup returns the local node's view of a role.
+func (p *Polity) lookup(name string) (role, bool) {
+	p.voteMutex.Lock()
+	defer p.voteMutex.Unlock()
+
+	r, ok := p.roles[name]
+	return r, ok
+}
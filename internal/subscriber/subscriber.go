@@ -0,0 +1,215 @@
+// Package subscriber consumes a channel of an nsqd topic over nsqd's TCP
+// protocol.
+//
+// It implements just enough of the protocol for ansqd to follow its peers'
+// audit topics: one subscription per connection, no feature negotiation, and
+// messages handled one at a time in the order they arrive. A message is
+// finished once its handler returns, or requeued at once if the handler
+// returns an error.
+package subscriber
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// Frame types, which prefix each frame nsqd sends.
+const (
+	frameTypeResponse int32 = 0
+	frameTypeError    int32 = 1
+	frameTypeMessage  int32 = 2
+)
+
+// heartbeat is the response nsqd sends to check that a client is still there.
+// Clients answer with NOP.
+const heartbeat = "_heartbeat_"
+
+// MaxFrameSize bounds the frames read from nsqd, so that a corrupt size does
+// not exhaust memory. It is well above nsqd's default --max-msg-size.
+const MaxFrameSize = 64 << 20
+
+// messageHeaderSize is the size of a message's timestamp, attempts and ID.
+const messageHeaderSize = 8 + 2 + 16
+
+// DialTimeout bounds connecting to nsqd and subscribing.
+var DialTimeout = 10 * time.Second
+
+// Message is a message delivered by nsqd.
+type Message struct {
+	ID [16]byte
+
+	// Timestamp is when the message was published, in nanoseconds since the
+	// epoch, by the clock of the nsqd it was published to.
+	Timestamp int64
+	Attempts  uint16
+	Body      []byte
+}
+
+// Handler processes a message. An error requeues it.
+type Handler func(*Message) error
+
+// Subscribe connects to the nsqd whose TCP listener is at addr, subscribes to
+// channel of topic and passes each message to h, allowing nsqd up to
+// maxInFlight messages ahead of h. It returns when the connection fails, or
+// with ctx's error once ctx is done.
+func Subscribe(ctx context.Context, addr, topic, channel string, maxInFlight int, h Handler) error {
+	d := net.Dialer{Timeout: DialTimeout}
+	nc, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer nc.Close()
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			nc.Close()
+		case <-done:
+		}
+	}()
+
+	c := &conn{r: bufio.NewReader(nc), w: bufio.NewWriter(nc)}
+	nc.SetDeadline(time.Now().Add(DialTimeout))
+	err = c.subscribe(topic, channel, maxInFlight)
+	if err == nil {
+		nc.SetDeadline(time.Time{})
+		err = c.consume(h)
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+type conn struct {
+	r *bufio.Reader
+	w *bufio.Writer
+}
+
+// subscribe sends the protocol magic and SUB, and once nsqd accepts the
+// subscription, RDY.
+func (c *conn) subscribe(topic, channel string, maxInFlight int) error {
+	err := c.send("  V2")
+	if err != nil {
+		return err
+	}
+	err = c.send(fmt.Sprintf("SUB %s %s\n", topic, channel))
+	if err != nil {
+		return err
+	}
+
+	frameType, data, err := c.readFrame()
+	if err != nil {
+		return err
+	}
+	if frameType == frameTypeError {
+		return fmt.Errorf("subscribing to %s/%s: %s", topic, channel, data)
+	}
+	if frameType != frameTypeResponse || string(data) != "OK" {
+		return fmt.Errorf("subscribing to %s/%s: unexpected response %q", topic, channel, data)
+	}
+
+	return c.send(fmt.Sprintf("RDY %d\n", maxInFlight))
+}
+
+// consume handles frames until the connection fails.
+func (c *conn) consume(h Handler) error {
+	for {
+		frameType, data, err := c.readFrame()
+		if err != nil {
+			return err
+		}
+
+		switch frameType {
+		case frameTypeResponse:
+			if string(data) == heartbeat {
+				err = c.send("NOP\n")
+			}
+		case frameTypeError:
+			// errors about a single message, such as finishing one that has
+			// timed out, leave the connection usable
+			if !recoverable(data) {
+				return fmt.Errorf("nsqd: %s", data)
+			}
+		case frameTypeMessage:
+			var m *Message
+			m, err = decodeMessage(data)
+			if err != nil {
+				return err
+			}
+			if h(m) != nil {
+				err = c.send(fmt.Sprintf("REQ %s 0\n", m.ID[:]))
+			} else {
+				err = c.send(fmt.Sprintf("FIN %s\n", m.ID[:]))
+			}
+		default:
+			return fmt.Errorf("unknown frame type %d", frameType)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// recoverable tests whether an error frame leaves the connection open.
+func recoverable(data []byte) bool {
+	for _, prefix := range []string{"E_FIN_FAILED", "E_REQ_FAILED", "E_TOUCH_FAILED"} {
+		if len(data) >= len(prefix) && string(data[:len(prefix)]) == prefix {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *conn) send(cmd string) error {
+	_, err := c.w.WriteString(cmd)
+	if err != nil {
+		return err
+	}
+	return c.w.Flush()
+}
+
+// readFrame reads a frame: its size, which counts the type, then its type and
+// data.
+func (c *conn) readFrame() (int32, []byte, error) {
+	var size int32
+	err := binary.Read(c.r, binary.BigEndian, &size)
+	if err != nil {
+		return 0, nil, err
+	}
+	if size < 4 || size > MaxFrameSize {
+		return 0, nil, fmt.Errorf("invalid frame size %d", size)
+	}
+
+	frame := make([]byte, size)
+	_, err = io.ReadFull(c.r, frame)
+	if err != nil {
+		return 0, nil, err
+	}
+	return int32(binary.BigEndian.Uint32(frame)), frame[4:], nil
+}
+
+var errShortMessage = errors.New("message frame too short")
+
+// decodeMessage decodes the data of a message frame.
+func decodeMessage(data []byte) (*Message, error) {
+	if len(data) < messageHeaderSize {
+		return nil, errShortMessage
+	}
+
+	m := &Message{
+		Timestamp: int64(binary.BigEndian.Uint64(data)),
+		Attempts:  binary.BigEndian.Uint16(data[8:]),
+		Body:      data[messageHeaderSize:],
+	}
+	copy(m.ID[:], data[10:messageHeaderSize])
+	return m, nil
+}
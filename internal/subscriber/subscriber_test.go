@@ -0,0 +1,138 @@
+package subscriber
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// fakeNSQD accepts one subscriber on a listener and plays the nsqd side of the
+// protocol as the test directs.
+type fakeNSQD struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func (f *fakeNSQD) expect(line string) {
+	got, err := f.r.ReadString('\n')
+	if err != nil {
+		f.t.Fatal(err)
+	}
+	if got != line {
+		f.t.Fatalf("Expected %q, got %q", line, got)
+	}
+}
+
+func (f *fakeNSQD) frame(frameType int32, data []byte) {
+	buf := make([]byte, 8+len(data))
+	binary.BigEndian.PutUint32(buf, uint32(4+len(data)))
+	binary.BigEndian.PutUint32(buf[4:], uint32(frameType))
+	copy(buf[8:], data)
+	_, err := f.conn.Write(buf)
+	if err != nil {
+		f.t.Fatal(err)
+	}
+}
+
+func (f *fakeNSQD) message(id string, timestamp int64, body string) {
+	data := make([]byte, messageHeaderSize+len(body))
+	binary.BigEndian.PutUint64(data, uint64(timestamp))
+	binary.BigEndian.PutUint16(data[8:], 1)
+	copy(data[10:], id)
+	copy(data[messageHeaderSize:], body)
+	f.frame(frameTypeMessage, data)
+}
+
+func TestSubscribe(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	received := make(chan *Message, 2)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- Subscribe(ctx, l.Addr().String(), "audit.send", "ansqd-2", 10, func(m *Message) error {
+			received <- m
+			if string(m.Body) == "retry" {
+				return errors.New("retry")
+			}
+			return nil
+		})
+	}()
+
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	f := &fakeNSQD{t, conn, bufio.NewReader(conn)}
+
+	magic := make([]byte, 4)
+	_, err = io.ReadFull(f.r, magic)
+	if err != nil || string(magic) != "  V2" {
+		t.Fatalf("Expected the protocol magic, got %q %v", magic, err)
+	}
+	f.expect("SUB audit.send ansqd-2\n")
+	f.frame(frameTypeResponse, []byte("OK"))
+	f.expect("RDY 10\n")
+
+	f.frame(frameTypeResponse, []byte(heartbeat))
+	f.expect("NOP\n")
+
+	f.message("0123456789abcdef", 1e18, "record")
+	f.expect("FIN 0123456789abcdef\n")
+	m := <-received
+	if string(m.ID[:]) != "0123456789abcdef" || m.Timestamp != 1e18 || m.Attempts != 1 || string(m.Body) != "record" {
+		t.Fatalf("Unexpected message %+v", m)
+	}
+
+	f.frame(frameTypeError, []byte("E_FIN_FAILED FIN 0123456789abcdef failed"))
+	f.message("fedcba9876543210", 1e18, "retry")
+	f.expect("REQ fedcba9876543210 0\n")
+	<-received
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != context.Canceled {
+			t.Fatal("Expected the subscription to end with its context, got", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Subscription did not end with its context")
+	}
+}
+
+func TestSubscribeRefused(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		f := &fakeNSQD{t, conn, bufio.NewReader(conn)}
+		io.ReadFull(f.r, make([]byte, 4))
+		f.r.ReadString('\n')
+		f.frame(frameTypeError, []byte("E_BAD_TOPIC SUB topic name is not valid"))
+	}()
+
+	err = Subscribe(context.Background(), l.Addr().String(), "bad topic", "ansqd-2", 1, func(*Message) error { return nil })
+	if err == nil {
+		t.Fatal("Expected a refused subscription to fail")
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/serf/command/agent"
+	"github.com/hashicorp/serf/serf"
+)
+
+// keysResponse reports the result of a keyring operation across the cluster.
+type keysResponse struct {
+	Error    string            `json:"error,omitempty"`
+	NumNodes int               `json:"num_nodes"`
+	NumResp  int               `json:"num_resp"`
+	NumErr   int               `json:"num_err"`
+	Messages map[string]string `json:"messages,omitempty"`
+	Keys     map[string]int    `json:"keys,omitempty"`
+}
+
+// keysHandler drives serf's key manager. GET lists the keys installed across
+// the cluster; POST to /serf/keys/install, /serf/keys/use or /serf/keys/remove
+// with a key form value changes them. Since the keys are secret, only clients
+// on the loopback interface are served.
+func keysHandler(ag *agent.Agent) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !fromLocalHost(r) {
+			http.Error(w, "keys may only be managed from the local host", http.StatusForbidden)
+			return
+		}
+
+		var op func(string) (*serf.KeyResponse, error)
+		switch strings.TrimPrefix(r.URL.Path, "/serf/keys") {
+		case "", "/list":
+			if r.Method != "GET" {
+				http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			op = func(string) (*serf.KeyResponse, error) { return ag.ListKeys() }
+		case "/install":
+			op = ag.InstallKey
+		case "/use":
+			op = ag.UseKey
+		case "/remove":
+			op = ag.RemoveKey
+		default:
+			http.NotFound(w, r)
+			return
+		}
+
+		key := r.FormValue("key")
+		if r.Method != "GET" {
+			if r.Method != "POST" {
+				http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			if key == "" {
+				http.Error(w, "missing key", http.StatusBadRequest)
+				return
+			}
+		}
+
+		kr, err := op(key)
+		rsp := keysResponse{}
+		if kr != nil {
+			rsp = keysResponse{
+				NumNodes: kr.NumNodes,
+				NumResp:  kr.NumResp,
+				NumErr:   kr.NumErr,
+				Messages: kr.Messages,
+				Keys:     kr.Keys,
+			}
+		}
+		status := http.StatusOK
+		if err != nil {
+			rsp.Error = err.Error()
+			status = http.StatusInternalServerError
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(rsp)
+	})
+}
+
+// runKeys implements "ansqd keys", which manages the serf keyring of a running
+// ansqd through its admin API.
+func runKeys(args []string) int {
+	fs := flag.NewFlagSet("keys", flag.ExitOnError)
+	addr := fs.String("ansqd-http-address", "127.0.0.1:4155", "<addr>:<port> of the local ansqd's admin HTTP API")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: ansqd keys [--ansqd-http-address=<addr>:<port>] list|install <key>|use <key>|remove <key>")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	var rsp *http.Response
+	var err error
+	switch cmd := fs.Arg(0); {
+	case cmd == "list" && fs.NArg() == 1:
+		rsp, err = http.Get(fmt.Sprintf("http://%s/serf/keys", *addr))
+	case (cmd == "install" || cmd == "use" || cmd == "remove") && fs.NArg() == 2:
+		rsp, err = http.PostForm(fmt.Sprintf("http://%s/serf/keys/%s", *addr, cmd), url.Values{"key": {fs.Arg(1)}})
+	default:
+		fs.Usage()
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "ERROR:", err)
+		return 1
+	}
+	defer rsp.Body.Close()
+
+	var kr keysResponse
+	err = json.NewDecoder(rsp.Body).Decode(&kr)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "ERROR:", errors.New(rsp.Status))
+		return 1
+	}
+
+	keys := []string{}
+	for k := range kr.Keys {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Printf("%s  [%d/%d]\n", k, kr.Keys[k], kr.NumNodes)
+	}
+
+	nodes := []string{}
+	for node := range kr.Messages {
+		nodes = append(nodes, node)
+	}
+	sort.Strings(nodes)
+	for _, node := range nodes {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", node, kr.Messages[node])
+	}
+
+	if kr.Error != "" {
+		fmt.Fprintf(os.Stderr, "ERROR: %s (%d of %d nodes responded, %d failed)\n", kr.Error, kr.NumResp, kr.NumNodes, kr.NumErr)
+		return 1
+	}
+	return 0
+}
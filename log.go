@@ -0,0 +1,46 @@
+package main
+
+import (
+	"flag"
+	"os"
+
+	"github.com/shipwire/ansqd/internal/logging"
+)
+
+// logger is ansqd's root logger. The others log for one component each and
+// share its output and level.
+var (
+	logger    *logging.Logger
+	auditLog  *logging.Logger
+	httpLog   *logging.Logger
+	polityLog *logging.Logger
+	reloadLog *logging.Logger
+	serfLog   *logging.Logger
+)
+
+func init() {
+	setLogger(logging.New(os.Stderr, logging.Logfmt, logging.Info))
+}
+
+// setLogger replaces the root logger and those made from it.
+func setLogger(root *logging.Logger) {
+	logger = root
+	auditLog = root.With("component", "audit")
+	httpLog = root.With("component", "http")
+	polityLog = root.With("component", "polity")
+	reloadLog = root.With("component", "reload")
+	serfLog = root.With("component", "serf")
+}
+
+// resolveLogFormat reads the log format from cfg or --log-format.
+func resolveLogFormat(cfg map[string]interface{}) (logging.Format, error) {
+	set := false
+	flagSet.Visit(func(f *flag.Flag) { set = set || f.Name == "log-format" })
+
+	var format string
+	err := stringOption(&format, *logFormat)(cfgValue(cfg, "log_format", set))
+	if err != nil {
+		return logging.Logfmt, err
+	}
+	return logging.ParseFormat(format)
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/serf/command/agent"
+	"github.com/shipwire/ansqd/internal/logging"
+)
+
+// defaultLookupdPortOffset is the distance from nsqd's default TCP port to
+// serf's default gossip port. Every ansqd is assumed to gossip at its nsqd TCP
+// port plus the offset, so that peers can be found from their nsqd registration.
+const defaultLookupdPortOffset = 7946 - 4150
+
+// lookupdProducer is the part of an nsqlookupd producer ansqd uses.
+type lookupdProducer struct {
+	BroadcastAddress string `json:"broadcast_address"`
+	TCPPort          int    `json:"tcp_port"`
+}
+
+// lookupdHTTPAddress guesses the HTTP address of the nsqlookupd listening for
+// TCP on addr, which by default is at the next port.
+func lookupdHTTPAddress(addr string) (string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", err
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil {
+		return "", fmt.Errorf("invalid port %q", port)
+	}
+	return net.JoinHostPort(host, strconv.Itoa(p+1)), nil
+}
+
+// lookupdNodes lists the producers registered with the nsqlookupd at addr.
+func lookupdNodes(client *http.Client, addr string) ([]lookupdProducer, error) {
+	rsp, err := client.Get(fmt.Sprintf("http://%s/nodes", addr))
+	if err != nil {
+		return nil, err
+	}
+	defer rsp.Body.Close()
+
+	if rsp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s/nodes: %s", addr, rsp.Status)
+	}
+
+	// older nsqlookupds wrap their responses in a data field
+	var body struct {
+		Producers []lookupdProducer `json:"producers"`
+		Data      struct {
+			Producers []lookupdProducer `json:"producers"`
+		} `json:"data"`
+	}
+	err = json.NewDecoder(rsp.Body).Decode(&body)
+	if err != nil {
+		return nil, fmt.Errorf("%s/nodes: %s", addr, err)
+	}
+	return append(body.Producers, body.Data.Producers...), nil
+}
+
+// discoverSerfPeers asks each nsqlookupd for the nsqd producers registered with
+// it and returns their serf gossip addresses. An nsqlookupd that cannot be
+// reached is skipped unless none can be.
+func discoverSerfPeers(client *http.Client, lookupds []string, offset int) ([]string, error) {
+	seen := map[string]bool{}
+	peers := []string{}
+	var lastErr error
+	reached := 0
+
+	for _, addr := range lookupds {
+		producers, err := lookupdNodes(client, addr)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		reached++
+
+		for _, p := range producers {
+			if p.BroadcastAddress == "" || p.TCPPort == 0 {
+				continue
+			}
+			peer := net.JoinHostPort(p.BroadcastAddress, strconv.Itoa(p.TCPPort+offset))
+			if !seen[peer] {
+				seen[peer] = true
+				peers = append(peers, peer)
+			}
+		}
+	}
+
+	if reached == 0 && lastErr != nil {
+		return nil, lastErr
+	}
+	return peers, nil
+}
+
+// discoverJoin joins the serf members found through nsqlookupd, polling until
+// the local node has joined at least one other member.
+func (o *serfOptions) discoverJoin(ag *agent.Agent) {
+	client := &http.Client{Timeout: 5 * time.Second}
+	for {
+		if ag.Serf().NumNodes() > 1 {
+			return
+		}
+
+		peers, err := discoverSerfPeers(client, o.LookupdHTTPAddresses, o.LookupdPortOffset)
+		if err != nil {
+			serfLog.Warn("failed to discover peers from nsqlookupd", logging.ErrorKey, err)
+		} else if len(peers) > 0 {
+			n, err := ag.Join(peers, false)
+			if err != nil {
+				serfLog.Warn("failed to join discovered peers", "peers", strings.Join(peers, " "), logging.ErrorKey, err)
+			} else {
+				serfLog.Info("joined discovered peers", "joined", n, "peers", strings.Join(peers, " "))
+			}
+		}
+
+		select {
+		case <-time.After(o.RetryInterval):
+		case <-ag.ShutdownCh():
+			return
+		}
+	}
+}
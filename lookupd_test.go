@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDiscoverSerfPeers(t *testing.T) {
+	// the current nsqlookupd response format
+	current := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/nodes" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(`{"producers": [
+			{"remote_address": "10.0.0.1:52000", "hostname": "a", "broadcast_address": "a.example", "tcp_port": 4150, "http_port": 4151},
+			{"remote_address": "10.0.0.2:52000", "hostname": "b", "broadcast_address": "b.example", "tcp_port": 5150, "http_port": 5151}
+		]}`))
+	}))
+	defer current.Close()
+
+	// older nsqlookupds wrap the response
+	legacy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"status_code": 200, "status_txt": "OK", "data": {"producers": [
+			{"broadcast_address": "b.example", "tcp_port": 5150},
+			{"broadcast_address": "c.example", "tcp_port": 4150}
+		]}}`))
+	}))
+	defer legacy.Close()
+
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer down.Close()
+
+	lookupds := []string{
+		strings.TrimPrefix(current.URL, "http://"),
+		strings.TrimPrefix(legacy.URL, "http://"),
+		strings.TrimPrefix(down.URL, "http://"),
+	}
+	peers, err := discoverSerfPeers(http.DefaultClient, lookupds, defaultLookupdPortOffset)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"a.example:7946", "b.example:8946", "c.example:7946"}
+	if !reflect.DeepEqual(peers, expected) {
+		t.Fatal("Expected peers", expected, "got", peers)
+	}
+
+	_, err = discoverSerfPeers(http.DefaultClient, lookupds[2:], defaultLookupdPortOffset)
+	if err == nil {
+		t.Fatal("Expected an error when no nsqlookupd can be reached")
+	}
+}
+
+func TestLookupdHTTPAddress(t *testing.T) {
+	addr, err := lookupdHTTPAddress("10.0.0.4:4160")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr != "10.0.0.4:4161" {
+		t.Fatal("Expected 10.0.0.4:4161, got", addr)
+	}
+}
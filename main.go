@@ -1,9 +1,9 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
-	"log"
 	"math/rand"
 	"os"
 	"os/signal"
@@ -17,21 +17,26 @@ import (
 	"github.com/bitly/nsq/nsqd"
 	"github.com/bitly/nsq/util"
 	"github.com/hashicorp/serf/command/agent"
-	"github.com/hashicorp/serf/serf"
 	"github.com/mreiferson/go-options"
+	"github.com/shipwire/ansqd/internal/logging"
 	"github.com/shipwire/ansqd/internal/polity"
 )
 
 var n *nsqd.NSQD
 var a auditor
 
+// resignTimeout bounds how long shutdown waits for held roles to be recalled.
+var resignTimeout = 10 * time.Second
+
 var (
 	flagSet = flag.NewFlagSet("nsqd", flag.ExitOnError)
 
 	// basic options
 	config            = flagSet.String("config", "", "path to config file")
 	showVersion       = flagSet.Bool("version", false, "print version string")
-	verbose           = flagSet.Bool("verbose", false, "enable verbose logging")
+	verbose           = flagSet.Bool("verbose", false, "enable verbose logging, overriding --log-level with debug (reloadable, except for nsqd's own logging)")
+	logLevel          = flagSet.String("log-level", "info", "lowest level of log lines to write: debug, info, warn or error (reloadable)")
+	logFormat         = flagSet.String("log-format", "logfmt", "format of log lines: logfmt or json")
 	workerId          = flagSet.Int64("worker-id", 0, "unique seed for message ID generation (int) in range [0,4096) (will default to a hash of hostname)")
 	httpsAddress      = flagSet.String("https-address", "", "<addr>:<port> to listen on for HTTPS clients")
 	httpAddress       = flagSet.String("http-address", "0.0.0.0:4151", "<addr>:<port> to listen on for HTTP clients")
@@ -48,6 +53,40 @@ var (
 	syncEvery       = flagSet.Int64("sync-every", 2500, "number of messages per diskqueue fsync")
 	syncTimeout     = flagSet.Duration("sync-timeout", 2*time.Second, "duration of time per diskqueue fsync")
 
+	// polity options
+	polityDataPath       = flagSet.String("polity-data-path", "", "path to persist polity roles and votes across restarts (disabled if empty)")
+	polityAuthKeyFile    = flagSet.String("polity-auth-key-file", "", "path to a key shared by every node, used to sign and verify polity messages with HMAC")
+	politySigningKeyFile = flagSet.String("polity-signing-key-file", "", "path to a base64 ed25519 key used to sign polity messages; its public key is advertised to peers in serf tags")
+	polityTrustedKeys    = flagSet.String("polity-trusted-keys-file", "", "path to the base64 ed25519 public keys, one per line, of the peers whose signed polity messages are accepted (required with --polity-signing-key-file)")
+	polityObserver       = flagSet.Bool("polity-observer", false, "join the polity as an observer that tracks roles but neither votes nor runs for them")
+	politySlowElection   = flagSet.Duration("polity-slow-election", 5*time.Second, "log the trace of any election, recall or query step that takes at least this long (0 logs every step)")
+	polityQuorum         = flagSet.Float64("polity-quorum", 0.5, "fraction of voters above which a vote wins, at least 0.5 (reloadable)")
+	polityQuorumMinimum  = flagSet.Int("polity-quorum-minimum", 3, "fewest votes with which a vote can win, at least 3 (reloadable)")
+
+	// audit options
+	auditExpiration = flagSet.Duration("audit-expiration", ExpirationTime(), "duration a message may go unfinished before it is recovered (reloadable)")
+	drainTimeout    = flagSet.Duration("drain-timeout", 30*time.Second, "duration to wait on shutdown for messages in flight to be finished before handing the rest to peers")
+	drainMaxTracked = flagSet.Int64("drain-max-tracked-bytes", 64<<20, "most bytes of unfinished message bodies kept to hand to peers on shutdown; messages beyond it are left to recovery")
+
+	// serf options
+	serfBind             = flagSet.String("serf-bind", "0.0.0.0:7946", "<addr>:<port> to bind serf's gossip listener to")
+	serfAdvertise        = flagSet.String("serf-advertise", "", "<addr>:<port> advertised to other serf members (defaults to the bind address)")
+	serfNodeName         = flagSet.String("serf-node-name", "", "unique name of this node in the serf cluster (defaults to the OS hostname)")
+	serfJoin             = util.StringArray{}
+	serfEncryptKey       = flagSet.String("serf-encrypt-key", "", "base64 key used to encrypt serf gossip; must be the same on every member")
+	serfEncryptKeyFile   = flagSet.String("serf-encrypt-key-file", "", "path to a file holding the base64 key used to encrypt serf gossip")
+	serfKeyringFile      = flagSet.String("serf-keyring-file", "", "path to serf's keyring, created from the encryption key if it does not exist and updated as keys are rotated with 'ansqd keys'")
+	serfTags             = util.StringArray{}
+	serfSnapshotPath     = flagSet.String("serf-snapshot-path", "", "path to a file used to recover serf membership across restarts (disabled if empty)")
+	serfRetryJoin        = util.StringArray{}
+	serfRetryInterval    = flagSet.String("serf-retry-interval", "30s", "duration to wait between --serf-retry-join attempts")
+	serfRetryMaxAttempts = flagSet.Int("serf-retry-max-attempts", 0, "number of --serf-retry-join attempts before exiting (0 retries forever)")
+	serfLookupdAddrs     = util.StringArray{}
+	serfLookupdOffset    = flagSet.Int("serf-lookupd-port-offset", defaultLookupdPortOffset, "difference between a peer's nsqd TCP port and its serf port, used to join peers discovered through nsqlookupd")
+
+	// ansqd options
+	ansqdHTTPAddress = flagSet.String("ansqd-http-address", "127.0.0.1:4155", "<addr>:<port> to listen on for ansqd's admin HTTP API, which also serves Prometheus metrics at /metrics rather than nsqd's --http-address. The default accepts local connections only; listen on a reachable address, such as 0.0.0.0:4155, for Prometheus to scrape it or for kubelet to probe /ansqd/health and /ansqd/ready")
+
 	// msg and command options
 	msgTimeout    = flagSet.String("msg-timeout", "60s", "duration to wait before auto-requeing a message")
 	maxMsgTimeout = flagSet.Duration("max-msg-timeout", 15*time.Minute, "maximum duration before a message will timeout")
@@ -64,10 +103,10 @@ var (
 	maxOutputBufferTimeout = flagSet.Duration("max-output-buffer-timeout", 1*time.Second, "maximum client configurable duration of time between flushing to a client")
 
 	// statsd integration options
-	statsdAddress  = flagSet.String("statsd-address", "", "UDP <addr>:<port> of a statsd daemon for pushing stats")
+	statsdAddress  = flagSet.String("statsd-address", "", "UDP <addr>:<port> of a statsd daemon for pushing stats (reloadable for ansqd's stats; nsqd only pushes if it was set at startup, and keeps the address it started with)")
 	statsdInterval = flagSet.String("statsd-interval", "60s", "duration between pushing to statsd")
 	statsdMemStats = flagSet.Bool("statsd-mem-stats", true, "toggle sending memory and GC stats to statsd")
-	statsdPrefix   = flagSet.String("statsd-prefix", "nsq.%s", "prefix used for keys sent to statsd (%s for host replacement)")
+	statsdPrefix   = flagSet.String("statsd-prefix", "nsq.%s", "prefix used for keys sent to statsd (%s for host replacement) (reloadable for ansqd's stats)")
 
 	// End to end percentile flags
 	e2eProcessingLatencyPercentiles = util.FloatArray{}
@@ -122,9 +161,17 @@ func init() {
 	flagSet.Var(&e2eProcessingLatencyPercentiles, "e2e-processing-latency-percentile", "message processing time percentiles to keep track of (can be specified multiple times or comma separated, default none)")
 	flagSet.Var(&authHttpAddresses, "auth-http-address", "<addr>:<port> to query auth server (may be given multiple times)")
 	flagSet.Var(&tlsRequired, "tls-required", "require TLS for client connections (true, false, tcp-https)")
+	flagSet.Var(&serfJoin, "serf-join", "<addr>:<port> of a serf member to join at startup (may be given multiple times)")
+	flagSet.Var(&serfTags, "serf-tag", "key=value tag advertised to other serf members (may be given multiple times; reloadable from the config file)")
+	flagSet.Var(&serfLookupdAddrs, "serf-lookupd-http-address", "<addr>:<port> of an nsqlookupd HTTP API to discover serf peers from (may be given multiple times; defaults to the port after each --lookupd-tcp-address)")
+	flagSet.Var(&serfRetryJoin, "serf-retry-join", "<addr>:<port> of a serf member to join, retrying until it succeeds (may be given multiple times)")
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "keys" {
+		os.Exit(runKeys(os.Args[2:]))
+	}
+
 	flagSet.Parse(os.Args[1:])
 
 	rand.Seed(time.Now().UTC().UnixNano())
@@ -141,7 +188,7 @@ func main() {
 	if *config != "" {
 		_, err := toml.DecodeFile(*config, &cfg)
 		if err != nil {
-			log.Fatalf("ERROR: failed to load config file %s - %s", *config, err.Error())
+			logger.Fatal("failed to load config file", "path", *config, logging.ErrorKey, err)
 		}
 	}
 	if v, exists := cfg["tls_required"]; exists {
@@ -152,37 +199,139 @@ func main() {
 		}
 	}
 
-	ag, err := agent.Create(agent.DefaultConfig(), serf.DefaultConfig(), os.Stdout)
+	format, err := resolveLogFormat(cfg)
+	if err != nil {
+		logger.Fatal("invalid configuration", logging.ErrorKey, err)
+	}
+	setLogger(logging.New(os.Stderr, format, logging.Info))
+
+	opts := nsqd.NewNSQDOptions()
+	options.Resolve(opts, flagSet, cfg)
+	opts.Logger = logger.With("component", "nsqd").StdLogger(logging.Info)
+
+	settings, err := resolveSettings(cfg)
+	if err != nil {
+		logger.Fatal("invalid configuration", logging.ErrorKey, err)
+	}
+	r := &reloader{path: *config, cfg: cfg, opts: opts}
+	r.apply(settings)
+	r.configureNSQD(settings)
+
+	serfOpts, err := resolveSerfOptions(cfg)
+	if err != nil {
+		logger.Fatal("invalid serf configuration", logging.ErrorKey, err)
+	}
+	agentConfig, serfConfig, err := serfOpts.configs()
 	if err != nil {
-		log.Fatal(err)
+		logger.Fatal("invalid serf configuration", logging.ErrorKey, err)
+	}
+	ag, err := agent.Create(agentConfig, serfConfig, serfLog.Writer(logging.Info))
+	if err != nil {
+		logger.Fatal("failed to create serf agent", logging.ErrorKey, err)
 	}
 	err = ag.Start()
 	if err != nil {
-		log.Fatal(err)
+		logger.Fatal("failed to start serf agent", logging.ErrorKey, err)
+	}
+	err = serfOpts.join(ag)
+	if err != nil {
+		logger.Fatal("failed to join serf cluster", logging.ErrorKey, err)
 	}
+	r.ag = ag
 
-	p := polity.CreateWithAgent(ag)
+	if *polityObserver {
+		err = setAgentTag(ag, polity.ObserverTag, "true")
+		if err != nil {
+			logger.Fatal("failed to advertise polity observer tag", logging.ErrorKey, err)
+		}
+	}
+	err = setAgentTag(ag, nsqdHTTPTag, broadcastHTTPAddress(opts))
+	if err != nil {
+		logger.Fatal("failed to advertise nsqd HTTP address tag", logging.ErrorKey, err)
+	}
+	err = setAgentTag(ag, nsqdTCPTag, broadcastTCPAddress(opts))
+	if err != nil {
+		logger.Fatal("failed to advertise nsqd TCP address tag", logging.ErrorKey, err)
+	}
+	t, err := polityTransport(ag)
+	if err != nil {
+		logger.Fatal("failed to configure polity authentication", logging.ErrorKey, err)
+	}
+	p, err := polity.New(t, *polityDataPath)
+	if err != nil {
+		logger.Fatal("failed to create polity", logging.ErrorKey, err)
+	}
+	p.Exporter = slowSpanLogger{*politySlowElection}
+	p.QuorumFunc = currentQuorum
+	p.Log = polityLog
 	a = auditor{
 		p,
 		ag,
 		make(map[string]*Host),
 		&sync.Mutex{},
+		&auditStats{},
+		newDrainer(*drainMaxTracked),
 	}
+	p.OnEvent = a.forgetDrained
 
 	nsqd.Delegate = &delegate{}
 
-	opts := nsqd.NewNSQDOptions()
-	options.Resolve(opts, flagSet, cfg)
 	n = nsqd.NewNSQD(opts)
+	go a.statsdLoop(opts)
+	go a.follow()
+
+	// a drain requested through the admin API shuts the node down as SIGTERM
+	// does
+	drain := func() {
+		select {
+		case signalChan <- syscall.SIGTERM:
+		default:
+		}
+	}
+	admin, err := newAdminServer(*ansqdHTTPAddress, a, n, drain)
+	if err != nil {
+		logger.Fatal("listen failed", "address", *ansqdHTTPAddress, logging.ErrorKey, err)
+	}
+	go admin.Serve()
 
 	n.LoadMetadata()
 	err = n.PersistMetadata()
 	if err != nil {
-		log.Fatalf("ERROR: failed to persist metadata - %s", err.Error())
+		logger.Fatal("failed to persist metadata", logging.ErrorKey, err)
+	}
+
+	// observers cannot hold roles, so they never coordinate
+	ctx, stopCoordinating := context.WithCancel(context.Background())
+	coordinating := make(chan error, 1)
+	if *polityObserver {
+		coordinating <- nil
+	} else {
+		go func() {
+			coordinating <- p.Campaign(ctx, coordinatorRole, a.coordinate, a.demoted)
+		}()
 	}
 
+	hupChan := make(chan os.Signal, 1)
+	signal.Notify(hupChan, syscall.SIGHUP)
+	go func() {
+		for range hupChan {
+			r.reload()
+		}
+	}()
+
 	n.Main()
 	<-signalChan
+	a.drain(*drainTimeout)
+	stopCoordinating()
+	err = <-coordinating
+	if err != nil && err != context.Canceled {
+		logger.Error("failed to campaign", logging.RoleKey, coordinatorRole, logging.ErrorKey, err)
+	}
+	err = p.ResignAll(resignTimeout)
+	if err != nil {
+		logger.Error("failed to resign roles", logging.ErrorKey, err)
+	}
+	admin.Close()
 	ag.Leave()
 	ag.Shutdown()
 	n.Exit()
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/bitly/nsq/nsqd"
+	"github.com/shipwire/ansqd/internal/metrics"
+)
+
+// metricsHandler serves the polity's metrics, the auditor's and nsqd's stats
+// in the Prometheus text format, for platforms that scrape rather than run
+// statsd. nsqd's HTTP listener cannot take ansqd's handlers, so it is served on
+// the admin listener, which must be given a reachable address to be scraped.
+func metricsHandler(a auditor, n *nsqd.NSQD) http.Handler {
+	audit := a.metricsRegistry()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		metrics.Handler(a.p.Metrics(), audit, nsqdMetrics(n)).ServeHTTP(w, r)
+	})
+}
+
+// metricsRegistry registers the auditor's stats, which are read each time the
+// registry is written.
+func (a auditor) metricsRegistry() *metrics.Registry {
+	r := metrics.NewRegistry()
+	s := a.stats
+
+	r.NewCounterFunc("ansqd_audit_events_total",
+		"Audit events recorded by this node, by event (queue, finish, requeue, touch or receive); their rate is the audit events per second.",
+		"event", counts(map[string]*auditCounter{
+			"queue":   &s.queued,
+			"finish":  &s.finished,
+			"requeue": &s.requeued,
+			"touch":   &s.touched,
+			"receive": &s.received,
+		}))
+	r.NewCounterFunc("ansqd_audit_expirations_total",
+		"Audited messages that went unfinished past the audit expiration.",
+		"", counts(map[string]*auditCounter{"": &s.expirations}))
+	r.NewCounterFunc("ansqd_audit_recoveries_total",
+		"Host recoveries run by this node, by outcome (started, succeeded, failed or cancelled).",
+		"outcome", counts(map[string]*auditCounter{
+			"started":   &s.recoveriesStarted,
+			"succeeded": &s.recoveriesSucceeded,
+			"failed":    &s.recoveriesFailed,
+			"cancelled": &s.recoveriesCancelled,
+		}))
+	r.NewCounterFunc("ansqd_audit_republished_total",
+		"Messages republished while recovering hosts.",
+		"", counts(map[string]*auditCounter{"": &s.republished}))
+	r.NewCounterFunc("ansqd_audit_lag_seconds_total",
+		"Total time received audit records took to arrive; divide by the rate of receive events for the mean lag.",
+		"", func() map[string]float64 {
+			return map[string]float64{"": s.lag.Sum().Seconds()}
+		})
+	r.NewGaugeFunc("ansqd_audit_lag_seconds", "Time the latest audit record received took to arrive.", "", func() map[string]float64 {
+		lag, _ := s.lag.Last()
+		return map[string]float64{"": lag.Seconds()}
+	})
+
+	r.NewGaugeFunc("ansqd_audit_messages", "Messages being audited, by host.", "host", func() map[string]float64 {
+		values := map[string]float64{}
+		for name, hs := range a.hostStats() {
+			values[name] = float64(hs.messages)
+		}
+		return values
+	})
+	r.NewGaugeFunc("ansqd_audit_buckets", "Expiration buckets held, by host.", "host", func() map[string]float64 {
+		values := map[string]float64{}
+		for name, hs := range a.hostStats() {
+			values[name] = float64(hs.buckets)
+		}
+		return values
+	})
+	return r
+}
+
+// counts reads a set of counters keyed by label value.
+func counts(counters map[string]*auditCounter) func() map[string]float64 {
+	return func() map[string]float64 {
+		values := make(map[string]float64, len(counters))
+		for label, c := range counters {
+			values[label] = float64(c.Load())
+		}
+		return values
+	}
+}
+
+// nsqdMetrics builds a registry of nsqd's topic and channel stats as they are
+// now. Topics and channels come and go, so the registry is built afresh for
+// each scrape rather than leaving series behind for those deleted.
+func nsqdMetrics(n *nsqd.NSQD) *metrics.Registry {
+	r := metrics.NewRegistry()
+
+	topicDepth := r.NewGauge("nsqd_topic_depth", "Messages queued in memory and on disk, by topic.", "topic")
+	topicBackendDepth := r.NewGauge("nsqd_topic_backend_depth", "Messages queued on disk, by topic.", "topic")
+	topicMessages := r.NewCounter("nsqd_topic_messages_total", "Messages published, by topic.", "topic")
+
+	channelDepth := r.NewGauge("nsqd_channel_depth", "Messages queued in memory and on disk, by topic and channel.", "topic", "channel")
+	channelBackendDepth := r.NewGauge("nsqd_channel_backend_depth", "Messages queued on disk, by topic and channel.", "topic", "channel")
+	channelInFlight := r.NewGauge("nsqd_channel_in_flight", "Messages sent to consumers and not yet finished, by topic and channel.", "topic", "channel")
+	channelDeferred := r.NewGauge("nsqd_channel_deferred", "Messages deferred by requeues, by topic and channel.", "topic", "channel")
+	channelMessages := r.NewCounter("nsqd_channel_messages_total", "Messages put on the channel, by topic and channel.", "topic", "channel")
+	channelRequeued := r.NewCounter("nsqd_channel_requeued_total", "Messages requeued, by topic and channel.", "topic", "channel")
+	channelTimedOut := r.NewCounter("nsqd_channel_timed_out_total", "Messages that timed out in flight, by topic and channel.", "topic", "channel")
+
+	if n == nil {
+		return r
+	}
+	for _, t := range n.GetStats() {
+		topicDepth.Set(float64(t.Depth), t.TopicName)
+		topicBackendDepth.Set(float64(t.BackendDepth), t.TopicName)
+		topicMessages.Add(float64(t.MessageCount), t.TopicName)
+
+		for _, c := range t.Channels {
+			channelDepth.Set(float64(c.Depth), t.TopicName, c.ChannelName)
+			channelBackendDepth.Set(float64(c.BackendDepth), t.TopicName, c.ChannelName)
+			channelInFlight.Set(float64(c.InFlightCount), t.TopicName, c.ChannelName)
+			channelDeferred.Set(float64(c.DeferredCount), t.TopicName, c.ChannelName)
+			channelMessages.Add(float64(c.MessageCount), t.TopicName, c.ChannelName)
+			channelRequeued.Add(float64(c.RequeueCount), t.TopicName, c.ChannelName)
+			channelTimedOut.Add(float64(c.TimeoutCount), t.TopicName, c.ChannelName)
+		}
+	}
+	return r
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bitly/nsq/nsqd"
+)
+
+func TestAuditMetrics(t *testing.T) {
+	a := auditor{hosts: map[string]*Host{}, hostsLock: &sync.Mutex{}, stats: &auditStats{}}
+	a.GetHost("nsqd-1").AddMessage(nsqd.Message{ID: nsqd.MessageID{1}}, time.Now().Add(time.Minute))
+	a.stats.queued.Inc()
+	a.stats.received.Inc()
+	a.stats.lag.observe(1500 * time.Millisecond)
+	a.stats.recoveriesStarted.Inc()
+	a.stats.recoveriesFailed.Inc()
+
+	buf := &bytes.Buffer{}
+	_, err := a.metricsRegistry().WriteTo(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, line := range []string{
+		`ansqd_audit_events_total{event="queue"} 1`,
+		`ansqd_audit_events_total{event="finish"} 0`,
+		`ansqd_audit_events_total{event="receive"} 1`,
+		`ansqd_audit_expirations_total 0`,
+		`ansqd_audit_recoveries_total{outcome="failed"} 1`,
+		`ansqd_audit_recoveries_total{outcome="started"} 1`,
+		`ansqd_audit_lag_seconds_total 1.5`,
+		`ansqd_audit_lag_seconds 1.5`,
+		`ansqd_audit_messages{host="nsqd-1"} 1`,
+	} {
+		if !strings.Contains(buf.String(), line+"\n") {
+			t.Errorf("Expected %q in\n%s", line, buf.String())
+		}
+	}
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/bitly/nsq/nsqd"
+	"github.com/hashicorp/serf/command/agent"
+	"github.com/shipwire/ansqd/internal/logging"
+	"github.com/shipwire/ansqd/internal/polity"
+)
+
+// reloadable lists the config file settings that are applied when the config
+// is reloaded. Other settings only take effect on restart. Within [serf], only
+// tags are reloadable. nsqd reads its options without synchronization, so
+// reloads of verbose and the statsd settings only reach ansqd's own logs and
+// stats; nsqd keeps those it started with.
+var reloadable = map[string]bool{
+	"verbose":               true,
+	"log_level":             true,
+	"audit_expiration":      true,
+	"polity_quorum":         true,
+	"polity_quorum_minimum": true,
+	"statsd_address":        true,
+	"statsd_prefix":         true,
+	"serf":                  true,
+}
+
+// settings are those that can change while ansqd runs.
+type settings struct {
+	Verbose         bool
+	LogLevel        logging.Level
+	AuditExpiration time.Duration
+	QuorumPercent   float64
+	QuorumMinimum   int
+	StatsdAddress   string
+	StatsdPrefix    string
+	SerfTags        map[string]string
+}
+
+// resolveSettings combines the reloadable settings in cfg with the flags; as at
+// startup, a flag given on the command line takes precedence.
+func resolveSettings(cfg map[string]interface{}) (*settings, error) {
+	set := map[string]bool{}
+	flagSet.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	s := &settings{}
+	var expiration, level string
+	for _, opt := range []struct {
+		flag, key string
+		resolve   func(v interface{}) error
+	}{
+		{"verbose", "verbose", boolOption(&s.Verbose, *verbose)},
+		{"log-level", "log_level", stringOption(&level, *logLevel)},
+		{"audit-expiration", "audit_expiration", stringOption(&expiration, auditExpiration.String())},
+		{"polity-quorum", "polity_quorum", floatOption(&s.QuorumPercent, *polityQuorum)},
+		{"polity-quorum-minimum", "polity_quorum_minimum", intOption(&s.QuorumMinimum, *polityQuorumMinimum)},
+		{"statsd-address", "statsd_address", stringOption(&s.StatsdAddress, *statsdAddress)},
+		{"statsd-prefix", "statsd_prefix", stringOption(&s.StatsdPrefix, *statsdPrefix)},
+	} {
+		err := opt.resolve(cfgValue(cfg, opt.key, set[opt.flag]))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", opt.key, err)
+		}
+	}
+
+	var err error
+	s.LogLevel, err = logging.ParseLevel(level)
+	if err != nil {
+		return nil, fmt.Errorf("log_level: %s", err)
+	}
+	s.AuditExpiration, err = time.ParseDuration(expiration)
+	if err != nil {
+		return nil, fmt.Errorf("audit_expiration: %s", err)
+	}
+	if s.AuditExpiration <= 0 {
+		return nil, fmt.Errorf("audit_expiration: must be positive, got %s", s.AuditExpiration)
+	}
+	// nodes reload separately, so any two of them must agree that at most one
+	// side of a partition can win, whatever their settings
+	if s.QuorumPercent < 0.5 || s.QuorumPercent > 1 {
+		return nil, fmt.Errorf("polity_quorum: must be between 0.5 and 1, got %v", s.QuorumPercent)
+	}
+	if s.QuorumMinimum < 3 {
+		return nil, fmt.Errorf("polity_quorum_minimum: must be at least 3, got %d", s.QuorumMinimum)
+	}
+
+	serfOpts, err := resolveSerfOptions(cfg)
+	if err != nil {
+		return nil, err
+	}
+	s.SerfTags = serfOpts.Tags
+	return s, nil
+}
+
+// boolOption resolves a boolean from the config file, or from its flag if v is
+// nil.
+func boolOption(dst *bool, flagValue bool) func(v interface{}) error {
+	return func(v interface{}) error {
+		if v == nil {
+			*dst = flagValue
+			return nil
+		}
+		b, ok := v.(bool)
+		if !ok {
+			return fmt.Errorf("expected a boolean, got %T", v)
+		}
+		*dst = b
+		return nil
+	}
+}
+
+// floatOption resolves a number from the config file, or from its flag if v is
+// nil.
+func floatOption(dst *float64, flagValue float64) func(v interface{}) error {
+	return func(v interface{}) error {
+		switch f := v.(type) {
+		case nil:
+			*dst = flagValue
+		case float64:
+			*dst = f
+		case int64:
+			*dst = float64(f)
+		default:
+			return fmt.Errorf("expected a number, got %T", v)
+		}
+		return nil
+	}
+}
+
+// quorumPolicy holds the polity.QuorumFunc in force, so that it can be changed
+// while votes are being counted.
+var quorumPolicy atomic.Value
+
+// currentQuorum is the polity.QuorumFunc ansqd's polity uses. It defers to the
+// policy in force.
+func currentQuorum(population int) int {
+	return quorumPolicy.Load().(polity.QuorumFunc)(population)
+}
+
+// statsdSettings are where the auditor pushes its stats.
+type statsdSettings struct {
+	Address string
+	Prefix  string
+}
+
+// statsdConfig holds the statsdSettings in force, so that they can be changed
+// while stats are being pushed.
+var statsdConfig atomic.Value
+
+// currentStatsd returns the statsdSettings in force.
+func currentStatsd() statsdSettings {
+	s, _ := statsdConfig.Load().(statsdSettings)
+	return s
+}
+
+// reloader applies changes to the config file while ansqd runs.
+type reloader struct {
+	path string
+	cfg  map[string]interface{}
+	opts *nsqd.NSQDOptions
+	ag   *agent.Agent
+}
+
+// apply puts s into effect for ansqd. The auditor reads the statsd settings on
+// every push; the push interval is only read at startup.
+func (r *reloader) apply(s *settings) {
+	level := s.LogLevel
+	if s.Verbose {
+		level = logging.Debug
+	}
+	logger.SetLevel(level)
+
+	setExpirationTime(s.AuditExpiration)
+	quorumPolicy.Store(polity.QuorumPercentage(s.QuorumPercent, s.QuorumMinimum))
+
+	statsdConfig.Store(statsdSettings{
+		Address: s.StatsdAddress,
+		Prefix:  expandStatsdPrefix(s.StatsdPrefix, r.opts),
+	})
+}
+
+// configureNSQD puts s into effect for nsqd. It must only be called before nsqd
+// starts, since nsqd reads its options without synchronization. statsd_mem_stats
+// only affects nsqd, so it is not among the settings; nsqd takes it from the
+// config file at startup, and a change is reported on reload as needing a
+// restart.
+func (r *reloader) configureNSQD(s *settings) {
+	r.opts.Verbose = s.Verbose
+	r.opts.StatsdAddress = s.StatsdAddress
+	r.opts.StatsdPrefix = expandStatsdPrefix(s.StatsdPrefix, r.opts)
+}
+
+// reload re-reads the config file, applying the reloadable settings that have
+// changed and logging any others that have, which are ignored until restart.
+func (r *reloader) reload() {
+	if r.path == "" {
+		reloadLog.Warn("no config file to reload")
+		return
+	}
+
+	var cfg map[string]interface{}
+	_, err := toml.DecodeFile(r.path, &cfg)
+	if err != nil {
+		reloadLog.Error("failed to load config file", "path", r.path, logging.ErrorKey, err)
+		return
+	}
+
+	s, err := resolveSettings(cfg)
+	if err != nil {
+		reloadLog.Error("invalid config file", "path", r.path, logging.ErrorKey, err)
+		return
+	}
+
+	// the settings that cannot be applied keep their old values, so that they
+	// are reported again on the next reload
+	for _, key := range changedKeys(r.cfg, cfg) {
+		if !reloadable[key] {
+			reloadLog.Warn("setting cannot be changed without a restart, ignoring it", "setting", key)
+			keep(cfg, r.cfg, key)
+		}
+	}
+	oldSerf, _ := r.cfg["serf"].(map[string]interface{})
+	newSerf, _ := cfg["serf"].(map[string]interface{})
+	for _, key := range changedKeys(oldSerf, newSerf) {
+		if key != "tags" {
+			reloadLog.Warn("setting cannot be changed without a restart, ignoring it", "setting", "serf."+key)
+			keep(newSerf, oldSerf, key)
+		}
+	}
+
+	r.apply(s)
+	err = r.setSerfTags(s.SerfTags)
+	if err != nil {
+		reloadLog.Error("failed to update serf tags", logging.ErrorKey, err)
+	}
+
+	r.cfg = cfg
+	reloadLog.Info("applied config file", "path", r.path)
+}
+
+// keep restores key in cfg to its value in old.
+func keep(cfg, old map[string]interface{}, key string) {
+	if cfg == nil {
+		return
+	}
+	if v, ok := old[key]; ok {
+		cfg[key] = v
+	} else {
+		delete(cfg, key)
+	}
+}
+
+// setSerfTags replaces the configured serf tags, keeping those polity and ansqd
+// set, such as polity.ObserverTag and nsqdHTTPTag.
+func (r *reloader) setSerfTags(configured map[string]string) error {
+	tags := map[string]string{}
+	for k, v := range r.ag.Serf().LocalMember().Tags {
+		if strings.HasPrefix(k, "polity-") || strings.HasPrefix(k, "ansqd-") {
+			tags[k] = v
+		}
+	}
+	for k, v := range configured {
+		if _, ok := tags[k]; !ok {
+			tags[k] = v
+		}
+	}
+
+	if reflect.DeepEqual(tags, r.ag.Serf().LocalMember().Tags) {
+		return nil
+	}
+	return r.ag.SetTags(tags)
+}
+
+// changedKeys lists the keys whose values differ between two configs.
+func changedKeys(before, after map[string]interface{}) []string {
+	keys := []string{}
+	for k, v := range before {
+		if !reflect.DeepEqual(v, after[k]) {
+			keys = append(keys, k)
+		}
+	}
+	for k := range after {
+		if _, ok := before[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestResolveSettings(t *testing.T) {
+	s, err := resolveSettings(map[string]interface{}{
+		"audit_expiration":      "30s",
+		"polity_quorum":         int64(1),
+		"polity_quorum_minimum": int64(4),
+		"serf": map[string]interface{}{
+			"tags": map[string]interface{}{"dc": "east"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.AuditExpiration != 30*time.Second {
+		t.Fatal("Expected an audit expiration of 30s, got", s.AuditExpiration)
+	}
+	if s.QuorumPercent != 1 || s.QuorumMinimum != 4 {
+		t.Fatal("Expected a quorum of 100% and at least 4, got", s.QuorumPercent, s.QuorumMinimum)
+	}
+	if s.StatsdPrefix != *statsdPrefix {
+		t.Fatal("Unset settings should default to their flags, got", s.StatsdPrefix)
+	}
+	if !reflect.DeepEqual(s.SerfTags, map[string]string{"dc": "east"}) {
+		t.Fatal("Expected serf tags from the config, got", s.SerfTags)
+	}
+
+	for _, cfg := range []map[string]interface{}{
+		{"audit_expiration": "soon"},
+		{"audit_expiration": "-1s"},
+		{"polity_quorum": 1.5},
+		{"polity_quorum": 0.4},
+		{"polity_quorum_minimum": int64(0)},
+		{"polity_quorum_minimum": int64(2)},
+		{"verbose": "yes"},
+	} {
+		_, err := resolveSettings(cfg)
+		if err == nil {
+			t.Error("Expected", cfg, "to be rejected")
+		}
+	}
+}
+
+func TestChangedKeys(t *testing.T) {
+	before := map[string]interface{}{"data_path": "/a", "verbose": false, "tcp_address": "0.0.0.0:4150"}
+	after := map[string]interface{}{"data_path": "/b", "verbose": false, "statsd_address": "localhost:8125"}
+
+	keys := changedKeys(before, after)
+	expected := []string{"data_path", "statsd_address", "tcp_address"}
+	if !reflect.DeepEqual(keys, expected) {
+		t.Fatal("Expected", expected, "to have changed, got", keys)
+	}
+
+	keep(after, before, "data_path")
+	keep(after, before, "statsd_address")
+	if after["data_path"] != "/a" {
+		t.Fatal("Expected data_path to be kept, got", after["data_path"])
+	}
+	if _, ok := after["statsd_address"]; ok {
+		t.Fatal("Expected statsd_address to be removed")
+	}
+}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/serf/command/agent"
+	"github.com/hashicorp/serf/serf"
+	"github.com/shipwire/ansqd/internal/logging"
+)
+
+// serfOptions configures the serf agent ansqd gossips over. Each option may be
+// set by a --serf-* flag or by the [serf] section of the config file; as with
+// nsqd's own options, a flag given on the command line takes precedence.
+//
+// Gossip is encrypted if a key is given by encrypt_key or encrypt_key_file. If
+// a keyring file is also given, the key only seeds the keyring when the file
+// does not yet exist; from then on keys are managed with "ansqd keys" and kept
+// in the file.
+//
+// Unless disabled by an empty lookupd_http_addresses, peers are also discovered
+// from the nsqlookupds nsqd registers with. See discoverJoin.
+//
+//	[serf]
+//	bind = "0.0.0.0:7946"
+//	advertise = "10.0.0.1:7946"
+//	node_name = "ansqd-1"
+//	join = ["10.0.0.2:7946"]
+//	encrypt_key = "..."
+//	keyring_file = "/var/lib/ansqd/serf.keyring"
+//	snapshot_path = "/var/lib/ansqd/serf.snapshot"
+//	retry_join = ["10.0.0.3:7946"]
+//	retry_interval = "30s"
+//	retry_max_attempts = 0
+//	lookupd_http_addresses = ["10.0.0.4:4161"]
+//	lookupd_port_offset = 3796
+//
+//	[serf.tags]
+//	dc = "east"
+type serfOptions struct {
+	Bind             string
+	Advertise        string
+	NodeName         string
+	Join             []string
+	EncryptKey       string
+	EncryptKeyFile   string
+	KeyringFile      string
+	Tags             map[string]string
+	SnapshotPath     string
+	RetryJoin        []string
+	RetryInterval    time.Duration
+	RetryMaxAttempts int
+
+	LookupdHTTPAddresses []string
+	LookupdPortOffset    int
+}
+
+// resolveSerfOptions combines the [serf] section of cfg with the --serf-* flags.
+func resolveSerfOptions(cfg map[string]interface{}) (*serfOptions, error) {
+	set := map[string]bool{}
+	flagSet.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	section := map[string]interface{}{}
+	if v, ok := cfg["serf"]; ok {
+		section, ok = v.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("[serf] must be a table, got %T", v)
+		}
+	}
+
+	o := &serfOptions{Tags: map[string]string{}}
+	var retryInterval string
+	var err error
+	for _, opt := range []struct {
+		flag, key string
+		resolve   func(v interface{}) error
+	}{
+		{"serf-bind", "bind", stringOption(&o.Bind, *serfBind)},
+		{"serf-advertise", "advertise", stringOption(&o.Advertise, *serfAdvertise)},
+		{"serf-node-name", "node_name", stringOption(&o.NodeName, *serfNodeName)},
+		{"serf-join", "join", stringsOption(&o.Join, serfJoin)},
+		{"serf-encrypt-key", "encrypt_key", stringOption(&o.EncryptKey, *serfEncryptKey)},
+		{"serf-encrypt-key-file", "encrypt_key_file", stringOption(&o.EncryptKeyFile, *serfEncryptKeyFile)},
+		{"serf-keyring-file", "keyring_file", stringOption(&o.KeyringFile, *serfKeyringFile)},
+		{"serf-tag", "tags", tagsOption(o.Tags, serfTags)},
+		{"serf-snapshot-path", "snapshot_path", stringOption(&o.SnapshotPath, *serfSnapshotPath)},
+		{"serf-retry-join", "retry_join", stringsOption(&o.RetryJoin, serfRetryJoin)},
+		{"serf-retry-interval", "retry_interval", stringOption(&retryInterval, *serfRetryInterval)},
+		{"serf-retry-max-attempts", "retry_max_attempts", intOption(&o.RetryMaxAttempts, *serfRetryMaxAttempts)},
+		{"serf-lookupd-http-address", "lookupd_http_addresses", stringsOption(&o.LookupdHTTPAddresses, serfLookupdAddrs)},
+		{"serf-lookupd-port-offset", "lookupd_port_offset", intOption(&o.LookupdPortOffset, *serfLookupdOffset)},
+	} {
+		err = opt.resolve(cfgValue(section, opt.key, set[opt.flag]))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", opt.key, err)
+		}
+	}
+
+	if o.EncryptKeyFile != "" {
+		if o.EncryptKey != "" {
+			return nil, errors.New("encrypt_key and encrypt_key_file are mutually exclusive")
+		}
+		key, err := ioutil.ReadFile(o.EncryptKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("encrypt_key_file: %s", err)
+		}
+		o.EncryptKey = strings.TrimSpace(string(key))
+	}
+
+	o.RetryInterval, err = time.ParseDuration(retryInterval)
+	if err != nil {
+		return nil, fmt.Errorf("retry_interval: %s", err)
+	}
+
+	_, configured := section["lookupd_http_addresses"]
+	if !set["serf-lookupd-http-address"] && !configured {
+		tcpAddrs := []string{}
+		err = stringsOption(&tcpAddrs, lookupdTCPAddrs)(cfgValue(cfg, "lookupd_tcp_addresses", set["lookupd-tcp-address"]))
+		if err != nil {
+			return nil, fmt.Errorf("lookupd_tcp_addresses: %s", err)
+		}
+		for _, addr := range tcpAddrs {
+			httpAddr, err := lookupdHTTPAddress(addr)
+			if err != nil {
+				return nil, fmt.Errorf("lookupd_tcp_addresses: %s", err)
+			}
+			o.LookupdHTTPAddresses = append(o.LookupdHTTPAddresses, httpAddr)
+		}
+	}
+	return o, nil
+}
+
+// cfgValue looks up key in cfg, returning nil if it is not set or its flag was
+// given on the command line.
+func cfgValue(cfg map[string]interface{}, key string, flagGiven bool) interface{} {
+	if flagGiven {
+		return nil
+	}
+	return cfg[key]
+}
+
+// stringOption resolves a string from the config file, or from its flag if v
+// is nil.
+func stringOption(dst *string, flagValue string) func(v interface{}) error {
+	return func(v interface{}) error {
+		if v == nil {
+			*dst = flagValue
+			return nil
+		}
+		s, ok := v.(string)
+		if !ok {
+			return fmt.Errorf("expected a string, got %T", v)
+		}
+		*dst = s
+		return nil
+	}
+}
+
+// stringsOption resolves a list of strings from the config file, or from its
+// flag if v is nil.
+func stringsOption(dst *[]string, flagValue []string) func(v interface{}) error {
+	return func(v interface{}) error {
+		if v == nil {
+			*dst = append([]string{}, flagValue...)
+			return nil
+		}
+		list, ok := v.([]interface{})
+		if !ok {
+			return fmt.Errorf("expected a list of strings, got %T", v)
+		}
+		for _, item := range list {
+			s, ok := item.(string)
+			if !ok {
+				return fmt.Errorf("expected a list of strings, got a %T", item)
+			}
+			*dst = append(*dst, s)
+		}
+		return nil
+	}
+}
+
+// intOption resolves an integer from the config file, or from its flag if v is
+// nil.
+func intOption(dst *int, flagValue int) func(v interface{}) error {
+	return func(v interface{}) error {
+		if v == nil {
+			*dst = flagValue
+			return nil
+		}
+		i, ok := v.(int64)
+		if !ok {
+			return fmt.Errorf("expected an integer, got %T", v)
+		}
+		*dst = int(i)
+		return nil
+	}
+}
+
+// tagsOption resolves tags from a table in the config file, or from key=value
+// flags if v is nil.
+func tagsOption(dst map[string]string, flagValue []string) func(v interface{}) error {
+	return func(v interface{}) error {
+		if v == nil {
+			for _, tag := range flagValue {
+				parts := strings.SplitN(tag, "=", 2)
+				if len(parts) != 2 {
+					return fmt.Errorf("expected key=value, got %q", tag)
+				}
+				dst[parts[0]] = parts[1]
+			}
+			return nil
+		}
+		table, ok := v.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("expected a table, got %T", v)
+		}
+		for k, tag := range table {
+			s, ok := tag.(string)
+			if !ok {
+				return fmt.Errorf("%s: expected a string, got %T", k, tag)
+			}
+			dst[k] = s
+		}
+		return nil
+	}
+}
+
+// configs builds the agent and serf configuration the options describe,
+// creating the keyring file from the encryption key if it does not exist.
+func (o *serfOptions) configs() (*agent.Config, *serf.Config, error) {
+	ac := agent.DefaultConfig()
+	ac.BindAddr = o.Bind
+	ac.AdvertiseAddr = o.Advertise
+	ac.EncryptKey = o.EncryptKey
+
+	sc := serf.DefaultConfig()
+	if o.NodeName != "" {
+		sc.NodeName = o.NodeName
+		sc.MemberlistConfig.Name = o.NodeName
+	}
+
+	bindIP, bindPort, err := ac.AddrParts(ac.BindAddr)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid bind address: %s", err)
+	}
+	sc.MemberlistConfig.BindAddr = bindIP
+	sc.MemberlistConfig.BindPort = bindPort
+
+	if ac.AdvertiseAddr != "" {
+		advertiseIP, advertisePort, err := ac.AddrParts(ac.AdvertiseAddr)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid advertise address: %s", err)
+		}
+		sc.MemberlistConfig.AdvertiseAddr = advertiseIP
+		sc.MemberlistConfig.AdvertisePort = advertisePort
+	}
+
+	key, err := ac.EncryptBytes()
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid encryption key: %s", err)
+	}
+
+	if o.KeyringFile != "" {
+		_, err := os.Stat(o.KeyringFile)
+		if os.IsNotExist(err) {
+			if key == nil {
+				return nil, nil, fmt.Errorf("keyring file %s does not exist and no encryption key was given to create it", o.KeyringFile)
+			}
+			err = writeKeyring(o.KeyringFile, []string{o.EncryptKey})
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+
+		// the agent loads the keyring, and serf persists changes to it
+		ac.EncryptKey = ""
+		ac.KeyringFile = o.KeyringFile
+		sc.KeyringFile = o.KeyringFile
+	} else {
+		sc.MemberlistConfig.SecretKey = key
+	}
+
+	if len(o.Tags) > 0 {
+		sc.Tags = o.Tags
+	}
+	sc.SnapshotPath = o.SnapshotPath
+
+	return ac, sc, nil
+}
+
+// writeKeyring creates a serf keyring file holding keys.
+func writeKeyring(path string, keys []string) error {
+	b, err := json.Marshal(keys)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, b, 0600)
+}
+
+// join joins the members given by --serf-join, failing if none can be reached,
+// and keeps trying those given by --serf-retry-join or discovered through
+// nsqlookupd in the background.
+func (o *serfOptions) join(ag *agent.Agent) error {
+	if len(o.Join) > 0 {
+		n, err := ag.Join(o.Join, false)
+		if err != nil {
+			return err
+		}
+		serfLog.Info("joined", "joined", n, "peers", strings.Join(o.Join, " "))
+	}
+	if len(o.RetryJoin) > 0 {
+		go o.retryJoin(ag)
+	}
+	if len(o.LookupdHTTPAddresses) > 0 {
+		go o.discoverJoin(ag)
+	}
+	return nil
+}
+
+// retryJoin joins the members given by --serf-retry-join, exiting if none can
+// be reached within the configured number of attempts.
+func (o *serfOptions) retryJoin(ag *agent.Agent) {
+	for attempt := 1; ; attempt++ {
+		n, err := ag.Join(o.RetryJoin, false)
+		if err == nil {
+			serfLog.Info("joined", "joined", n, "peers", strings.Join(o.RetryJoin, " "))
+			return
+		}
+
+		if o.RetryMaxAttempts > 0 && attempt >= o.RetryMaxAttempts {
+			serfLog.Fatal("failed to join serf cluster", "attempts", attempt, logging.ErrorKey, err)
+		}
+		serfLog.Warn("failed to join, retrying", "peers", strings.Join(o.RetryJoin, " "), "retry_in", o.RetryInterval, logging.ErrorKey, err)
+
+		select {
+		case <-time.After(o.RetryInterval):
+		case <-ag.ShutdownCh():
+			return
+		}
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bitly/nsq/nsqd"
+	"github.com/bitly/nsq/util"
+	"github.com/shipwire/ansqd/internal/logging"
+)
+
+// auditCounter counts events since ansqd started.
+type auditCounter struct {
+	n int64
+}
+
+func (c *auditCounter) Inc()        { atomic.AddInt64(&c.n, 1) }
+func (c *auditCounter) Load() int64 { return atomic.LoadInt64(&c.n) }
+
+// auditLag tracks how long audit records take to arrive from the node that
+// published them.
+type auditLag struct {
+	mu         sync.Mutex
+	count      int64
+	total, max time.Duration
+
+	// sum is the lag of every record since ansqd started; it is not reset.
+	sum time.Duration
+
+	// last is the lag of the latest record, received at lastAt.
+	last   time.Duration
+	lastAt time.Time
+}
+
+func (l *auditLag) observe(d time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.count++
+	l.total += d
+	l.sum += d
+	l.last, l.lastAt = d, time.Now()
+	if d > l.max {
+		l.max = d
+	}
+}
+
+// Sum returns the total lag of every record since ansqd started.
+func (l *auditLag) Sum() time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.sum
+}
+
+// Last returns the lag of the latest record and when it was received. at is
+// zero if no record has been received.
+func (l *auditLag) Last() (lag time.Duration, at time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.last, l.lastAt
+}
+
+// reset returns the mean and maximum lag observed since the last reset.
+func (l *auditLag) reset() (count int64, mean, max time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	count, max = l.count, l.max
+	if count > 0 {
+		mean = l.total / time.Duration(count)
+	}
+	l.count, l.total, l.max = 0, 0, 0
+	return count, mean, max
+}
+
+// auditStats counts the auditor's work. The counters are pushed to statsd
+// alongside nsqd's own stats, and exported on /metrics.
+type auditStats struct {
+	queued, finished, requeued, touched, received auditCounter
+	lag                                           auditLag
+
+	expirations auditCounter
+
+	recoveriesStarted, recoveriesSucceeded, recoveriesFailed auditCounter
+	recoveriesCancelled                                      auditCounter
+	republished                                              auditCounter
+}
+
+// statsdHostKey turns an address into a single statsd key segment, as nsqd does
+// for the host replacement in --statsd-prefix.
+func statsdHostKey(addr string) string {
+	return strings.NewReplacer(".", "_", ":", "_").Replace(addr)
+}
+
+// expandStatsdPrefix expands the host replacement in prefix the way nsqd does, using
+// the broadcast address and HTTP port in opts.
+func expandStatsdPrefix(prefix string, opts *nsqd.NSQDOptions) string {
+	if strings.Contains(prefix, "%s") {
+		prefix = strings.Replace(prefix, "%s", statsdHostKey(broadcastHTTPAddress(opts)), -1)
+	}
+	if prefix != "" && !strings.HasSuffix(prefix, ".") {
+		prefix += "."
+	}
+	return prefix
+}
+
+// broadcastHTTPAddress is the address at which peers reach nsqd's HTTP API: the
+// broadcast address with the HTTP port.
+func broadcastHTTPAddress(opts *nsqd.NSQDOptions) string {
+	_, port, _ := net.SplitHostPort(opts.HTTPAddress)
+	return net.JoinHostPort(opts.BroadcastAddress, port)
+}
+
+// broadcastTCPAddress is the address at which peers reach nsqd's TCP listener:
+// the broadcast address with the TCP port.
+func broadcastTCPAddress(opts *nsqd.NSQDOptions) string {
+	_, port, _ := net.SplitHostPort(opts.TCPAddress)
+	return net.JoinHostPort(opts.BroadcastAddress, port)
+}
+
+// statsdLoop pushes the auditor's stats to the statsd daemon nsqd pushes to,
+// under the same prefix, until the serf agent shuts down. The address and
+// prefix are read from statsdConfig on every push, so that they follow config
+// reloads.
+func (a auditor) statsdLoop(opts *nsqd.NSQDOptions) {
+	ticker := time.NewTicker(opts.StatsdInterval)
+	defer ticker.Stop()
+
+	last := map[string]int64{}
+	for {
+		select {
+		case <-ticker.C:
+		case <-a.ag.ShutdownCh():
+			return
+		}
+
+		s := currentStatsd()
+		if s.Address == "" {
+			continue
+		}
+
+		client := util.NewStatsdClient(s.Address, s.Prefix)
+		err := client.CreateSocket()
+		if err != nil {
+			auditLog.Warn("failed to create statsd socket", "address", s.Address, logging.ErrorKey, err)
+			continue
+		}
+		a.pushStats(client, last, opts.StatsdInterval)
+		client.Close()
+	}
+}
+
+// pushStats sends the counters' increases since they were last pushed, interval
+// ago, the rate of audit events and the lag of audit records over the interval,
+// and the current size of each host's audit.
+func (a auditor) pushStats(client *util.StatsdClient, last map[string]int64, interval time.Duration) {
+	s := a.stats
+	var events int64
+	for stat, c := range map[string]*auditCounter{
+		"audit.events.queue":           &s.queued,
+		"audit.events.finish":          &s.finished,
+		"audit.events.requeue":         &s.requeued,
+		"audit.events.touch":           &s.touched,
+		"audit.events.receive":         &s.received,
+		"audit.expirations":            &s.expirations,
+		"audit.recoveries.started":     &s.recoveriesStarted,
+		"audit.recoveries.succeeded":   &s.recoveriesSucceeded,
+		"audit.recoveries.failed":      &s.recoveriesFailed,
+		"audit.recoveries.cancelled":   &s.recoveriesCancelled,
+		"audit.recoveries.republished": &s.republished,
+	} {
+		n := c.Load()
+		client.Incr(stat, n-last[stat])
+		if strings.HasPrefix(stat, "audit.events.") {
+			events += n - last[stat]
+		}
+		last[stat] = n
+	}
+	if interval > 0 {
+		client.Gauge("audit.events.per_second", int64(float64(events)/interval.Seconds()))
+	}
+
+	if count, mean, max := s.lag.reset(); count > 0 {
+		client.Timing("audit.lag.mean", int64(mean/time.Millisecond))
+		client.Timing("audit.lag.max", int64(max/time.Millisecond))
+	}
+
+	hosts := a.hostStats()
+	names := make([]string, 0, len(hosts))
+	for name := range hosts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var totalMessages, totalBuckets int
+	for _, name := range names {
+		hs := hosts[name]
+		totalMessages += hs.messages
+		totalBuckets += hs.buckets
+
+		key := "audit.hosts." + statsdHostKey(name)
+		client.Gauge(key+".messages", int64(hs.messages))
+		client.Gauge(key+".buckets", int64(hs.buckets))
+	}
+	client.Gauge("audit.messages", int64(totalMessages))
+	client.Gauge("audit.buckets", int64(totalBuckets))
+}
+
+// hostStats is the size of a host's audit.
+type hostStats struct {
+	messages, buckets int
+}
+
+// hostStats returns the size of each host's audit.
+func (a auditor) hostStats() map[string]hostStats {
+	a.hostsLock.Lock()
+	hosts := make(map[string]*Host, len(a.hosts))
+	for name, h := range a.hosts {
+		hosts[name] = h
+	}
+	a.hostsLock.Unlock()
+
+	stats := make(map[string]hostStats, len(hosts))
+	for name, h := range hosts {
+		messages, buckets := h.Stats()
+		stats[name] = hostStats{messages, buckets}
+	}
+	return stats
+}
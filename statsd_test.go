@@ -0,0 +1,45 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bitly/nsq/nsqd"
+)
+
+func TestExpandStatsdPrefix(t *testing.T) {
+	opts := &nsqd.NSQDOptions{BroadcastAddress: "nsqd-1.example", HTTPAddress: "0.0.0.0:4151"}
+
+	for prefix, expected := range map[string]string{
+		"nsq.%s": "nsq.nsqd-1_example_4151.",
+		"ansqd.": "ansqd.",
+		"ansqd":  "ansqd.",
+		"":       "",
+	} {
+		if got := expandStatsdPrefix(prefix, opts); got != expected {
+			t.Errorf("Expected %q to expand to %q, got %q", prefix, expected, got)
+		}
+	}
+}
+
+func TestHostStats(t *testing.T) {
+	h := NewHost("nsqd-1")
+	now := time.Now()
+
+	h.AddMessage(nsqd.Message{ID: nsqd.MessageID{1}}, now.Add(time.Minute))
+	h.AddMessage(nsqd.Message{ID: nsqd.MessageID{2}}, now.Add(time.Minute))
+	h.AddMessage(nsqd.Message{ID: nsqd.MessageID{2}}, now.Add(2*time.Minute))
+
+	messages, buckets := h.Stats()
+	if messages != 2 {
+		t.Fatal("Expected 2 tracked messages, got", messages)
+	}
+	if buckets < 2 {
+		t.Fatal("Expected at least 2 buckets, got", buckets)
+	}
+
+	h.RemoveMessage(nsqd.Message{ID: nsqd.MessageID{1}})
+	if messages, _ := h.Stats(); messages != 1 {
+		t.Fatal("Expected 1 tracked message after removing one, got", messages)
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/shipwire/ansqd/internal/polity"
+)
+
+// slowSpanLogger logs polity spans that take longer than threshold, listing
+// when each peer responded so that slow peers stand out.
+type slowSpanLogger struct {
+	threshold time.Duration
+}
+
+func (l slowSpanLogger) ExportSpan(s polity.Span) {
+	took := s.End.Sub(s.Start)
+	if took < l.threshold {
+		return
+	}
+
+	responses := []string{}
+	for _, e := range s.Events {
+		if from, ok := e.Attributes["from"]; ok {
+			responses = append(responses, fmt.Sprintf("%s@%s", from, e.Attributes["elapsed"]))
+		}
+	}
+	sort.Strings(responses)
+
+	attributes := []string{}
+	for k, v := range s.Attributes {
+		attributes = append(attributes, k+"="+v)
+	}
+	sort.Strings(attributes)
+
+	polityLog.Warn("slow "+s.Name, "took", took, "trace", s.TraceID, "span", s.SpanID,
+		"attributes", strings.Join(attributes, " "), "responses", strings.Join(responses, " "))
+}